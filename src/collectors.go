@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"code.cloudfoundry.org/service-metrics-release/scheduler"
+	"go.yaml.in/yaml/v3"
+)
+
+// collectorConfig configures a metrics command that is run on its own
+// interval. Unset intervals, timeouts and formats default to the values of
+// the --metrics-interval, --metrics-cmd-timeout and --metrics-format flags.
+//
+// The metrics command of a daemon collector is started once instead and
+// writes batches of metrics, separated according to its framing, for as long
+// as it runs. Its timeout is the longest it may go without writing a batch.
+//
+// A collector with a URL scrapes it instead of running a command, verifying
+// HTTPS with the CA in CAFile if set. Its format defaults to prometheus.
+//
+// Only the metrics whose name matches Keep and does not match Drop, both
+// anchored regular expressions, are recorded.
+type collectorConfig struct {
+	Name     string            `json:"name" yaml:"name"`
+	Command  string            `json:"command" yaml:"command"`
+	Args     []string          `json:"args" yaml:"args"`
+	URL      string            `json:"url" yaml:"url"`
+	CAFile   string            `json:"ca_file" yaml:"ca_file"`
+	Interval duration          `json:"interval" yaml:"interval"`
+	Timeout  duration          `json:"timeout" yaml:"timeout"`
+	Format   string            `json:"format" yaml:"format"`
+	Labels   map[string]string `json:"labels" yaml:"labels"`
+	Keep     string            `json:"keep" yaml:"keep"`
+	Drop     string            `json:"drop" yaml:"drop"`
+	Daemon   bool              `json:"daemon" yaml:"daemon"`
+	Framing  string            `json:"framing" yaml:"framing"`
+
+	RelabelRules []relabelConfig `json:"relabel_rules" yaml:"relabel_rules"`
+}
+
+// collectorList is configured as a list in the configuration file, as a
+// JSON array of collectors in the COLLECTORS environment variable, or as one
+// JSON object per --collector flag.
+type collectorList []collectorConfig
+
+// collectorList implements flag.Value
+func (c *collectorList) String() string {
+	if c == nil {
+		return "[]"
+	}
+
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+// collectorList implements flag.Value
+func (c *collectorList) Set(value string) error {
+	var collector collectorConfig
+	if err := json.Unmarshal([]byte(value), &collector); err != nil {
+		return err
+	}
+
+	*c = append(*c, collector)
+
+	return nil
+}
+
+// collectorList implements envstruct.Unmarshaller
+func (c *collectorList) UnmarshalEnv(v string) error {
+	return json.Unmarshal([]byte(v), c)
+}
+
+// duration is a time.Duration that is configured as a string such as "10s".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+
+	return nil
+}
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+
+	return nil
+}
+
+// collectors returns the configured collectors with defaults applied. The
+// --metrics-cmd flag configures a collector named "default". Daemon
+// collectors default to NDJSON framing, whose batches are parsed as NDJSON,
+// and URL collectors to the prometheus format.
+func (c config) collectors() []collectorConfig {
+	var collectors []collectorConfig
+	if c.MetricsCmd != "" {
+		collectors = append(collectors, collectorConfig{
+			Name:    "default",
+			Command: c.MetricsCmd,
+			Args:    c.MetricsCmdArgs,
+		})
+	}
+	collectors = append(collectors, c.Collectors...)
+
+	for i := range collectors {
+		if collectors[i].Interval == 0 {
+			collectors[i].Interval = duration(c.MetricsInterval)
+		}
+
+		if collectors[i].Timeout == 0 {
+			collectors[i].Timeout = duration(c.MetricsTimeout)
+		}
+
+		if collectors[i].Daemon && collectors[i].Framing == "" {
+			collectors[i].Framing = string(metrics.FramingNDJSON)
+		}
+
+		if collectors[i].Format == "" {
+			switch {
+			case collectors[i].Framing == string(metrics.FramingNDJSON):
+				collectors[i].Format = string(metrics.FormatNDJSON)
+			case collectors[i].URL != "":
+				collectors[i].Format = string(metrics.FormatPrometheus)
+			default:
+				collectors[i].Format = c.MetricsFormat
+			}
+		}
+	}
+
+	return collectors
+}
+
+func validateCollectors(collectors []collectorConfig) error {
+	if len(collectors) == 0 {
+		return errors.New("no collectors configured, provide --metrics-cmd or --collector")
+	}
+
+	names := make(map[string]bool)
+	for _, c := range collectors {
+		if c.Name == "" {
+			return fmt.Errorf("collector with command %q has no name", c.Command)
+		}
+
+		if names[c.Name] {
+			return fmt.Errorf("collector %q is configured more than once", c.Name)
+		}
+		names[c.Name] = true
+
+		if c.Command == "" && c.URL == "" {
+			return fmt.Errorf("collector %q has no command or url", c.Name)
+		}
+
+		if c.Command != "" && c.URL != "" {
+			return fmt.Errorf("collector %q has both a command and a url", c.Name)
+		}
+
+		if c.URL != "" {
+			if err := validateURL(c); err != nil {
+				return fmt.Errorf("collector %q: %w", c.Name, err)
+			}
+		}
+
+		for _, re := range []string{c.Keep, c.Drop} {
+			if _, err := compileFilter(re); err != nil {
+				return fmt.Errorf("collector %q: %w", c.Name, err)
+			}
+		}
+
+		if _, err := compileRelabelRules("relabel_rules", c.RelabelRules); err != nil {
+			return fmt.Errorf("collector %q: %w", c.Name, err)
+		}
+
+		if c.Interval <= 0 {
+			return fmt.Errorf("collector %q must have a positive interval", c.Name)
+		}
+
+		format, err := metrics.ParseFormat(c.Format)
+		if err != nil {
+			return fmt.Errorf("collector %q: %s", c.Name, err)
+		}
+
+		if c.Daemon && c.URL != "" {
+			return fmt.Errorf("collector %q scrapes a url and cannot be a daemon", c.Name)
+		}
+
+		if !c.Daemon {
+			if c.Framing != "" {
+				return fmt.Errorf("collector %q has a framing but is not a daemon", c.Name)
+			}
+			continue
+		}
+
+		framing, err := metrics.ParseFraming(c.Framing)
+		if err != nil {
+			return fmt.Errorf("collector %q: %s", c.Name, err)
+		}
+
+		if framing == metrics.FramingNDJSON && format != metrics.FormatNDJSON && format != metrics.FormatAuto {
+			return fmt.Errorf("collector %q: %s framing requires the %s or %s format", c.Name, framing, metrics.FormatNDJSON, metrics.FormatAuto)
+		}
+	}
+
+	return nil
+}
+
+// compileFilter compiles a Keep or Drop expression, anchored at both ends
+// like Prometheus does. An empty expression compiles to nil.
+func compileFilter(re string) (*regexp.Regexp, error) {
+	if re == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + re + ")$")
+}
+
+// collector runs one configured metrics command. Each collector has its own
+// Processor and failurePolicy so that failures stay isolated from the other
+// collectors.
+type collector struct {
+	config    collectorConfig
+	processor metrics.Processor
+	failures  *failurePolicy
+	daemon    *daemon
+	scraper   *scraper
+}
+
+// newCollectors creates a collector for each of configs. A collector that
+// replaces one in previous with the same name continues from its recorded
+// totals and run statistics.
+func newCollectors(
+	configs []collectorConfig,
+	previous []*collector,
+	logger lager.Logger,
+	m metrics.Sink,
+	signatures *metrics.Signatures,
+) []*collector {
+	byName := make(map[string]*collector, len(previous))
+	for _, c := range previous {
+		byName[c.config.Name] = c
+	}
+
+	collectors := make([]*collector, 0, len(configs))
+	for _, c := range configs {
+		collectors = append(collectors, newCollector(c, byName[c.Name], logger, m, signatures))
+	}
+
+	return collectors
+}
+
+// collectorOption configures optional collector behaviour.
+type collectorOption func(*collectorOptions)
+
+type collectorOptions struct {
+	report   *metrics.Report
+	executor metrics.Executor
+}
+
+// withReport adds what every run records, renames and rejects to r.
+func withReport(r *metrics.Report) collectorOption {
+	return func(o *collectorOptions) {
+		o.report = r
+	}
+}
+
+// withExecutor runs the metrics command with e instead of running it on
+// the command line, e.g. to record an output that was read from a file.
+func withExecutor(e metrics.Executor) collectorOption {
+	return func(o *collectorOptions) {
+		o.executor = e
+	}
+}
+
+func newCollector(
+	c collectorConfig,
+	prev *collector,
+	logger lager.Logger,
+	m metrics.Sink,
+	signatures *metrics.Signatures,
+	options ...collectorOption,
+) *collector {
+	var o collectorOptions
+	for _, option := range options {
+		option(&o)
+	}
+
+	logger = logger.WithData(lager.Data{"collector": c.Name})
+
+	format, _ := metrics.ParseFormat(c.Format)
+	keep, _ := compileFilter(c.Keep)
+	drop, _ := compileFilter(c.Drop)
+	opts := []metrics.ProcessorOption{
+		metrics.WithFormat(format),
+		metrics.WithStaleGaugeRemoval(cfg.StaleGaugeRuns),
+		metrics.WithLabels(c.Labels),
+		metrics.WithNameFilter(keep, drop),
+		metrics.WithRelabelRules(cfg.relabelRules(c)),
+		metrics.WithSignatures(signatures),
+		metrics.WithInstrumentation(c.Name),
+	}
+
+	if o.report != nil {
+		opts = append(opts, metrics.WithReport(o.report))
+	}
+
+	failures := &failurePolicy{max: cfg.MaxFailures, logger: logger}
+	if prev != nil {
+		opts = append(opts, metrics.WithStateOf(prev.processor))
+		failures.runs = prev.failures.runs
+		failures.failures = prev.failures.failures
+	}
+
+	labels := map[string]string{"collector": c.Name}
+	timeouts := newSinkCounter(
+		m,
+		metrics.ReservedPrefix+"command_timeouts",
+		"Number of metrics command runs killed for exceeding the timeout.",
+		labels,
+	)
+
+	executor := o.executor
+	if executor == nil {
+		executor = NewCommandLineExecutor(logger, time.Duration(c.Timeout), timeouts, cfg.stderrLog())
+	}
+
+	col := &collector{
+		config:    c,
+		processor: metrics.NewProcessor(logger, m, executor, opts...),
+		failures:  failures,
+	}
+
+	if c.Daemon {
+		col.daemon = &daemon{
+			config:    c,
+			processor: &col.processor,
+			logger:    logger,
+			stderr:    cfg.stderrLog(),
+			timeouts:  timeouts,
+			restarts: newSinkCounter(
+				m,
+				metrics.ReservedPrefix+"daemon_restarts",
+				"Number of times the metrics command of a daemon collector was restarted.",
+				labels,
+			),
+		}
+	}
+
+	if c.URL != "" {
+		col.scraper = newScraper(c, logger, timeouts)
+	}
+
+	return col
+}
+
+// collect runs the metrics command one time, scrapes the URL of the
+// collector or, for a daemon collector, runs the metrics command until it has
+// written its first batch.
+func (c *collector) collect(ctx context.Context) error {
+	switch {
+	case c.daemon != nil:
+		return c.daemon.once(ctx)
+	case c.scraper != nil:
+		return c.processor.ProcessFetched(ctx, func() ([]byte, error) {
+			return c.scraper.scrape(ctx)
+		})
+	default:
+		return c.processor.Process(ctx, c.config.Command, c.config.Args...)
+	}
+}
+
+func (c *collector) job() scheduler.Job {
+	if c.daemon != nil {
+		return scheduler.Job{
+			Name:         c.config.Name,
+			Interval:     time.Duration(c.config.Interval),
+			CancelOnStop: true,
+			Run: func(ctx context.Context) {
+				c.daemon.supervise(ctx, c.failures.observe)
+			},
+		}
+	}
+
+	return scheduler.Job{
+		Name:     c.config.Name,
+		Interval: time.Duration(c.config.Interval),
+		Run: func(ctx context.Context) {
+			c.failures.observe(c.collect(ctx))
+		},
+	}
+}
+
+// failurePolicy exits the process once max consecutive runs of the metrics
+// command have failed, including runs that timed out. A max of 0 keeps going
+// regardless of failures. Runs where the command is not ready yet, or that
+// were canceled during shutdown, do not count as failures. For daemon
+// collectors every batch counts as a run, while the command exiting does not
+// as it is restarted.
+type failurePolicy struct {
+	max         int
+	consecutive int
+	runs        int
+	failures    int
+	logger      lager.Logger
+}
+
+func (f *failurePolicy) observe(err error) {
+	f.runs++
+
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if err == nil || errors.Is(err, metrics.ErrNotReady) {
+		f.consecutive = 0
+		return
+	}
+
+	f.failures++
+	f.consecutive++
+	if f.max > 0 && f.consecutive >= f.max {
+		f.logger.Error("processing-metrics", err, lager.Data{
+			"event":                "exiting",
+			"consecutive_failures": f.consecutive,
+		})
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("failurePolicy", func() {
+	var f *failurePolicy
+
+	BeforeEach(func() {
+		f = &failurePolicy{max: 2, logger: lager.NewLogger("test")}
+	})
+
+	It("counts consecutive failures and resets them on success", func() {
+		f.observe(fmt.Errorf("%w: exit status 1", metrics.ErrCommandFailed))
+		Expect(f.consecutive).To(Equal(1))
+
+		f.observe(nil)
+		Expect(f.consecutive).To(BeZero())
+		Expect(f.runs).To(Equal(2))
+		Expect(f.failures).To(Equal(1))
+	})
+
+	It("resets consecutive failures when the command is not ready", func() {
+		f.observe(errors.New("unparsable"))
+		f.observe(metrics.ErrNotReady)
+
+		Expect(f.consecutive).To(BeZero())
+		Expect(f.failures).To(Equal(1))
+	})
+
+	It("does not count runs canceled during shutdown", func() {
+		f.observe(context.Canceled)
+
+		Expect(f.consecutive).To(BeZero())
+		Expect(f.failures).To(BeZero())
+		Expect(f.runs).To(Equal(1))
+	})
+
+	It("keeps going regardless of failures with a max of 0", func() {
+		f.max = 0
+		for i := 0; i < 3; i++ {
+			f.observe(metrics.ErrCommandFailed)
+		}
+
+		Expect(f.consecutive).To(Equal(3))
+	})
+
+	It("counts runs that timed out as failures", func() {
+		f.observe(metrics.ErrTimedOut)
+
+		Expect(f.consecutive).To(Equal(1))
+		Expect(f.failures).To(Equal(1))
+		Expect(f.runs).To(Equal(1))
+	})
+})
+
+var _ = Describe("collector", func() {
+	BeforeEach(func() {
+		cfg = defaultConfig()
+	})
+
+	It("counts a run of the metrics command that times out as a failure", func() {
+		reg := metrics.NewPrometheusRegistry()
+		c := newCollector(collectorConfig{
+			Name:    "slow",
+			Command: "/bin/sleep",
+			Args:    []string{"10"},
+			Timeout: duration(100 * time.Millisecond),
+		}, nil, lager.NewLogger("test"), metrics.NewRegistrySink(reg), metrics.NewSignatures())
+
+		err := c.collect(context.Background())
+		Expect(err).To(MatchError(metrics.ErrTimedOut))
+
+		c.failures.max = 0
+		c.failures.observe(err)
+		Expect(c.failures.failures).To(Equal(1))
+		Expect(c.failures.consecutive).To(Equal(1))
+	})
+})
+
+var _ = Describe("collectors", func() {
+	It("share the signatures of the series they record", func() {
+		logger, logs := newTestLogger()
+		m := metrics.NewPrometheusRegistry()
+		signatures := metrics.NewSignatures()
+
+		gauge := newCollector(collectorConfig{
+			Name:    "gauge",
+			Command: "/bin/echo",
+			Args:    []string{`[{"key": "size", "value": 3, "unit": "bytes"}]`},
+			Format:  "json",
+		}, nil, logger, metrics.NewRegistrySink(m), signatures)
+		counter := newCollector(collectorConfig{
+			Name:    "counter",
+			Command: "/bin/echo",
+			Args:    []string{`[{"name": "size", "delta": 1}]`},
+			Format:  "json",
+		}, nil, logger, metrics.NewRegistrySink(m), signatures)
+
+		Expect(gauge.processor.Process(context.Background(), gauge.config.Command, gauge.config.Args...)).To(Succeed())
+		Expect(counter.processor.Process(context.Background(), counter.config.Command, counter.config.Args...)).To(Succeed())
+
+		Expect(logs.data("recording-metric")).To(ContainElement(And(
+			HaveKeyWithValue("event", "skipped"),
+			HaveKeyWithValue("name", "size"),
+			HaveKeyWithValue("collector", "counter"),
+		)))
+	})
+})
@@ -1,33 +1,125 @@
 package main
 
 import (
-	"os"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os/exec"
 	"syscall"
+	"time"
 
+	egress "code.cloudfoundry.org/go-metric-registry"
 	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/service-metrics-release/metrics"
 )
 
+// waitDelay is how long the output of a command that has exited, or was
+// killed, is still read. A process the command started in a session of its
+// own, which killing the process group of the command does not kill, may hold
+// on to the output pipes forever. A command that exited successfully but left
+// its output open that long still succeeds.
+const waitDelay = 5 * time.Second
+
 // CommandLineExecutor implements metrics.Executor
 type CommandLineExecutor struct {
-	logger metrics.Logger
+	logger    metrics.Logger
+	timeout   time.Duration
+	timeouts  egress.Counter
+	stderr    stderrLog
+	waitDelay time.Duration
 }
 
-func NewCommandLineExecutor(l metrics.Logger) CommandLineExecutor {
+// NewCommandLineExecutor returns an executor that kills the command and its
+// process group when it runs longer than timeout, counting every such kill.
+// A zero timeout lets the command run forever. Only stdout is returned as the
+// output of the command, stderr is logged line by line as configured.
+func NewCommandLineExecutor(l metrics.Logger, timeout time.Duration, timeouts egress.Counter, stderr stderrLog) CommandLineExecutor {
 	return CommandLineExecutor{
-		logger: l,
+		logger:    l,
+		timeout:   timeout,
+		timeouts:  timeouts,
+		stderr:    stderr,
+		waitDelay: waitDelay,
 	}
 }
 
 func (e CommandLineExecutor) Run(c *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	c.Stdout = &out
+
+	if err := e.run(c, &out); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// Stream implements metrics.StreamingExecutor. The stdout of the command is
+// handed to read, while stderr is logged like it is by Run. Any output read
+// does not consume is discarded.
+func (e CommandLineExecutor) Stream(c *exec.Cmd, read func(io.Reader)) error {
+	// Unlike the pipe of StdoutPipe, which has to be read to the end before
+	// waiting for the command, stdout is copied into this pipe while waiting,
+	// so that it is closed once the wait delay has expired.
+	r, w := io.Pipe()
+	c.Stdout = w
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		read(r)
+		_, _ = io.Copy(io.Discard, r)
+	}()
+
+	err := e.run(c, nil)
+	_ = w.Close()
+	<-done
+
+	return err
+}
+
+// run runs the command and logs and classifies how it exited. out, the
+// buffered stdout if not nil, is logged when it fails.
+func (e CommandLineExecutor) run(c *exec.Cmd, out *bytes.Buffer) error {
 	action := "executing-metrics-cmd"
 
 	e.logger.Info(action, lager.Data{
 		"event": "starting",
 	})
 
-	out, err := c.CombinedOutput()
+	stderr := e.stderr.writer(e.logger)
+	c.Stderr = stderr
+
+	err := e.wait(c)
+	stderr.flush()
+
+	if errors.Is(err, exec.ErrWaitDelay) {
+		e.logger.Info(action, lager.Data{
+			"event":      "output-left-open",
+			"wait_delay": e.waitDelay.String(),
+		})
+		err = nil
+	}
+
+	if err == context.Canceled {
+		e.logger.Info(action, lager.Data{
+			"event":  "canceled",
+			"output": output(out),
+		})
+		return err
+	}
+
+	if err == metrics.ErrTimedOut {
+		e.logger.Error(action, err, lager.Data{
+			"event":   "timed-out",
+			"timeout": e.timeout.String(),
+			"output":  output(out),
+		})
+		e.timeouts.Add(1)
+		return err
+	}
 
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
@@ -35,28 +127,81 @@ func (e CommandLineExecutor) Run(c *exec.Cmd) ([]byte, error) {
 				"event":  "failed",
 				"output": "no metrics command has been configured, cannot collect metrics",
 			})
-			os.Exit(1)
+			return fmt.Errorf("%w: %w", metrics.ErrCommandFailed, err)
 		}
 
 		exitStatus := c.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
 		if exitStatus == 10 {
 			e.logger.Info(action, lager.Data{
 				"event":  "not yet ready to emit metrics",
-				"output": string(out),
+				"output": output(out),
 			})
-			return nil, err
+			return fmt.Errorf("%w: %w", metrics.ErrNotReady, err)
 		}
 
 		e.logger.Error(action, err, lager.Data{
 			"event":  "failed",
-			"output": string(out),
+			"output": output(out),
 		})
-		os.Exit(0)
+		return fmt.Errorf("%w: %w", metrics.ErrCommandFailed, err)
 	}
 
 	e.logger.Info(action, lager.Data{
 		"event": "done",
 	})
 
-	return out, nil
+	return nil
+}
+
+// wait starts the command and waits for it to exit. The command runs in its
+// own process group so that the command and anything it started can be
+// killed together once the timeout expires or its context is canceled. Its
+// output is read for at most the wait delay after that.
+func (e CommandLineExecutor) wait(c *exec.Cmd) error {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.WaitDelay = e.waitDelay
+
+	canceled := false
+	if c.Cancel != nil {
+		c.Cancel = func() error {
+			canceled = true
+			return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		}
+	}
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if e.timeout > 0 {
+		timer := time.NewTimer(e.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-done:
+		if canceled {
+			return context.Canceled
+		}
+		return err
+	case <-timeout:
+		_ = syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		<-done
+		return metrics.ErrTimedOut
+	}
+}
+
+func output(out *bytes.Buffer) string {
+	if out == nil {
+		return ""
+	}
+
+	return out.String()
 }
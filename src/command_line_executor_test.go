@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CommandLineExecutor", func() {
+	var (
+		logger   lager.Logger
+		logs     *logSink
+		timeouts *spyCounter
+		pidFile  string
+	)
+
+	BeforeEach(func() {
+		logger, logs = newTestLogger()
+		timeouts = &spyCounter{}
+		pidFile = filepath.Join(GinkgoT().TempDir(), "pid")
+	})
+
+	newExecutor := func(timeout time.Duration) CommandLineExecutor {
+		return NewCommandLineExecutor(logger, timeout, timeouts, stderrLog{level: lager.INFO})
+	}
+
+	It("returns stdout and logs stderr line by line", func() {
+		out, err := newExecutor(0).Run(exec.Command("/bin/sh", "-c", "echo out; echo one >&2; echo two >&2"))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("out\n"))
+
+		var lines []interface{}
+		for _, d := range logs.data("executing-metrics-cmd") {
+			if d["event"] == "stderr" {
+				lines = append(lines, d["line"])
+			}
+		}
+		Expect(lines).To(Equal([]interface{}{"one", "two"}))
+		Expect(logs.events("executing-metrics-cmd")).To(HaveExactElements("starting", "stderr", "stderr", "done"))
+	})
+
+	It("streams stdout and logs stderr", func() {
+		var out []byte
+		err := newExecutor(0).Stream(exec.Command("/bin/sh", "-c", "echo out; echo err >&2"), func(r io.Reader) {
+			out, _ = io.ReadAll(r)
+		})
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("out\n"))
+		Expect(logs.events("executing-metrics-cmd")).To(ContainElement("stderr"))
+	})
+
+	It("classifies how the command exited", func() {
+		_, err := newExecutor(0).Run(exec.Command("/bin/sh", "-c", "exit 10"))
+		Expect(err).To(MatchError(metrics.ErrNotReady))
+
+		_, err = newExecutor(0).Run(exec.Command("/bin/sh", "-c", "echo partial; exit 1"))
+		Expect(err).To(MatchError(metrics.ErrCommandFailed))
+		Expect(logs.data("executing-metrics-cmd")).To(ContainElement(HaveKeyWithValue("output", "partial\n")))
+
+		_, err = newExecutor(0).Run(exec.Command("/does/not/exist"))
+		Expect(err).To(MatchError(metrics.ErrCommandFailed))
+	})
+
+	It("kills the whole process group once the timeout expires", func() {
+		// The command ignores SIGTERM and starts a grandchild that holds on
+		// to its stdout.
+		cmd := exec.Command("/bin/sh", "-c", `trap '' TERM; sleep 30 & echo $! > `+pidFile+`; wait`)
+
+		start := time.Now()
+		_, err := newExecutor(200 * time.Millisecond).Run(cmd)
+
+		Expect(err).To(MatchError(metrics.ErrTimedOut))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(timeouts.value()).To(Equal(1.0))
+		Expect(logs.events("executing-metrics-cmd")).To(ContainElement("timed-out"))
+
+		Expect(processExited(cmd.Process.Pid)).To(BeTrue())
+		grandchild := readPid(pidFile)
+		Eventually(func() bool { return processExited(grandchild) }).Should(BeTrue())
+	})
+
+	Context("when the command starts a process in a session of its own", func() {
+		// The grandchild is not in the process group of the command, so it is
+		// not killed with it and holds on to its stdout and stderr.
+		var script string
+
+		newExecutor := func(timeout time.Duration) CommandLineExecutor {
+			e := newExecutor(timeout)
+			e.waitDelay = 100 * time.Millisecond
+			return e
+		}
+
+		BeforeEach(func() {
+			script = `echo out; setsid sleep 30 & echo $! > ` + pidFile + `; `
+			DeferCleanup(func() {
+				_ = syscall.Kill(readPid(pidFile), syscall.SIGKILL)
+			})
+		})
+
+		It("stops reading the output of a command that exited after the wait delay", func() {
+			out, err := newExecutor(0).Run(exec.Command("/bin/sh", "-c", script+"exit 0"))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(out)).To(Equal("out\n"))
+			Expect(logs.events("executing-metrics-cmd")).To(HaveExactElements("starting", "output-left-open", "done"))
+		})
+
+		It("stops waiting for a command that timed out after the wait delay", func() {
+			start := time.Now()
+			_, err := newExecutor(200 * time.Millisecond).Run(exec.Command("/bin/sh", "-c", script+"sleep 30"))
+
+			Expect(err).To(MatchError(metrics.ErrTimedOut))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+
+		It("stops streaming the output of a command that was canceled after the wait delay", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cmd := exec.CommandContext(ctx, "/bin/sh", "-c", script+"sleep 30")
+
+			done := make(chan error, 1)
+			var out []byte
+			go func() {
+				done <- newExecutor(0).Stream(cmd, func(r io.Reader) {
+					out, _ = io.ReadAll(r)
+				})
+			}()
+
+			readPid(pidFile)
+			cancel()
+
+			Eventually(done, 5*time.Second).Should(Receive(MatchError(context.Canceled)))
+			Expect(string(out)).To(Equal("out\n"))
+		})
+	})
+
+	It("kills the whole process group when the context is canceled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", `trap '' TERM; sleep 30 & echo $! > `+pidFile+`; wait`)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := newExecutor(0).Run(cmd)
+			done <- err
+		}()
+
+		grandchild := readPid(pidFile)
+		cancel()
+
+		Eventually(done).Should(Receive(MatchError(context.Canceled)))
+		Eventually(func() bool { return processExited(grandchild) }).Should(BeTrue())
+		Expect(timeouts.value()).To(BeZero())
+		Expect(logs.events("executing-metrics-cmd")).To(ContainElement("canceled"))
+	})
+})
+
+// spyCounter is a counter that records its value.
+type spyCounter struct {
+	mu sync.Mutex
+	n  float64
+}
+
+func (c *spyCounter) Add(delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.n += delta
+}
+
+func (c *spyCounter) value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.n
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/go-envstruct"
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"code.cloudfoundry.org/service-metrics-release/otlp"
+	"code.cloudfoundry.org/service-metrics-release/remotewrite"
+	"go.yaml.in/yaml/v3"
+)
+
+// config is read from the optional YAML or JSON file given by --config or
+// CONFIG_FILE, then from the environment and finally from flags, each
+// overriding the values set by the previous one. See README.md for the
+// configuration file schema. Only the settings tagged reload:"true" take
+// effect when the configuration is reloaded, the others on restart.
+type config struct {
+	ConfigFile                string        `env:"CONFIG_FILE, report" yaml:"-" reload:"true"`
+	Origin                    string        `env:"ORIGIN, report" yaml:"origin"`
+	MetricsInterval           time.Duration `env:"METRICS_INTERVAL, report" yaml:"metrics_interval" reload:"true"`
+	MetricsCmd                string        `env:"METRICS_CMD, report" yaml:"metrics_cmd" reload:"true"`
+	MetricsCmdArgs            multiFlag     `env:"METRICS_CMD_ARG" yaml:"metrics_cmd_args" reload:"true"`
+	Collectors                collectorList `env:"COLLECTORS" yaml:"collectors" reload:"true"`
+	RelabelRules              relabelList   `env:"RELABEL_RULES" yaml:"relabel_rules"`
+	MetricsTimeout            time.Duration `env:"METRICS_CMD_TIMEOUT, report" yaml:"metrics_cmd_timeout" reload:"true"`
+	MetricsFormat             string        `env:"METRICS_FORMAT, report" yaml:"metrics_format" reload:"true"`
+	StderrLogLevel            string        `env:"METRICS_CMD_STDERR_LOG_LEVEL, report" yaml:"metrics_cmd_stderr_log_level" reload:"true"`
+	StderrMaxBytes            int           `env:"METRICS_CMD_STDERR_MAX_BYTES, report" yaml:"metrics_cmd_stderr_max_bytes" reload:"true"`
+	MaxFailures               int           `env:"MAX_CONSECUTIVE_FAILURES, report" yaml:"max_consecutive_failures" reload:"true"`
+	StaleGaugeRuns            int           `env:"STALE_GAUGE_RUNS, report" yaml:"stale_gauge_runs" reload:"true"`
+	ShutdownGracePeriod       time.Duration `env:"SHUTDOWN_GRACE_PERIOD, report" yaml:"shutdown_grace_period" reload:"true"`
+	FinalScrapeWait           time.Duration `env:"FINAL_SCRAPE_WAIT, report" yaml:"final_scrape_wait" reload:"true"`
+	PushAddress               string        `env:"PUSH_ADDRESS, report" yaml:"push_address"`
+	PushSocket                string        `env:"PUSH_SOCKET, report" yaml:"push_socket"`
+	StatsDAddress             string        `env:"STATSD_ADDRESS, report" yaml:"statsd_address"`
+	StatsDFlushInterval       time.Duration `env:"STATSD_FLUSH_INTERVAL, report" yaml:"statsd_flush_interval"`
+	LoggregatorAddress        string        `env:"LOGGREGATOR_ADDRESS, report" yaml:"loggregator_address"`
+	LoggregatorCAFile         string        `env:"LOGGREGATOR_CA_FILE_PATH, report" yaml:"loggregator_ca_file_path"`
+	LoggregatorCertFile       string        `env:"LOGGREGATOR_CERT_FILE_PATH, report" yaml:"loggregator_cert_file_path"`
+	LoggregatorKeyFile        string        `env:"LOGGREGATOR_KEY_FILE_PATH, report" yaml:"loggregator_key_file_path"`
+	LoggregatorInterval       time.Duration `env:"LOGGREGATOR_FLUSH_INTERVAL, report" yaml:"loggregator_flush_interval"`
+	SourceID                  string        `env:"SOURCE_ID, report" yaml:"source_id"`
+	InstanceID                string        `env:"INSTANCE_ID, report" yaml:"instance_id"`
+	OTLPEndpoint              string        `env:"OTLP_ENDPOINT, report" yaml:"otlp_endpoint"`
+	OTLPProtocol              string        `env:"OTLP_PROTOCOL, report" yaml:"otlp_protocol"`
+	OTLPInterval              time.Duration `env:"OTLP_EXPORT_INTERVAL, report" yaml:"otlp_export_interval"`
+	OTLPCAFile                string        `env:"OTLP_CA_FILE_PATH, report" yaml:"otlp_ca_file_path"`
+	OTLPCertFile              string        `env:"OTLP_CERT_FILE_PATH, report" yaml:"otlp_cert_file_path"`
+	OTLPKeyFile               string        `env:"OTLP_KEY_FILE_PATH, report" yaml:"otlp_key_file_path"`
+	OTLPResourceAttributes    stringMap     `env:"OTLP_RESOURCE_ATTRIBUTES, report" yaml:"otlp_resource_attributes"`
+	RemoteWriteURL            string        `env:"REMOTE_WRITE_URL, report" yaml:"remote_write_url"`
+	RemoteWriteInterval       time.Duration `env:"REMOTE_WRITE_INTERVAL, report" yaml:"remote_write_interval"`
+	RemoteWriteQueueSize      int           `env:"REMOTE_WRITE_QUEUE_SIZE, report" yaml:"remote_write_queue_size"`
+	RemoteWriteUsername       string        `env:"REMOTE_WRITE_USERNAME, report" yaml:"remote_write_username"`
+	RemoteWritePassword       string        `env:"REMOTE_WRITE_PASSWORD" yaml:"remote_write_password"`
+	RemoteWriteBearerToken    string        `env:"REMOTE_WRITE_BEARER_TOKEN" yaml:"remote_write_bearer_token"`
+	RemoteWriteCAFile         string        `env:"REMOTE_WRITE_CA_FILE_PATH, report" yaml:"remote_write_ca_file_path"`
+	RemoteWriteCertFile       string        `env:"REMOTE_WRITE_CERT_FILE_PATH, report" yaml:"remote_write_cert_file_path"`
+	RemoteWriteKeyFile        string        `env:"REMOTE_WRITE_KEY_FILE_PATH, report" yaml:"remote_write_key_file_path"`
+	RemoteWriteExternalLabels stringMap     `env:"REMOTE_WRITE_EXTERNAL_LABELS, report" yaml:"remote_write_external_labels"`
+	Debug                     bool          `env:"DEBUG, report" yaml:"debug"`
+	Port                      int           `env:"PORT, report" yaml:"port"`
+	CAFile                    string        `env:"CA_FILE_PATH, report" yaml:"ca_file_path"`
+	CertFile                  string        `env:"CERT_FILE_PATH, report" yaml:"cert_file_path"`
+	KeyFile                   string        `env:"KEY_FILE_PATH, report" yaml:"key_file_path"`
+}
+
+var cfg config
+
+func defaultConfig() config {
+	return config{
+		MetricsInterval:      time.Minute,
+		MetricsFormat:        string(metrics.FormatJSON),
+		StderrLogLevel:       "info",
+		StderrMaxBytes:       64 * 1024,
+		MaxFailures:          1,
+		ShutdownGracePeriod:  10 * time.Second,
+		StatsDFlushInterval:  10 * time.Second,
+		LoggregatorInterval:  15 * time.Second,
+		OTLPProtocol:         string(otlp.ProtocolGRPC),
+		OTLPInterval:         time.Minute,
+		RemoteWriteQueueSize: 100,
+	}
+}
+
+// parseConfig loads the configuration from the command line, exiting when it
+// is invalid.
+func parseConfig() {
+	var err error
+	cfg, err = loadConfig(flag.CommandLine, os.Args[1:])
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\nInvalid configuration: %s", err)
+		os.Exit(1)
+	}
+
+	err = envstruct.WriteReport(&cfg)
+	if err != nil {
+		log.Panicf("error writing report: %s", err)
+	}
+}
+
+// reloadConfig loads the configuration again from the same command line.
+// Since flags and the environment of a running process do not change, only
+// changes to the configuration file take effect.
+func reloadConfig() (config, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	c, err := loadConfig(fs, os.Args[1:])
+	if err != nil {
+		return config{}, err
+	}
+
+	return c, c.validate()
+}
+
+// loadConfig reads the configuration file, the environment and then the
+// flags in args, defining the flags on fs.
+func loadConfig(fs *flag.FlagSet, args []string) (config, error) {
+	c := defaultConfig()
+
+	c.ConfigFile = configFileFromArgs(args, os.Getenv("CONFIG_FILE"))
+	if c.ConfigFile != "" {
+		if err := loadConfigFile(c.ConfigFile, &c); err != nil {
+			return config{}, fmt.Errorf("invalid --config: %w", err)
+		}
+	}
+
+	if err := envstruct.Load(&c); err != nil {
+		return config{}, fmt.Errorf("invalid environment: %w", err)
+	}
+
+	// Multi-valued flags replace the values from the file and environment
+	// rather than adding to them.
+	cmdArgs, collectors, relabelRules := c.MetricsCmdArgs, c.Collectors, c.RelabelRules
+	c.MetricsCmdArgs, c.Collectors, c.RelabelRules = nil, nil, nil
+
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "Path to a YAML or JSON configuration file, overridden by environment variables and flags")
+	fs.StringVar(&c.Origin, "origin", c.Origin, "Required. Source name for metrics emitted by this process, e.g. service-name")
+	fs.StringVar(&c.MetricsCmd, "metrics-cmd", c.MetricsCmd, "Path to metrics command, required unless --collector is given")
+	fs.Var(&c.MetricsCmdArgs, "metrics-cmd-arg", "Argument to pass on to metrics-cmd (multi-valued)")
+	fs.Var(&c.Collectors, "collector", `Additional named collector as a JSON object with "name", "command" or "url", and optionally "args", "interval", "timeout", "format", "labels", "keep", "drop", "relabel_rules", "daemon" and "framing" (multi-valued)`)
+	fs.Var(&c.RelabelRules, "relabel-rule", `Relabel rule applied to the metrics of every collector as a JSON object with "action" (keep, drop, replace, labelmap, labeldrop or hashmod) and optionally "source_labels", "separator", "regex", "target_label", "replacement" and "modulus" (multi-valued)`)
+	fs.DurationVar(&c.MetricsInterval, "metrics-interval", c.MetricsInterval, "Interval to run metrics-cmd")
+	fs.DurationVar(&c.MetricsTimeout, "metrics-cmd-timeout", c.MetricsTimeout, "Time after which metrics-cmd and its process group are killed, 0 to never kill it")
+	fs.StringVar(&c.MetricsFormat, "metrics-format", c.MetricsFormat, "Format of the metrics-cmd output: json, ndjson, prometheus or auto")
+	fs.StringVar(&c.StderrLogLevel, "metrics-cmd-stderr-log-level", c.StderrLogLevel, "Level to log the stderr of metrics-cmd at: debug, info or error")
+	fs.IntVar(&c.StderrMaxBytes, "metrics-cmd-stderr-max-bytes", c.StderrMaxBytes, "Maximum number of bytes of the stderr of a metrics-cmd run to log, 0 to log all of it")
+	fs.IntVar(&c.MaxFailures, "max-consecutive-failures", c.MaxFailures, "Exit after this many consecutive failed or timed out runs of metrics-cmd, 0 to never exit")
+	fs.IntVar(&c.StaleGaugeRuns, "stale-gauge-runs", c.StaleGaugeRuns, "Stop exporting gauges metrics-cmd has not reported for this many consecutive runs, 0 to keep them forever")
+	fs.DurationVar(&c.ShutdownGracePeriod, "shutdown-grace-period", c.ShutdownGracePeriod, "Time to wait for a running metrics-cmd to finish on SIGTERM or SIGINT before killing it")
+	fs.DurationVar(&c.FinalScrapeWait, "final-scrape-wait", c.FinalScrapeWait, "Time to keep serving metrics after the last run of metrics-cmd on shutdown, the whole shutdown takes at most this plus the grace period")
+	fs.StringVar(&c.PushAddress, "push-address", c.PushAddress, "Address such as 127.0.0.1:8081 to accept metrics POSTed by co-located services on, disabled if empty")
+	fs.StringVar(&c.PushSocket, "push-socket", c.PushSocket, "Path of a unix domain socket, accessible to the user and group of the process, to accept metrics POSTed by co-located services on, disabled if empty")
+	fs.StringVar(&c.StatsDAddress, "statsd-address", c.StatsDAddress, "UDP address such as 127.0.0.1:8125 to receive StatsD metrics on, disabled if empty")
+	fs.DurationVar(&c.StatsDFlushInterval, "statsd-flush-interval", c.StatsDFlushInterval, "Interval to record the StatsD metrics received in")
+	fs.StringVar(&c.LoggregatorAddress, "loggregator-address", c.LoggregatorAddress, "Address such as localhost:3458 of the Loggregator agent to send metrics to over gRPC, disabled if empty")
+	fs.DurationVar(&c.LoggregatorInterval, "loggregator-flush-interval", c.LoggregatorInterval, "Interval to send metrics to the Loggregator agent in")
+	fs.StringVar(&c.SourceID, "source-id", c.SourceID, "Source ID of the envelopes sent to the Loggregator agent, defaults to --origin")
+	fs.StringVar(&c.InstanceID, "instance-id", c.InstanceID, "Instance ID of the envelopes sent to the Loggregator agent")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "URL such as http://localhost:4317 of an OTLP receiver to export metrics to, disabled if empty")
+	fs.StringVar(&c.OTLPProtocol, "otlp-protocol", c.OTLPProtocol, "Protocol to export metrics to the OTLP receiver with: grpc or http/protobuf")
+	fs.DurationVar(&c.OTLPInterval, "otlp-export-interval", c.OTLPInterval, "Interval to export metrics to the OTLP receiver in")
+	fs.StringVar(&c.RemoteWriteURL, "remote-write-url", c.RemoteWriteURL, "URL such as http://localhost:9090/api/v1/write of a Prometheus remote write endpoint to write metrics to, disabled if empty")
+	fs.DurationVar(&c.RemoteWriteInterval, "remote-write-interval", c.RemoteWriteInterval, "Interval to write metrics to the remote write endpoint in, defaults to --metrics-interval")
+	fs.IntVar(&c.RemoteWriteQueueSize, "remote-write-queue-size", c.RemoteWriteQueueSize, "Maximum number of requests to queue while the remote write endpoint cannot be written to")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "Output debug logging")
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	if len(c.MetricsCmdArgs) == 0 {
+		c.MetricsCmdArgs = cmdArgs
+	}
+
+	if len(c.Collectors) == 0 {
+		c.Collectors = collectors
+	}
+
+	if len(c.RelabelRules) == 0 {
+		c.RelabelRules = relabelRules
+	}
+
+	return c, nil
+}
+
+func (c config) validate() error {
+	if c.Origin == "" {
+		return errors.New("must provide --origin")
+	}
+
+	if _, err := metrics.ParseFormat(c.MetricsFormat); err != nil {
+		return fmt.Errorf("invalid --metrics-format: %w", err)
+	}
+
+	if err := validateStderrLogLevel(c.StderrLogLevel); err != nil {
+		return err
+	}
+
+	if c.statsdEnabled() && c.StatsDFlushInterval <= 0 {
+		return errors.New("invalid --statsd-flush-interval: must be positive")
+	}
+
+	if c.loggregatorEnabled() {
+		if c.LoggregatorCAFile == "" || c.LoggregatorCertFile == "" || c.LoggregatorKeyFile == "" {
+			return errors.New("invalid --loggregator-address: LOGGREGATOR_CA_FILE_PATH, LOGGREGATOR_CERT_FILE_PATH and LOGGREGATOR_KEY_FILE_PATH are required")
+		}
+
+		if c.LoggregatorInterval <= 0 {
+			return errors.New("invalid --loggregator-flush-interval: must be positive")
+		}
+	}
+
+	if c.otlpEnabled() {
+		if _, err := otlp.ParseProtocol(c.OTLPProtocol); err != nil {
+			return fmt.Errorf("invalid --otlp-protocol: %w", err)
+		}
+
+		if _, err := otlp.NewClient(otlp.Protocol(c.OTLPProtocol), c.OTLPEndpoint, nil); err != nil {
+			return fmt.Errorf("invalid --otlp-endpoint: %w", err)
+		}
+
+		if c.OTLPInterval <= 0 {
+			return errors.New("invalid --otlp-export-interval: must be positive")
+		}
+
+		if (c.OTLPCertFile == "") != (c.OTLPKeyFile == "") {
+			return errors.New("invalid --otlp-endpoint: OTLP_CERT_FILE_PATH and OTLP_KEY_FILE_PATH must be set together")
+		}
+
+		if _, err := clientTLSConfig(c.OTLPCAFile, c.OTLPCertFile, c.OTLPKeyFile); err != nil {
+			return fmt.Errorf("invalid --otlp-endpoint: %w", err)
+		}
+	}
+
+	if c.remoteWriteEnabled() {
+		if _, err := remotewrite.NewClient(c.RemoteWriteURL, nil); err != nil {
+			return fmt.Errorf("invalid --remote-write-url: %w", err)
+		}
+
+		if c.RemoteWriteInterval < 0 {
+			return errors.New("invalid --remote-write-interval: must not be negative")
+		}
+
+		if c.RemoteWriteQueueSize <= 0 {
+			return errors.New("invalid --remote-write-queue-size: must be positive")
+		}
+
+		if c.RemoteWriteBearerToken != "" && c.RemoteWriteUsername != "" {
+			return errors.New("invalid --remote-write-url: REMOTE_WRITE_USERNAME and REMOTE_WRITE_BEARER_TOKEN are mutually exclusive")
+		}
+
+		if c.RemoteWritePassword != "" && c.RemoteWriteUsername == "" {
+			return errors.New("invalid --remote-write-url: REMOTE_WRITE_PASSWORD requires REMOTE_WRITE_USERNAME")
+		}
+
+		if (c.RemoteWriteCertFile == "") != (c.RemoteWriteKeyFile == "") {
+			return errors.New("invalid --remote-write-url: REMOTE_WRITE_CERT_FILE_PATH and REMOTE_WRITE_KEY_FILE_PATH must be set together")
+		}
+
+		if _, err := clientTLSConfig(c.RemoteWriteCAFile, c.RemoteWriteCertFile, c.RemoteWriteKeyFile); err != nil {
+			return fmt.Errorf("invalid --remote-write-url: %w", err)
+		}
+	}
+
+	if _, err := compileRelabelRules("relabel_rules", c.RelabelRules); err != nil {
+		return fmt.Errorf("invalid --relabel-rule: %w", err)
+	}
+
+	// Metrics can be pushed or sent over StatsD instead of collected, so no
+	// collector has to be configured then.
+	collectors := c.collectors()
+	if len(collectors) == 0 && (c.pushEnabled() || c.statsdEnabled()) {
+		return nil
+	}
+
+	if err := validateCollectors(collectors); err != nil {
+		return fmt.Errorf("invalid collectors: %w", err)
+	}
+
+	for _, col := range collectors {
+		if col.Name == pushCollector && c.pushEnabled() || col.Name == statsdCollector && c.statsdEnabled() {
+			return fmt.Errorf("invalid collectors: collector name %q is reserved", col.Name)
+		}
+	}
+
+	return nil
+}
+
+func (c config) pushEnabled() bool {
+	return c.PushAddress != "" || c.PushSocket != ""
+}
+
+func (c config) statsdEnabled() bool {
+	return c.StatsDAddress != ""
+}
+
+func (c config) loggregatorEnabled() bool {
+	return c.LoggregatorAddress != ""
+}
+
+func (c config) otlpEnabled() bool {
+	return c.OTLPEndpoint != ""
+}
+
+func (c config) remoteWriteEnabled() bool {
+	return c.RemoteWriteURL != ""
+}
+
+// remoteWriteInterval returns the interval to write metrics to the remote
+// write endpoint in, which is the metrics interval unless it is set.
+func (c config) remoteWriteInterval() time.Duration {
+	if c.RemoteWriteInterval > 0 {
+		return c.RemoteWriteInterval
+	}
+
+	return c.MetricsInterval
+}
+
+// sourceID returns the source ID of the envelopes sent to the Loggregator
+// agent.
+func (c config) sourceID() string {
+	if c.SourceID != "" {
+		return c.SourceID
+	}
+
+	return c.Origin
+}
+
+func validateStderrLogLevel(level string) error {
+	switch level {
+	case "debug", "info", "error":
+		return nil
+	}
+
+	return fmt.Errorf("invalid --metrics-cmd-stderr-log-level: unknown log level %q, must be one of debug, info or error", level)
+}
+
+// stderrLog returns how the stderr of metrics commands is logged.
+func (c config) stderrLog() stderrLog {
+	level, _ := lager.LogLevelFromString(c.StderrLogLevel)
+
+	return stderrLog{level: level, maxBytes: c.StderrMaxBytes}
+}
+
+// restartRequired returns the settings that differ in next but only take
+// effect when service metrics is restarted, named after their key in the
+// configuration file.
+func (c config) restartRequired(next config) []string {
+	current, updated := reflect.ValueOf(c), reflect.ValueOf(next)
+
+	var settings []string
+	for _, f := range restartFields() {
+		if !reflect.DeepEqual(current.FieldByIndex(f.Index).Interface(), updated.FieldByIndex(f.Index).Interface()) {
+			settings = append(settings, strings.Split(f.Tag.Get("yaml"), ",")[0])
+		}
+	}
+
+	return settings
+}
+
+// withRestartSettingsOf returns c with the settings that only take effect on
+// restart set to those of prev.
+func (c config) withRestartSettingsOf(prev config) config {
+	current, previous := reflect.ValueOf(&c).Elem(), reflect.ValueOf(prev)
+	for _, f := range restartFields() {
+		current.FieldByIndex(f.Index).Set(previous.FieldByIndex(f.Index))
+	}
+
+	return c
+}
+
+// restartFields returns the fields of config that are not tagged
+// reload:"true".
+func restartFields() []reflect.StructField {
+	var fields []reflect.StructField
+	for _, f := range reflect.VisibleFields(reflect.TypeOf(config{})) {
+		if f.Tag.Get("reload") != "true" {
+			fields = append(fields, f)
+		}
+	}
+
+	return fields
+}
+
+// configFileFromArgs returns the value of the --config flag, which has to be
+// known before the remaining flags are parsed, falling back to def.
+func configFileFromArgs(args []string, def string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+
+		if hasValue {
+			return value
+		}
+
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return def
+}
+
+// loadConfigFile decodes the YAML or JSON file at path into c, rejecting any
+// keys that are not part of the configuration schema.
+func loadConfigFile(path string, c *config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d := yaml.NewDecoder(f)
+	d.KnownFields(true)
+
+	err = d.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+type multiFlag []string
+
+// multiFlag implements flag.Value
+func (m *multiFlag) String() string {
+	if m == nil {
+		return "[]"
+	}
+
+	return fmt.Sprint([]string(*m))
+}
+
+// multiFlag implements flag.Value
+func (m *multiFlag) Set(value string) error {
+	*m = append(*m, value)
+
+	return nil
+}
+
+// multiFlag implements envstruct.Unmarshaller
+func (m *multiFlag) UnmarshalEnv(v string) error {
+	*m = multiFlag{v}
+	return nil
+}
+
+// stringMap is configured as a YAML mapping or, in the environment, as a
+// comma-separated list of key=value pairs.
+type stringMap map[string]string
+
+// stringMap implements envstruct.Unmarshaller
+func (a *stringMap) UnmarshalEnv(v string) error {
+	m := make(stringMap)
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return fmt.Errorf("invalid pair %q, must be key=value", pair)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	*a = m
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("loadConfig", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+
+		return path
+	}
+
+	load := func(args ...string) (config, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+
+		return loadConfig(fs, args)
+	}
+
+	DescribeTable("overrides the file with the environment and the environment with flags",
+		func(env map[string]string, args []string, origin string, interval time.Duration) {
+			path := writeFile("config.yml", "origin: from-file\nmetrics_interval: 1s\n")
+			for k, v := range env {
+				GinkgoT().Setenv(k, v)
+			}
+
+			c, err := load(append([]string{"--config", path}, args...)...)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.ConfigFile).To(Equal(path))
+			Expect(c.Origin).To(Equal(origin))
+			Expect(c.MetricsInterval).To(Equal(interval))
+		},
+		Entry("file", nil, nil, "from-file", time.Second),
+		Entry("environment", map[string]string{"ORIGIN": "from-env"}, nil, "from-env", time.Second),
+		Entry("flag", map[string]string{"ORIGIN": "from-env"}, []string{"--origin", "from-flag"}, "from-flag", time.Second),
+		Entry("flag without environment", nil, []string{"--metrics-interval", "2s"}, "from-file", 2*time.Second),
+	)
+
+	It("keeps the defaults that nothing overrides", func() {
+		c, err := load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(Equal(defaultConfig()))
+	})
+
+	It("replaces multi-valued settings from the file and environment with flags", func() {
+		path := writeFile("config.yml", `
+metrics_cmd_args: [--from-file]
+collectors:
+- name: from-file
+  command: /bin/true
+relabel_rules:
+- action: drop
+  source_labels: [from_file]
+`)
+		GinkgoT().Setenv("METRICS_CMD_ARG", "--from-env")
+
+		c, err := load("--config", path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.MetricsCmdArgs).To(Equal(multiFlag{"--from-env"}))
+		Expect(c.Collectors).To(HaveLen(1))
+		Expect(c.RelabelRules).To(HaveLen(1))
+
+		c, err = load(
+			"--config", path,
+			"--metrics-cmd-arg", "--from-flag",
+			"--collector", `{"name": "from-flag", "command": "/bin/true"}`,
+			"--relabel-rule", `{"action": "keep", "source_labels": ["from_flag"]}`,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.MetricsCmdArgs).To(Equal(multiFlag{"--from-flag"}))
+		Expect(c.Collectors).To(HaveLen(1))
+		Expect(c.Collectors[0].Name).To(Equal("from-flag"))
+		Expect(c.RelabelRules).To(HaveLen(1))
+		Expect(c.RelabelRules[0].Action).To(Equal("keep"))
+	})
+
+	It("reads the configuration file named by CONFIG_FILE", func() {
+		GinkgoT().Setenv("CONFIG_FILE", writeFile("config.json", `{"origin": "from-json"}`))
+
+		c, err := load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Origin).To(Equal("from-json"))
+	})
+
+	DescribeTable("rejects keys that are not part of the configuration",
+		func(name, content string) {
+			_, err := load("--config", writeFile(name, content))
+			Expect(err).To(MatchError(ContainSubstring("invalid --config")))
+			Expect(err).To(MatchError(ContainSubstring("orgin")))
+		},
+		Entry("YAML", "config.yml", "orgin: typo\n"),
+		Entry("JSON", "config.json", `{"orgin": "typo"}`),
+		Entry("nested YAML", "config.yml", "collectors:\n- name: a\n  orgin: typo\n"),
+	)
+
+	It("rejects a configuration file that does not exist", func() {
+		_, err := load("--config", filepath.Join(dir, "missing.yml"))
+		Expect(err).To(MatchError(ContainSubstring("invalid --config")))
+	})
+
+	It("accepts an empty configuration file", func() {
+		c, err := load("--config", writeFile("config.yml", ""))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Origin).To(BeEmpty())
+	})
+})
+
+var _ = DescribeTable("configFileFromArgs",
+	func(args []string, expected string) {
+		Expect(configFileFromArgs(args, "default.yml")).To(Equal(expected))
+	},
+	Entry("no flag", []string{"--origin", "o"}, "default.yml"),
+	Entry("separate value", []string{"--origin", "o", "--config", "c.yml"}, "c.yml"),
+	Entry("single dash", []string{"-config", "c.yml"}, "c.yml"),
+	Entry("joined value", []string{"--config=c.yml"}, "c.yml"),
+	Entry("joined value with a single dash", []string{"-config=c.yml"}, "c.yml"),
+	Entry("missing value", []string{"--config"}, "default.yml"),
+	Entry("after the end of the flags", []string{"--", "--config", "c.yml"}, "default.yml"),
+	Entry("flag value that looks like the flag", []string{"config", "c.yml"}, "default.yml"),
+	Entry("other flag with the same prefix", []string{"--config-file", "c.yml"}, "default.yml"),
+)
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	egress "code.cloudfoundry.org/go-metric-registry"
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+const (
+	// minRestartBackoff is how long a daemon collector waits before
+	// restarting its metrics command the first time it exited. The wait
+	// doubles on every restart until maxRestartBackoff, and starts over once
+	// the command has written a batch.
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+
+	// daemonStopTimeout is how long the metrics command of a daemon collector
+	// has to exit after SIGTERM before it is killed.
+	daemonStopTimeout = 5 * time.Second
+)
+
+// daemon runs the metrics command of a daemon collector, which is started
+// once and keeps writing batches of metrics to stdout instead of being run
+// on every interval.
+type daemon struct {
+	config    collectorConfig
+	processor *metrics.Processor
+	logger    lager.Logger
+	stderr    stderrLog
+	timeouts  egress.Counter
+	restarts  egress.Counter
+}
+
+// supervise runs the metrics command until ctx is canceled, restarting it
+// with backoff whenever it exits. The result of recording every batch is
+// passed to observe.
+func (d daemon) supervise(ctx context.Context, observe func(error)) {
+	var backoff time.Duration
+	for {
+		batches, _ := d.run(ctx, 0, observe)
+		if ctx.Err() != nil {
+			return
+		}
+
+		backoff = restartBackoff(backoff, batches)
+		d.logger.Info("running-metrics-daemon", lager.Data{
+			"event":   "restarting",
+			"backoff": backoff.String(),
+		})
+		d.restarts.Add(1)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// restartBackoff returns how long to wait before restarting a metrics
+// command that exited after recording the given number of batches. previous
+// is the wait before the last restart, or 0 if there was none.
+func restartBackoff(previous time.Duration, batches int) time.Duration {
+	if previous == 0 || batches > 0 {
+		return minRestartBackoff
+	}
+
+	return min(2*previous, maxRestartBackoff)
+}
+
+// once runs the metrics command until it has written its first batch and
+// returns the result of recording it.
+func (d daemon) once(ctx context.Context) error {
+	var result error
+	if _, err := d.run(ctx, 1, func(err error) { result = err }); err != nil {
+		return err
+	}
+
+	return result
+}
+
+// run starts the metrics command and records every batch it writes, passing
+// the result to observe, until the command exits, ctx is canceled or, unless
+// max is 0, max batches have been recorded, after which the command is
+// stopped. It returns the number of batches recorded and nil if the command
+// was stopped after max batches, or why it exited otherwise. A command that
+// writes no batch for longer than the timeout of the collector is killed.
+func (d daemon) run(ctx context.Context, max int, observe func(error)) (int, error) {
+	action := "running-metrics-daemon"
+	framing, _ := metrics.ParseFraming(d.config.Framing)
+	timeout := time.Duration(d.config.Timeout)
+
+	stopCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	cmd := exec.CommandContext(stopCtx, d.config.Command, d.config.Args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = daemonStopTimeout
+
+	stderr := d.stderr.writer(d.logger)
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", metrics.ErrCommandFailed, err)
+	}
+
+	d.logger.Info(action, lager.Data{
+		"event": "starting",
+	})
+
+	if err := cmd.Start(); err != nil {
+		d.logger.Error(action, err, lager.Data{
+			"event": "failed",
+		})
+		return 0, fmt.Errorf("%w: %w", metrics.ErrCommandFailed, err)
+	}
+
+	var timedOut atomic.Bool
+	var watchdog *time.Timer
+	if timeout > 0 {
+		watchdog = time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+	}
+
+	reader := metrics.NewBatchReader(stdout, framing)
+	batches := 0
+	var readErr error
+	for max == 0 || batches < max {
+		var batch []byte
+		batch, readErr = reader.Next()
+		if readErr != nil {
+			break
+		}
+
+		if watchdog != nil {
+			watchdog.Reset(timeout)
+		}
+		stderr.reset()
+
+		batches++
+		observe(d.processor.ProcessBatch(batch))
+	}
+
+	// Once max batches have been read, or the output cannot be framed any
+	// more, the command is stopped. Otherwise it has closed its output and
+	// is expected to exit.
+	if readErr == nil || !isEOF(readErr) {
+		stop()
+	}
+
+	err = cmd.Wait()
+	if watchdog != nil {
+		watchdog.Stop()
+	}
+	stderr.flush()
+
+	if ctx.Err() != nil {
+		d.logger.Info(action, lager.Data{
+			"event": "canceled",
+		})
+		return batches, ctx.Err()
+	}
+
+	if timedOut.Load() {
+		d.logger.Error(action, metrics.ErrTimedOut, lager.Data{
+			"event":   "timed-out",
+			"timeout": timeout.String(),
+		})
+		d.timeouts.Add(1)
+		return batches, metrics.ErrTimedOut
+	}
+
+	if readErr == nil {
+		d.logger.Info(action, lager.Data{
+			"event": "done",
+		})
+		return batches, nil
+	}
+
+	if !isEOF(readErr) {
+		d.logger.Error(action, readErr, lager.Data{
+			"event":   "reading batch failed",
+			"framing": framing,
+		})
+		return batches, fmt.Errorf("%w: %w", metrics.ErrParseFailed, readErr)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 10 {
+		d.logger.Info(action, lager.Data{
+			"event": "not yet ready to emit metrics",
+		})
+		return batches, fmt.Errorf("%w: %w", metrics.ErrNotReady, err)
+	}
+
+	if err == nil {
+		err = errors.New("metrics command exited")
+	}
+
+	d.logger.Error(action, err, lager.Data{
+		"event":   "exited",
+		"batches": batches,
+	})
+
+	return batches, fmt.Errorf("%w: %w", metrics.ErrCommandFailed, err)
+}
+
+func isEOF(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
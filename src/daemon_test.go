@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("daemon", func() {
+	var (
+		logger   lager.Logger
+		logs     *logSink
+		restarts *spyCounter
+		pidFile  string
+	)
+
+	BeforeEach(func() {
+		cfg = defaultConfig()
+		logger, logs = newTestLogger()
+		restarts = &spyCounter{}
+		pidFile = filepath.Join(GinkgoT().TempDir(), "pid")
+	})
+
+	newDaemon := func(script string) *daemon {
+		c := newCollector(collectorConfig{
+			Name:    "test",
+			Command: "/bin/sh",
+			Args:    []string{"-c", "echo $$ > " + pidFile + "; " + script},
+			Daemon:  true,
+			Framing: string(metrics.FramingNDJSON),
+			Format:  string(metrics.FormatNDJSON),
+		}, nil, logger, metrics.NewRegistrySink(metrics.NewPrometheusRegistry()), metrics.NewSignatures())
+		c.daemon.restarts = restarts
+
+		return c.daemon
+	}
+
+	// observed records the results passed to the observe function of
+	// supervise.
+	type observed struct {
+		mu      sync.Mutex
+		results []error
+	}
+
+	It("restarts the metrics command after the backoff once it exits", func() {
+		d := newDaemon(`echo '{"name": "c", "delta": 1}'; echo`)
+
+		var o observed
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			d.supervise(ctx, func(err error) {
+				o.mu.Lock()
+				defer o.mu.Unlock()
+				o.results = append(o.results, err)
+			})
+		}()
+
+		Eventually(func() []error {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			return o.results
+		}).WithTimeout(5 * time.Second).Should(HaveExactElements(BeNil(), BeNil()))
+
+		cancel()
+		Eventually(done).Should(BeClosed())
+
+		Expect(restarts.value()).To(BeNumerically(">=", 1))
+		Expect(logs.data("running-metrics-daemon")).To(ContainElement(And(
+			HaveKeyWithValue("event", "restarting"),
+			HaveKeyWithValue("backoff", minRestartBackoff.String()),
+		)))
+	})
+
+	It("stops the metrics command when the context is canceled", func() {
+		d := newDaemon(`trap 'exit 0' TERM; while true; do sleep 0.1; done`)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			d.supervise(ctx, func(error) {})
+		}()
+
+		pid := readPid(pidFile)
+		cancel()
+
+		Eventually(done).Should(BeClosed())
+		Eventually(func() bool { return processExited(pid) }).Should(BeTrue())
+		Expect(restarts.value()).To(BeZero())
+		Expect(logs.events("running-metrics-daemon")).To(ContainElement("canceled"))
+	})
+
+	It("stops the metrics command once it has written its first batch", func() {
+		d := newDaemon(`while true; do echo '{"name": "c", "delta": 1}'; echo; sleep 0.1; done`)
+
+		Expect(d.once(context.Background())).To(Succeed())
+		Eventually(func() bool { return processExited(readPid(pidFile)) }).Should(BeTrue())
+		Expect(logs.events("running-metrics-daemon")).To(ContainElement("done"))
+	})
+
+	It("kills a metrics command that writes no batch within the timeout", func() {
+		d := newDaemon(`trap '' TERM; sleep 30`)
+		d.config.Timeout = duration(100 * time.Millisecond)
+
+		start := time.Now()
+		Expect(d.once(context.Background())).To(MatchError(metrics.ErrTimedOut))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+})
+
+var _ = DescribeTable("restartBackoff",
+	func(previous time.Duration, batches int, expected time.Duration) {
+		Expect(restartBackoff(previous, batches)).To(Equal(expected))
+	},
+	Entry("first restart", time.Duration(0), 0, minRestartBackoff),
+	Entry("first restart after batches", time.Duration(0), 3, minRestartBackoff),
+	Entry("doubles while no batch is recorded", minRestartBackoff, 0, 2*minRestartBackoff),
+	Entry("doubles again", 4*minRestartBackoff, 0, 8*minRestartBackoff),
+	Entry("stops at the max", maxRestartBackoff, 0, maxRestartBackoff),
+	Entry("does not exceed the max", 3*maxRestartBackoff/4, 0, maxRestartBackoff),
+	Entry("starts over once a batch is recorded", maxRestartBackoff, 1, minRestartBackoff),
+)
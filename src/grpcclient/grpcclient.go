@@ -0,0 +1,157 @@
+// Package grpcclient makes unary gRPC calls on top of the HTTP/2 support of
+// net/http, for the few gRPC services service metrics sends metrics to
+// without depending on a gRPC implementation.
+package grpcclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxResponseSize is the largest response message that is read.
+const maxResponseSize = 4 * 1024 * 1024
+
+// StatusError is returned when the server responds with a gRPC status other
+// than OK.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", e.Code, e.Message)
+}
+
+// Retryable reports whether the call may succeed when it is retried: its
+// status is CANCELLED, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED, ABORTED,
+// OUT_OF_RANGE, UNAVAILABLE or DATA_LOSS.
+func (e *StatusError) Retryable() bool {
+	switch e.Code {
+	case 1, 4, 8, 10, 11, 14, 15:
+		return true
+	}
+
+	return false
+}
+
+// NewHTTPClient returns a client for calls over TLS with tlsConfig or, if it
+// is nil, over cleartext HTTP/2.
+func NewHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if tlsConfig == nil {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// URL returns the URL of method, such as /package.Service/Method, on the
+// server listening on addr.
+func URL(addr string, secure bool, method string) string {
+	u := url.URL{Scheme: "http", Host: addr, Path: method}
+	if secure {
+		u.Scheme = "https"
+	}
+
+	return u.String()
+}
+
+// Invoke sends the encoded request message msg to the method at url and
+// returns the encoded response message.
+func Invoke(ctx context.Context, client *http.Client, url string, msg []byte) ([]byte, error) {
+	// A gRPC message is prefixed with an uncompressed flag and its length.
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		return nil, fmt.Errorf("server responded with %s instead of HTTP/2", resp.Proto)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// The trailers are only available once the body has been read.
+	out, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+5))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := status(resp); err != nil {
+		return nil, err
+	}
+
+	if len(out) < 5 {
+		return nil, nil
+	}
+
+	if out[0] != 0 {
+		return nil, errors.New("compressed responses are not supported")
+	}
+
+	n := binary.BigEndian.Uint32(out[1:5])
+	if int(n) > len(out)-5 {
+		return nil, fmt.Errorf("response message of %d bytes is truncated", n)
+	}
+
+	return out[5 : 5+n], nil
+}
+
+// status returns the error of the gRPC status in the trailers of resp, or in
+// its headers for a response without a body.
+func status(resp *http.Response) error {
+	code := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+
+	if code == "" {
+		return errors.New("server responded without a grpc status")
+	}
+
+	c, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("invalid grpc status %q", code)
+	}
+
+	if c != 0 {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return &StatusError{Code: c, Message: message}
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package grpcclient_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/service-metrics-release/grpcclient"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// echo responds to every call with the request message.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	_, _ = w.Write(body)
+	w.Header().Set("Grpc-Status", "0")
+})
+
+var _ = Describe("Invoke over TLS", func() {
+	var (
+		ca     *x509.Certificate
+		caKey  *ecdsa.PrivateKey
+		pool   *x509.CertPool
+		server *httptest.Server
+	)
+
+	// keyPair returns a certificate signed by the CA.
+	keyPair := func(usage x509.ExtKeyUsage) tls.Certificate {
+		cert, key := newCertificate(ca, caKey, usage)
+
+		return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+	}
+
+	invoke := func(tlsConfig *tls.Config) ([]byte, error) {
+		client := grpcclient.NewHTTPClient(tlsConfig)
+		url := grpcclient.URL(server.Listener.Addr().String(), true, "/test.Service/Echo")
+
+		return grpcclient.Invoke(context.Background(), client, url, []byte("message"))
+	}
+
+	BeforeEach(func() {
+		ca, caKey = newCertificate(nil, nil, x509.ExtKeyUsageAny)
+		pool = x509.NewCertPool()
+		pool.AddCert(ca)
+
+		// The server requires a client certificate signed by the CA.
+		server = httptest.NewUnstartedServer(echo)
+		server.EnableHTTP2 = true
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{keyPair(x509.ExtKeyUsageServerAuth)},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+		server.StartTLS()
+		DeferCleanup(server.Close)
+	})
+
+	It("calls a server that trusts the client certificate over HTTP/2", func() {
+		out, err := invoke(&tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{keyPair(x509.ExtKeyUsageClientAuth)},
+		})
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("message"))
+	})
+
+	It("fails without a client certificate", func() {
+		_, err := invoke(&tls.Config{RootCAs: pool})
+
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails with a client certificate the server does not trust", func() {
+		otherCA, otherKey := newCertificate(nil, nil, x509.ExtKeyUsageAny)
+		cert, key := newCertificate(otherCA, otherKey, x509.ExtKeyUsageClientAuth)
+
+		_, err := invoke(&tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		})
+
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("does not trust a server whose certificate is not signed by the CA", func() {
+		_, err := invoke(&tls.Config{
+			Certificates: []tls.Certificate{keyPair(x509.ExtKeyUsageClientAuth)},
+		})
+
+		Expect(err).To(MatchError(ContainSubstring("certificate")))
+	})
+
+	It("verifies the server name of the TLS configuration", func() {
+		_, err := invoke(&tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{keyPair(x509.ExtKeyUsageClientAuth)},
+			ServerName:   "other",
+		})
+
+		Expect(err).To(MatchError(ContainSubstring("certificate")))
+	})
+
+	It("fails when the server does not negotiate HTTP/2", func() {
+		http1 := httptest.NewUnstartedServer(echo)
+		http1.TLS = &tls.Config{Certificates: []tls.Certificate{keyPair(x509.ExtKeyUsageServerAuth)}}
+		http1.StartTLS()
+		defer http1.Close()
+
+		client := grpcclient.NewHTTPClient(&tls.Config{RootCAs: pool})
+		url := grpcclient.URL(http1.Listener.Addr().String(), true, "/test.Service/Echo")
+
+		_, err := grpcclient.Invoke(context.Background(), client, url, []byte("message"))
+		Expect(err).To(MatchError(ContainSubstring("instead of HTTP/2")))
+	})
+})
+
+var _ = Describe("Invoke over cleartext HTTP/2", func() {
+	var (
+		handler http.Handler
+		server  *httptest.Server
+	)
+
+	BeforeEach(func() {
+		handler = echo
+	})
+
+	JustBeforeEach(func() {
+		server = httptest.NewUnstartedServer(handler)
+		server.Config.Protocols = new(http.Protocols)
+		server.Config.Protocols.SetUnencryptedHTTP2(true)
+		server.Start()
+		DeferCleanup(server.Close)
+	})
+
+	invoke := func(msg []byte) ([]byte, error) {
+		url := grpcclient.URL(server.Listener.Addr().String(), false, "/test.Service/Echo")
+		Expect(url).To(HavePrefix("http://"))
+
+		return grpcclient.Invoke(context.Background(), grpcclient.NewHTTPClient(nil), url, msg)
+	}
+
+	It("calls the server without TLS", func() {
+		out, err := invoke([]byte("message"))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("message"))
+	})
+
+	Context("when the server responds with a status other than OK", func() {
+		BeforeEach(func() {
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Grpc-Status", "14")
+				w.Header().Set("Grpc-Message", "agent%20unavailable")
+				w.WriteHeader(http.StatusOK)
+			})
+		})
+
+		It("returns the status", func() {
+			_, err := invoke([]byte("message"))
+
+			var status *grpcclient.StatusError
+			Expect(errors.As(err, &status)).To(BeTrue())
+			Expect(status.Code).To(Equal(14))
+			Expect(status.Message).To(Equal("agent unavailable"))
+			Expect(status.Retryable()).To(BeTrue())
+		})
+	})
+
+	Context("when the server records the request", func() {
+		var requests chan []byte
+
+		BeforeEach(func() {
+			requests = make(chan []byte, 1)
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				requests <- body
+
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Grpc-Status", "0")
+				w.WriteHeader(http.StatusOK)
+			})
+		})
+
+		It("prefixes the request message with its length", func() {
+			msg := []byte(strings.Repeat("m", 300))
+			_, err := invoke(msg)
+			Expect(err).NotTo(HaveOccurred())
+
+			var body []byte
+			Expect(requests).To(Receive(&body))
+			Expect(body[0]).To(BeZero())
+			Expect(binary.BigEndian.Uint32(body[1:5])).To(BeEquivalentTo(300))
+			Expect(body[5:]).To(Equal(msg))
+		})
+	})
+})
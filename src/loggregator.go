@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/loggregator"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"code.cloudfoundry.org/tlsconfig"
+)
+
+// loggregatorServerName is the name in the certificate of the Loggregator
+// agent.
+const loggregatorServerName = "metron"
+
+// loggregatorSink sends counters and gauges to the Loggregator agent, with
+// their labels as tags and the "unit" label of gauges as their unit.
+// Loggregator v2 has no envelope for histograms, so they are only served for
+// prom_scraper.
+type loggregatorSink struct {
+	emitter *loggregator.Emitter
+}
+
+// startLoggregator starts sending the counters and gauges recorded in the
+// returned sink to the configured Loggregator agent, calling onError with
+// every batch that failed.
+func startLoggregator(logger lager.Logger, onError func(error)) (*loggregatorSink, error) {
+	tlsConfig, err := tlsconfig.Build(
+		tlsconfig.WithInternalServiceDefaults(),
+		tlsconfig.WithIdentityFromFile(cfg.LoggregatorCertFile, cfg.LoggregatorKeyFile),
+	).Client(
+		tlsconfig.WithAuthorityFromFile(cfg.LoggregatorCAFile),
+		tlsconfig.WithServerName(loggregatorServerName),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	emitter := loggregator.NewEmitter(
+		loggregator.NewClient(cfg.LoggregatorAddress, tlsConfig),
+		logger,
+		loggregator.WithSourceID(cfg.sourceID()),
+		loggregator.WithInstanceID(cfg.InstanceID),
+		loggregator.WithTags(map[string]string{"origin": cfg.Origin}),
+		loggregator.WithFlushInterval(cfg.LoggregatorInterval),
+		loggregator.WithErrorHandler(onError),
+	)
+	emitter.Start()
+
+	logger.Info("sending-loggregator-envelopes", lager.Data{
+		"address":        cfg.LoggregatorAddress,
+		"source_id":      cfg.sourceID(),
+		"instance_id":    cfg.InstanceID,
+		"flush_interval": cfg.LoggregatorInterval.String(),
+	})
+
+	return &loggregatorSink{emitter: emitter}, nil
+}
+
+// stop sends the values that have not been sent yet, unless ctx is done
+// first.
+func (s *loggregatorSink) stop(ctx context.Context) {
+	s.emitter.Stop(ctx)
+}
+
+func (s *loggregatorSink) SetGauge(series metrics.Series, value float64) {
+	unit, tags := splitUnit(series.Labels)
+	s.emitter.SetGauge(series.Name, unit, tags, value)
+}
+
+func (s *loggregatorSink) AddCounter(series metrics.Series, delta float64) {
+	s.emitter.AddCounter(series.Name, series.Labels, delta)
+}
+
+func (s *loggregatorSink) ObserveHistogram(metrics.Series, []float64, float64) {}
+
+func (s *loggregatorSink) AddHistogramCounts(metrics.Series, []float64, []uint64, float64) {}
+
+func (s *loggregatorSink) DeleteSeries(series metrics.Series) {
+	_, tags := splitUnit(series.Labels)
+	s.emitter.RemoveGauge(series.Name, tags)
+}
+
+// splitUnit returns the "unit" label of a gauge and its other labels.
+func splitUnit(labels map[string]string) (string, map[string]string) {
+	unit, ok := labels["unit"]
+	if !ok {
+		return "", labels
+	}
+
+	tags := make(map[string]string, len(labels)-1)
+	for k, v := range labels {
+		if k != "unit" {
+			tags[k] = v
+		}
+	}
+
+	return unit, tags
+}
@@ -0,0 +1,36 @@
+package loggregator
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"code.cloudfoundry.org/service-metrics-release/grpcclient"
+)
+
+// sendMethod is the gRPC method of the Loggregator v2 Ingress service that
+// sends a batch of envelopes in a single unary call.
+const sendMethod = "/loggregator.v2.Ingress/Send"
+
+// Client sends envelope batches to a Loggregator agent over mutual TLS gRPC.
+type Client struct {
+	url    string
+	client *http.Client
+}
+
+// NewClient returns a client for the agent listening on addr, such as
+// localhost:3458, that authenticates itself and the agent with tlsConfig.
+func NewClient(addr string, tlsConfig *tls.Config) *Client {
+	return &Client{
+		url:    grpcclient.URL(addr, true, sendMethod),
+		client: grpcclient.NewHTTPClient(tlsConfig),
+	}
+}
+
+// Send sends envelopes as a single batch. When the agent refuses the batch,
+// the error is a *grpcclient.StatusError.
+func (c *Client) Send(ctx context.Context, envelopes []*Envelope) error {
+	_, err := grpcclient.Invoke(ctx, c.client, c.url, MarshalBatch(envelopes))
+
+	return err
+}
@@ -0,0 +1,87 @@
+package loggregator_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+
+	"code.cloudfoundry.org/service-metrics-release/grpcclient"
+	"code.cloudfoundry.org/service-metrics-release/loggregator"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		ingress   *fakeIngress
+		tlsConfig *tls.Config
+		client    *loggregator.Client
+	)
+
+	BeforeEach(func() {
+		ingress, tlsConfig = newFakeIngress()
+		DeferCleanup(ingress.close)
+
+		client = loggregator.NewClient(ingress.addr(), tlsConfig)
+	})
+
+	It("sends envelopes as a single batch", func() {
+		err := client.Send(context.Background(), []*loggregator.Envelope{
+			{
+				Timestamp:  1234,
+				SourceID:   "my-source",
+				InstanceID: "0",
+				Tags:       map[string]string{"origin": "my-origin"},
+				Counter:    &loggregator.Counter{Name: "requests", Delta: 2, Total: 5},
+			},
+			{
+				SourceID: "my-source",
+				Gauge: &loggregator.Gauge{Metrics: map[string]loggregator.GaugeValue{
+					"memory": {Unit: "bytes", Value: 1.5},
+				}},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ingress.received()).To(HaveLen(1))
+		Expect(ingress.received()[0]).To(Equal([]*loggregator.Envelope{
+			{
+				Timestamp:  1234,
+				SourceID:   "my-source",
+				InstanceID: "0",
+				Tags:       map[string]string{"origin": "my-origin"},
+				Counter:    &loggregator.Counter{Name: "requests", Delta: 2, Total: 5},
+			},
+			{
+				SourceID: "my-source",
+				Gauge: &loggregator.Gauge{Metrics: map[string]loggregator.GaugeValue{
+					"memory": {Unit: "bytes", Value: 1.5},
+				}},
+			},
+		}))
+	})
+
+	It("returns the grpc status the agent refused the batch with", func() {
+		ingress.fail(1)
+
+		err := client.Send(context.Background(), []*loggregator.Envelope{{SourceID: "my-source"}})
+
+		var status *grpcclient.StatusError
+		Expect(errors.As(err, &status)).To(BeTrue())
+		Expect(status.Code).To(Equal(14))
+		Expect(status.Message).To(Equal("agent unavailable"))
+		Expect(status.Retryable()).To(BeTrue())
+	})
+
+	It("fails when the agent cannot be authenticated", func() {
+		client = loggregator.NewClient(ingress.addr(), &tls.Config{
+			Certificates: tlsConfig.Certificates,
+			ServerName:   "metron",
+		})
+
+		err := client.Send(context.Background(), []*loggregator.Envelope{{SourceID: "my-source"}})
+		Expect(err).To(MatchError(ContainSubstring("certificate")))
+		Expect(ingress.received()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,331 @@
+package loggregator
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// sendTimeout bounds every call to the agent, so that an unresponsive agent
+// is retried like one that refused the batch.
+const sendTimeout = 10 * time.Second
+
+// Emitter keeps the latest value of every counter and gauge it is given and
+// sends all of them to the agent on every flush interval, the way
+// prom_scraper sends every series it scrapes. Envelopes are sent in batches.
+// When a batch fails it is retried with exponential backoff before the next
+// values are sent, which is lossless since the values are aggregated in the
+// meantime. It is safe for concurrent use.
+type Emitter struct {
+	client *Client
+	logger lager.Logger
+
+	sourceID   string
+	instanceID string
+	tags       map[string]string
+
+	interval   time.Duration
+	batchSize  int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	onError func(error)
+
+	mu       sync.Mutex
+	counters map[string]*counterSeries
+	gauges   map[string]*gaugeSeries
+
+	stop chan struct{}
+	done chan struct{}
+	// stopCtx bounds the last send, it is set before stop is closed.
+	stopCtx context.Context
+}
+
+type counterSeries struct {
+	name  string
+	tags  map[string]string
+	total float64
+	// sent is the total last put in an envelope. Loggregator counters are
+	// integers, so fractions are only sent once they add up.
+	sent uint64
+}
+
+type gaugeSeries struct {
+	name  string
+	unit  string
+	tags  map[string]string
+	value float64
+}
+
+// EmitterOption configures optional Emitter behaviour.
+type EmitterOption func(*Emitter)
+
+// WithSourceID sets the source_id of every envelope.
+func WithSourceID(id string) EmitterOption {
+	return func(e *Emitter) {
+		e.sourceID = id
+	}
+}
+
+// WithInstanceID sets the instance_id of every envelope.
+func WithInstanceID(id string) EmitterOption {
+	return func(e *Emitter) {
+		e.instanceID = id
+	}
+}
+
+// WithTags adds tags to every envelope, replacing the labels of a series
+// with the same name.
+func WithTags(tags map[string]string) EmitterOption {
+	return func(e *Emitter) {
+		for k, v := range tags {
+			e.tags[k] = v
+		}
+	}
+}
+
+// WithFlushInterval sets how often the values are sent, 15 seconds by
+// default.
+func WithFlushInterval(d time.Duration) EmitterOption {
+	return func(e *Emitter) {
+		e.interval = d
+	}
+}
+
+// WithBatchSize sets the largest number of envelopes sent in one call, 100
+// by default.
+func WithBatchSize(n int) EmitterOption {
+	return func(e *Emitter) {
+		e.batchSize = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry of a failed batch, which
+// doubles with every retry up to max. It is 1 second up to 1 minute by
+// default.
+func WithBackoff(min, max time.Duration) EmitterOption {
+	return func(e *Emitter) {
+		e.minBackoff, e.maxBackoff = min, max
+	}
+}
+
+// WithErrorHandler sets a function that is called with the error of every
+// batch that failed.
+func WithErrorHandler(f func(error)) EmitterOption {
+	return func(e *Emitter) {
+		e.onError = f
+	}
+}
+
+func NewEmitter(c *Client, logger lager.Logger, opts ...EmitterOption) *Emitter {
+	e := &Emitter{
+		client:     c,
+		logger:     logger,
+		tags:       make(map[string]string),
+		interval:   15 * time.Second,
+		batchSize:  100,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		onError:    func(error) {},
+		counters:   make(map[string]*counterSeries),
+		gauges:     make(map[string]*gaugeSeries),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(e)
+	}
+
+	return e
+}
+
+// AddCounter adds delta to the counter name with tags. Negative deltas are
+// ignored.
+func (e *Emitter) AddCounter(name string, tags map[string]string, delta float64) {
+	if delta < 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := seriesKey(name, tags)
+	c, ok := e.counters[key]
+	if !ok {
+		c = &counterSeries{name: name, tags: tags}
+		e.counters[key] = c
+	}
+	c.total += delta
+}
+
+// SetGauge sets the gauge name with tags to value.
+func (e *Emitter) SetGauge(name, unit string, tags map[string]string, value float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := seriesKey(name, tags)
+	g, ok := e.gauges[key]
+	if !ok {
+		g = &gaugeSeries{name: name, unit: unit, tags: tags}
+		e.gauges[key] = g
+	}
+	g.value = value
+}
+
+// RemoveGauge stops sending the gauge name with tags.
+func (e *Emitter) RemoveGauge(name string, tags map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.gauges, seriesKey(name, tags))
+}
+
+func seriesKey(name string, tags map[string]string) string {
+	names := make([]string, 0, len(tags))
+	for k := range tags {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	key.WriteString(name)
+	for _, k := range names {
+		key.WriteString("," + k + "=" + tags[k])
+	}
+
+	return key.String()
+}
+
+// Start starts sending the values on every flush interval.
+func (e *Emitter) Start() {
+	go e.run()
+}
+
+// Stop stops sending and makes a last attempt to send the values that have
+// not been sent yet, which is abandoned once ctx is done.
+func (e *Emitter) Stop(ctx context.Context) {
+	e.stopCtx = ctx
+	close(e.stop)
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+}
+
+func (e *Emitter) run() {
+	defer close(e.done)
+
+	timer := time.NewTimer(e.interval)
+	defer timer.Stop()
+
+	var (
+		pending []*Envelope
+		backoff time.Duration
+	)
+	for {
+		select {
+		case <-timer.C:
+		case <-e.stop:
+			e.send(e.stopCtx, append(pending, e.snapshot()...))
+			return
+		}
+
+		if len(pending) == 0 {
+			pending = e.snapshot()
+		}
+
+		pending = e.send(context.Background(), pending)
+		if len(pending) == 0 {
+			backoff = 0
+			timer.Reset(e.interval)
+			continue
+		}
+
+		backoff = min(max(2*backoff, e.minBackoff), e.maxBackoff)
+		e.logger.Info("sending-loggregator-envelopes", lager.Data{
+			"event":    "retrying",
+			"pending":  len(pending),
+			"retry_in": backoff.String(),
+		})
+		timer.Reset(backoff)
+	}
+}
+
+// send sends envelopes in batches and returns the envelopes of the first
+// batch that failed and the ones after it.
+func (e *Emitter) send(ctx context.Context, envelopes []*Envelope) []*Envelope {
+	for len(envelopes) > 0 {
+		n := min(len(envelopes), e.batchSize)
+
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := e.client.Send(sendCtx, envelopes[:n])
+		cancel()
+
+		if err != nil {
+			e.onError(err)
+			e.logger.Error("sending-loggregator-envelopes", err, lager.Data{
+				"envelopes": n,
+			})
+			return envelopes
+		}
+
+		e.logger.Debug("sending-loggregator-envelopes", lager.Data{
+			"envelopes": n,
+		})
+		envelopes = envelopes[n:]
+	}
+
+	return nil
+}
+
+// snapshot returns an envelope for every counter and gauge.
+func (e *Emitter) snapshot() []*Envelope {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now().UnixNano()
+
+	envelopes := make([]*Envelope, 0, len(e.counters)+len(e.gauges))
+	for _, key := range sortedKeys(e.counters) {
+		c := e.counters[key]
+
+		total := uint64(c.total)
+		envelopes = append(envelopes, e.envelope(now, c.tags, &Envelope{
+			Counter: &Counter{Name: c.name, Delta: total - c.sent, Total: total},
+		}))
+		c.sent = total
+	}
+
+	for _, key := range sortedKeys(e.gauges) {
+		g := e.gauges[key]
+
+		envelopes = append(envelopes, e.envelope(now, g.tags, &Envelope{
+			Gauge: &Gauge{Metrics: map[string]GaugeValue{
+				g.name: {Unit: g.unit, Value: g.value},
+			}},
+		}))
+	}
+
+	return envelopes
+}
+
+func (e *Emitter) envelope(timestamp int64, tags map[string]string, env *Envelope) *Envelope {
+	env.Timestamp = timestamp
+	env.SourceID = e.sourceID
+	env.InstanceID = e.instanceID
+	env.Tags = make(map[string]string, len(tags)+len(e.tags))
+	for k, v := range tags {
+		env.Tags[k] = v
+	}
+	for k, v := range e.tags {
+		env.Tags[k] = v
+	}
+
+	return env
+}
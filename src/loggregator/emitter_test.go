@@ -0,0 +1,168 @@
+package loggregator_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/loggregator"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Emitter", func() {
+	var (
+		ingress *fakeIngress
+		client  *loggregator.Client
+	)
+
+	BeforeEach(func() {
+		var tlsConfig *tls.Config
+		ingress, tlsConfig = newFakeIngress()
+		DeferCleanup(ingress.close)
+
+		client = loggregator.NewClient(ingress.addr(), tlsConfig)
+	})
+
+	newEmitter := func(opts ...loggregator.EmitterOption) *loggregator.Emitter {
+		opts = append([]loggregator.EmitterOption{
+			loggregator.WithFlushInterval(10 * time.Millisecond),
+			loggregator.WithBackoff(10*time.Millisecond, 20*time.Millisecond),
+		}, opts...)
+
+		return loggregator.NewEmitter(client, lager.NewLogger("test"), opts...)
+	}
+
+	It("sends counters and gauges with the source, instance and tags", func() {
+		e := newEmitter(
+			loggregator.WithSourceID("my-source"),
+			loggregator.WithInstanceID("my-instance"),
+			loggregator.WithTags(map[string]string{"origin": "my-origin"}),
+		)
+		e.AddCounter("requests", map[string]string{"code": "200"}, 2.5)
+		e.AddCounter("requests", map[string]string{"code": "200"}, 1)
+		e.SetGauge("memory", "bytes", map[string]string{"origin": "ignored"}, 10)
+		e.SetGauge("memory", "bytes", map[string]string{"origin": "ignored"}, 15)
+
+		e.Start()
+		Eventually(ingress.envelopes).ShouldNot(BeEmpty())
+		e.Stop(context.Background())
+
+		envelopes := ingress.received()[0]
+		Expect(envelopes).To(HaveLen(2))
+
+		Expect(envelopes[0].SourceID).To(Equal("my-source"))
+		Expect(envelopes[0].InstanceID).To(Equal("my-instance"))
+		Expect(envelopes[0].Timestamp).NotTo(BeZero())
+		Expect(envelopes[0].Tags).To(Equal(map[string]string{"code": "200", "origin": "my-origin"}))
+		Expect(envelopes[0].Counter).To(Equal(&loggregator.Counter{Name: "requests", Delta: 3, Total: 3}))
+
+		Expect(envelopes[1].SourceID).To(Equal("my-source"))
+		Expect(envelopes[1].Tags).To(Equal(map[string]string{"origin": "my-origin"}))
+		Expect(envelopes[1].Gauge.Metrics).To(Equal(map[string]loggregator.GaugeValue{
+			"memory": {Unit: "bytes", Value: 15},
+		}))
+	})
+
+	It("sends the delta since the last flush along with the total", func() {
+		e := newEmitter()
+		e.AddCounter("requests", nil, 2)
+
+		e.Start()
+		Eventually(ingress.envelopes).ShouldNot(BeEmpty())
+
+		e.AddCounter("requests", nil, 3)
+		e.Stop(context.Background())
+
+		var counters []*loggregator.Counter
+		for _, env := range ingress.envelopes() {
+			if env.Counter.Delta != 0 {
+				counters = append(counters, env.Counter)
+			}
+		}
+		Expect(counters).To(Equal([]*loggregator.Counter{
+			{Name: "requests", Delta: 2, Total: 2},
+			{Name: "requests", Delta: 3, Total: 5},
+		}))
+	})
+
+	It("splits the envelopes into batches", func() {
+		e := newEmitter(loggregator.WithBatchSize(2), loggregator.WithFlushInterval(time.Hour))
+		e.SetGauge("a", "", nil, 1)
+		e.SetGauge("b", "", nil, 2)
+		e.SetGauge("c", "", nil, 3)
+
+		e.Start()
+		e.Stop(context.Background())
+
+		batches := ingress.received()
+		Expect(batches).To(HaveLen(2))
+		Expect(batches[0]).To(HaveLen(2))
+		Expect(batches[1]).To(HaveLen(1))
+	})
+
+	It("retries failed batches with backoff", func() {
+		ingress.fail(3)
+
+		e := newEmitter()
+		e.AddCounter("requests", nil, 1)
+
+		e.Start()
+		Eventually(ingress.envelopes).ShouldNot(BeEmpty())
+		e.Stop(context.Background())
+
+		env := ingress.envelopes()[0]
+		Expect(env.Counter).To(Equal(&loggregator.Counter{Name: "requests", Delta: 1, Total: 1}))
+	})
+
+	It("reports every failed batch to the error handler", func() {
+		ingress.fail(2)
+
+		var failures atomic.Int32
+		e := newEmitter(loggregator.WithErrorHandler(func(error) {
+			failures.Add(1)
+		}))
+		e.AddCounter("requests", nil, 1)
+
+		e.Start()
+		Eventually(ingress.envelopes).ShouldNot(BeEmpty())
+		e.Stop(context.Background())
+
+		Expect(failures.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("stops sending removed gauges", func() {
+		e := newEmitter(loggregator.WithFlushInterval(time.Hour))
+		e.SetGauge("memory", "bytes", map[string]string{"a": "b"}, 1)
+		e.RemoveGauge("memory", map[string]string{"a": "b"})
+
+		e.Start()
+		e.Stop(context.Background())
+
+		Expect(ingress.envelopes()).To(BeEmpty())
+	})
+
+	It("abandons the last send once the context of Stop is done", func() {
+		// The agent accepts connections but never completes the handshake.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(l.Close)
+
+		client = loggregator.NewClient(l.Addr().String(), &tls.Config{ServerName: "metron"})
+
+		e := newEmitter(loggregator.WithFlushInterval(time.Hour))
+		e.SetGauge("size", "bytes", nil, 1)
+		e.Start()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		e.Stop(ctx)
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+})
@@ -0,0 +1,300 @@
+package loggregator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Envelope is a Loggregator v2 envelope carrying either a counter or a gauge.
+// Only the fields service metrics sends are supported.
+type Envelope struct {
+	Timestamp  int64
+	SourceID   string
+	InstanceID string
+	Tags       map[string]string
+
+	Counter *Counter
+	Gauge   *Gauge
+}
+
+type Counter struct {
+	Name  string
+	Delta uint64
+	Total uint64
+}
+
+type Gauge struct {
+	Metrics map[string]GaugeValue
+}
+
+type GaugeValue struct {
+	Unit  string
+	Value float64
+}
+
+// Field numbers of loggregator.v2.Envelope and the messages it contains, see
+// https://github.com/cloudfoundry/loggregator-api/blob/master/v2/envelope.proto.
+const (
+	envelopeTimestamp  protowire.Number = 1
+	envelopeSourceID   protowire.Number = 2
+	envelopeCounter    protowire.Number = 5
+	envelopeGauge      protowire.Number = 6
+	envelopeInstanceID protowire.Number = 8
+	envelopeTags       protowire.Number = 9
+
+	counterName  protowire.Number = 1
+	counterDelta protowire.Number = 2
+	counterTotal protowire.Number = 3
+
+	gaugeMetrics protowire.Number = 1
+
+	gaugeValueUnit  protowire.Number = 1
+	gaugeValueValue protowire.Number = 2
+
+	mapKey   protowire.Number = 1
+	mapValue protowire.Number = 2
+
+	batchEnvelopes protowire.Number = 1
+)
+
+// MarshalBatch encodes envelopes as a loggregator.v2.EnvelopeBatch.
+func MarshalBatch(envelopes []*Envelope) []byte {
+	var b []byte
+	for _, e := range envelopes {
+		b = appendMessage(b, batchEnvelopes, e.marshal())
+	}
+
+	return b
+}
+
+// UnmarshalBatch decodes a loggregator.v2.EnvelopeBatch, skipping the fields
+// and envelope types that are not supported.
+func UnmarshalBatch(b []byte) ([]*Envelope, error) {
+	var envelopes []*Envelope
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != batchEnvelopes || typ != protowire.BytesType {
+			return nil
+		}
+
+		e := &Envelope{}
+		if err := e.unmarshal(v); err != nil {
+			return err
+		}
+		envelopes = append(envelopes, e)
+
+		return nil
+	})
+
+	return envelopes, err
+}
+
+func (e *Envelope) marshal() []byte {
+	var b []byte
+	if e.Timestamp != 0 {
+		b = protowire.AppendTag(b, envelopeTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.Timestamp))
+	}
+	b = appendString(b, envelopeSourceID, e.SourceID)
+
+	if e.Counter != nil {
+		var c []byte
+		c = appendString(c, counterName, e.Counter.Name)
+		c = appendUint(c, counterDelta, e.Counter.Delta)
+		c = appendUint(c, counterTotal, e.Counter.Total)
+		b = appendMessage(b, envelopeCounter, c)
+	}
+
+	if e.Gauge != nil {
+		var g []byte
+		for _, name := range sortedKeys(e.Gauge.Metrics) {
+			v := e.Gauge.Metrics[name]
+
+			var value []byte
+			value = appendString(value, gaugeValueUnit, v.Unit)
+			value = protowire.AppendTag(value, gaugeValueValue, protowire.Fixed64Type)
+			value = protowire.AppendFixed64(value, math.Float64bits(v.Value))
+
+			var entry []byte
+			entry = appendString(entry, mapKey, name)
+			entry = appendMessage(entry, mapValue, value)
+			g = appendMessage(g, gaugeMetrics, entry)
+		}
+		b = appendMessage(b, envelopeGauge, g)
+	}
+
+	b = appendString(b, envelopeInstanceID, e.InstanceID)
+
+	for _, k := range sortedKeys(e.Tags) {
+		var entry []byte
+		entry = appendString(entry, mapKey, k)
+		entry = appendString(entry, mapValue, e.Tags[k])
+		b = appendMessage(b, envelopeTags, entry)
+	}
+
+	return b
+}
+
+func (e *Envelope) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == envelopeTimestamp && typ == protowire.VarintType:
+			t, _ := protowire.ConsumeVarint(v)
+			e.Timestamp = int64(t)
+		case num == envelopeSourceID && typ == protowire.BytesType:
+			e.SourceID = string(v)
+		case num == envelopeInstanceID && typ == protowire.BytesType:
+			e.InstanceID = string(v)
+		case num == envelopeTags && typ == protowire.BytesType:
+			k, value, err := unmarshalMapEntry(v)
+			if err != nil {
+				return err
+			}
+			if e.Tags == nil {
+				e.Tags = make(map[string]string)
+			}
+			e.Tags[k] = string(value)
+		case num == envelopeCounter && typ == protowire.BytesType:
+			e.Counter = &Counter{}
+			return e.Counter.unmarshal(v)
+		case num == envelopeGauge && typ == protowire.BytesType:
+			if e.Gauge == nil {
+				e.Gauge = &Gauge{Metrics: make(map[string]GaugeValue)}
+			}
+			return e.Gauge.unmarshal(v)
+		}
+
+		return nil
+	})
+}
+
+func (c *Counter) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == counterName && typ == protowire.BytesType:
+			c.Name = string(v)
+		case num == counterDelta && typ == protowire.VarintType:
+			c.Delta, _ = protowire.ConsumeVarint(v)
+		case num == counterTotal && typ == protowire.VarintType:
+			c.Total, _ = protowire.ConsumeVarint(v)
+		}
+
+		return nil
+	})
+}
+
+func (g *Gauge) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != gaugeMetrics || typ != protowire.BytesType {
+			return nil
+		}
+
+		name, value, err := unmarshalMapEntry(v)
+		if err != nil {
+			return err
+		}
+
+		var gv GaugeValue
+		err = consumeFields(value, func(num protowire.Number, typ protowire.Type, v []byte) error {
+			switch {
+			case num == gaugeValueUnit && typ == protowire.BytesType:
+				gv.Unit = string(v)
+			case num == gaugeValueValue && typ == protowire.Fixed64Type:
+				bits, _ := protowire.ConsumeFixed64(v)
+				gv.Value = math.Float64frombits(bits)
+			}
+
+			return nil
+		})
+		g.Metrics[name] = gv
+
+		return err
+	})
+}
+
+func unmarshalMapEntry(b []byte) (string, []byte, error) {
+	var (
+		key   string
+		value []byte
+	)
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == mapKey && typ == protowire.BytesType:
+			key = string(v)
+		case num == mapValue && typ == protowire.BytesType:
+			value = v
+		}
+
+		return nil
+	})
+
+	return key, value, err
+}
+
+// consumeFields calls f with the number, type and raw value of each field in
+// b. The value of a length-delimited field is its contents, the value of
+// any other field is its encoding.
+func consumeFields(b []byte, f func(protowire.Number, protowire.Type, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid field tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v []byte
+		if typ == protowire.BytesType {
+			v, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := f(num, typ, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,167 @@
+package loggregator_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/service-metrics-release/loggregator"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLoggregator(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Loggregator Suite")
+}
+
+// fakeIngress is an in-process Loggregator agent that records the batches
+// sent to its Ingress Send method over mutual TLS HTTP/2.
+type fakeIngress struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	batches [][]*loggregator.Envelope
+	// failures is the number of calls still to be refused as unavailable.
+	failures int
+}
+
+// newFakeIngress starts a fake agent and returns the TLS configuration of a
+// client it trusts.
+func newFakeIngress() (*fakeIngress, *tls.Config) {
+	ca, caKey := newCertificate(nil, nil, x509.ExtKeyUsageAny)
+	server, serverKey := newCertificate(ca, caKey, x509.ExtKeyUsageServerAuth)
+	client, clientKey := newCertificate(ca, caKey, x509.ExtKeyUsageClientAuth)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	f := &fakeIngress{}
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.EnableHTTP2 = true
+	f.server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	f.server.StartTLS()
+
+	return f, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}},
+		RootCAs:      pool,
+		ServerName:   "metron",
+	}
+}
+
+func (f *fakeIngress) addr() string {
+	return f.server.Listener.Addr().String()
+}
+
+func (f *fakeIngress) close() {
+	f.server.Close()
+}
+
+func (f *fakeIngress) fail(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = n
+}
+
+func (f *fakeIngress) received() [][]*loggregator.Envelope {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([][]*loggregator.Envelope(nil), f.batches...)
+}
+
+func (f *fakeIngress) envelopes() []*loggregator.Envelope {
+	var envelopes []*loggregator.Envelope
+	for _, batch := range f.received() {
+		envelopes = append(envelopes, batch...)
+	}
+
+	return envelopes
+}
+
+func (f *fakeIngress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+
+	Expect(r.ProtoMajor).To(Equal(2))
+	Expect(r.Method).To(Equal(http.MethodPost))
+	Expect(r.URL.Path).To(Equal("/loggregator.v2.Ingress/Send"))
+	Expect(r.Header.Get("Content-Type")).To(Equal("application/grpc"))
+
+	body, err := io.ReadAll(r.Body)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(len(body)).To(BeNumerically(">=", 5))
+	Expect(body[0]).To(BeZero())
+	Expect(binary.BigEndian.Uint32(body[1:5])).To(BeEquivalentTo(len(body) - 5))
+
+	w.Header().Set("Content-Type", "application/grpc")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		// A response without a body carries the status in its headers.
+		w.Header().Set("Grpc-Status", "14")
+		w.Header().Set("Grpc-Message", "agent%20unavailable")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	envelopes, err := loggregator.UnmarshalBatch(body[5:])
+	Expect(err).NotTo(HaveOccurred())
+	f.batches = append(f.batches, envelopes)
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte{0, 0, 0, 0, 0})
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+// newCertificate returns a certificate for metron and 127.0.0.1 signed by
+// parent, or a self-signed CA if parent is nil.
+func newCertificate(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "metron"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"metron"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return cert, key
+}
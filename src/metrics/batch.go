@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Framing is how a long-running metrics command separates the batches of
+// metrics it writes to its output.
+type Framing string
+
+const (
+	// FramingNDJSON ends every batch of NDJSON entries with an empty line.
+	FramingNDJSON Framing = "ndjson"
+
+	// FramingLength precedes every batch, such as a JSON array of entries,
+	// with a line holding the size of the batch in bytes.
+	FramingLength Framing = "length"
+)
+
+// maxBatchSize is the largest batch a long-running metrics command can
+// write.
+const maxBatchSize = 64 * 1024 * 1024
+
+// ErrBatchTooLarge is returned by BatchReader.Next for a batch larger than
+// 64MiB.
+var ErrBatchTooLarge = errors.New("metrics batch too large")
+
+// ParseFraming returns the Framing with the given name.
+func ParseFraming(s string) (Framing, error) {
+	switch f := Framing(s); f {
+	case FramingNDJSON, FramingLength:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown framing %q, must be one of %s or %s", s, FramingNDJSON, FramingLength)
+}
+
+// BatchReader reads successive batches of metrics from the output of a
+// long-running metrics command.
+type BatchReader struct {
+	r       *bufio.Reader
+	framing Framing
+}
+
+func NewBatchReader(r io.Reader, f Framing) *BatchReader {
+	return &BatchReader{
+		r:       bufio.NewReader(r),
+		framing: f,
+	}
+}
+
+// Next returns the next complete batch. It returns io.EOF once the output
+// has ended between batches and io.ErrUnexpectedEOF if it ended within a
+// batch, which is not returned. Any other error leaves the reader in the
+// middle of a batch, so no further batches can be read.
+func (b *BatchReader) Next() ([]byte, error) {
+	if b.framing == FramingLength {
+		return b.nextLength()
+	}
+
+	return b.nextNDJSON()
+}
+
+func (b *BatchReader) nextNDJSON() ([]byte, error) {
+	var batch []byte
+	for {
+		line, err := b.r.ReadBytes('\n')
+		if err == io.EOF && len(batch)+len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Empty lines before the first entry do not end a batch, so that a
+		// command can end every batch with an empty line regardless.
+		if len(bytes.TrimSpace(line)) == 0 {
+			if len(batch) > 0 {
+				return batch, nil
+			}
+			continue
+		}
+
+		if len(batch)+len(line) > maxBatchSize {
+			return nil, ErrBatchTooLarge
+		}
+		batch = append(batch, line...)
+	}
+}
+
+func (b *BatchReader) nextLength() ([]byte, error) {
+	var header []byte
+	for len(header) == 0 {
+		line, err := b.r.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		header = bytes.TrimSpace(line)
+	}
+
+	size, err := strconv.Atoi(string(header))
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid batch size %q", header)
+	}
+
+	if size > maxBatchSize {
+		return nil, ErrBatchTooLarge
+	}
+
+	batch := make([]byte, size)
+	if _, err := io.ReadFull(b.r, batch); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,97 @@
+package metrics_test
+
+import (
+	"io"
+	"strings"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BatchReader", func() {
+	It("reads NDJSON batches ended by an empty line", func() {
+		r := metrics.NewBatchReader(strings.NewReader("\n{\"a\": 1}\n{\"b\": 2}\n\n\n{\"c\": 3}\n\n{\"d\": 4}\n"), metrics.FramingNDJSON)
+
+		Expect(r.Next()).To(Equal([]byte("{\"a\": 1}\n{\"b\": 2}\n")))
+		Expect(r.Next()).To(Equal([]byte("{\"c\": 3}\n")))
+
+		_, err := r.Next()
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	It("reads batches preceded by their size", func() {
+		r := metrics.NewBatchReader(strings.NewReader("5\n[1,2]\n\n2\n[]"), metrics.FramingLength)
+
+		Expect(r.Next()).To(Equal([]byte("[1,2]")))
+		Expect(r.Next()).To(Equal([]byte("[]")))
+
+		_, err := r.Next()
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("fails on a batch cut short", func() {
+		r := metrics.NewBatchReader(strings.NewReader("10\n[1,2]"), metrics.FramingLength)
+
+		_, err := r.Next()
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	It("fails on an invalid size", func() {
+		r := metrics.NewBatchReader(strings.NewReader("[1,2]\n"), metrics.FramingLength)
+
+		_, err := r.Next()
+		Expect(err).To(MatchError(`invalid batch size "[1,2]"`))
+	})
+
+	It("fails on a batch that is too large", func() {
+		r := metrics.NewBatchReader(strings.NewReader("1000000000\n"), metrics.FramingLength)
+
+		_, err := r.Next()
+		Expect(err).To(MatchError(metrics.ErrBatchTooLarge))
+	})
+})
+
+var _ = Describe("ParseFraming", func() {
+	It("returns known framings", func() {
+		Expect(metrics.ParseFraming("ndjson")).To(Equal(metrics.FramingNDJSON))
+		Expect(metrics.ParseFraming("length")).To(Equal(metrics.FramingLength))
+	})
+
+	It("rejects unknown framings", func() {
+		_, err := metrics.ParseFraming("xml")
+		Expect(err).To(MatchError(`unknown framing "xml", must be one of ndjson or length`))
+	})
+})
+
+var _ = Describe("Processor.ProcessBatch", func() {
+	It("records batches like the output of a run", func() {
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			newSpyExecutor(nil, nil),
+			metrics.WithFormat(metrics.FormatNDJSON),
+			metrics.WithInstrumentation("daemon"),
+		)
+
+		Expect(p.ProcessBatch([]byte(`{"name": "my-counter", "delta": 2}`))).To(Succeed())
+		Expect(p.ProcessBatch([]byte(`{"name": "my-counter", "delta": 3}`))).To(Succeed())
+
+		Expect(m.GetMetricValue("my_counter", nil)).To(Equal(5.0))
+		Expect(m.GetMetricValue("service_metrics_runs", map[string]string{"collector": "daemon", "result": "success"})).To(Equal(2.0))
+		Expect(m.GetMetricValue("service_metrics_parsed_entries", map[string]string{"collector": "daemon", "type": "counter"})).To(Equal(1.0))
+	})
+
+	It("fails on batches that cannot be parsed", func() {
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(testhelpers.NewMetricsRegistry()),
+			newSpyExecutor(nil, nil),
+		)
+
+		Expect(p.ProcessBatch([]byte(`{"key":`))).To(MatchError(metrics.ErrParseFailed))
+	})
+})
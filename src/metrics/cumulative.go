@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"sort"
+	"time"
+)
+
+// CumulativeKind is the kind of a CumulativeSeries.
+type CumulativeKind int
+
+const (
+	CumulativeGauge CumulativeKind = iota
+	CumulativeCounter
+	CumulativeHistogram
+)
+
+// CumulativeSeries is the state of a series in a CumulativeStore. Value is
+// the latest value of a gauge or the total of a counter. Count, Sum, Bounds
+// and BucketCounts are those of a histogram, whose bucket counts are not
+// cumulative and end with the count of the observations above the highest
+// bound.
+type CumulativeSeries struct {
+	Series Series
+	Kind   CumulativeKind
+	// Start is when the series was first recorded.
+	Start time.Time
+
+	Value        float64
+	Count        uint64
+	Sum          float64
+	Bounds       []float64
+	BucketCounts []uint64
+}
+
+// CumulativeStore keeps the state of every series recorded through it, for
+// outputs that export all series on every interval, cumulative from the time
+// each series was first recorded. A histogram keeps the buckets it was first
+// recorded with. It is not safe for concurrent use.
+type CumulativeStore struct {
+	series map[string]*CumulativeSeries
+}
+
+func NewCumulativeStore() *CumulativeStore {
+	return &CumulativeStore{series: make(map[string]*CumulativeSeries)}
+}
+
+func (c *CumulativeStore) SetGauge(s Series, value float64) {
+	c.get(s, CumulativeGauge).Value = value
+}
+
+func (c *CumulativeStore) AddCounter(s Series, delta float64) {
+	c.get(s, CumulativeCounter).Value += delta
+}
+
+func (c *CumulativeStore) ObserveHistogram(s Series, buckets []float64, value float64) {
+	h := c.histogram(s, buckets)
+
+	h.Count++
+	h.Sum += value
+	h.BucketCounts[sort.SearchFloat64s(h.Bounds, value)]++
+}
+
+// AddHistogramCounts adds each count to the first bucket of the series that
+// holds the upper bound of its bucket.
+func (c *CumulativeStore) AddHistogramCounts(s Series, buckets []float64, counts []uint64, sum float64) {
+	h := c.histogram(s, buckets)
+
+	for i, count := range counts {
+		b := len(h.Bounds)
+		if i < len(buckets) {
+			b = sort.SearchFloat64s(h.Bounds, buckets[i])
+		}
+
+		h.BucketCounts[b] += count
+		h.Count += count
+	}
+	h.Sum += sum
+}
+
+// Delete removes the series and reports whether it was in the store.
+func (c *CumulativeStore) Delete(s Series) bool {
+	key := seriesKey(s.Name, s.Labels)
+	_, ok := c.series[key]
+	delete(c.series, key)
+
+	return ok
+}
+
+// Series returns every series in the store, ordered by name and labels.
+func (c *CumulativeStore) Series() []*CumulativeSeries {
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	series := make([]*CumulativeSeries, 0, len(keys))
+	for _, k := range keys {
+		series = append(series, c.series[k])
+	}
+
+	return series
+}
+
+func (c *CumulativeStore) histogram(s Series, buckets []float64) *CumulativeSeries {
+	h := c.get(s, CumulativeHistogram)
+	if h.Bounds == nil {
+		h.Bounds = buckets
+		h.BucketCounts = make([]uint64, len(buckets)+1)
+	}
+
+	return h
+}
+
+func (c *CumulativeStore) get(s Series, kind CumulativeKind) *CumulativeSeries {
+	key := seriesKey(s.Name, s.Labels)
+	state, ok := c.series[key]
+	if !ok {
+		labels := make(map[string]string, len(s.Labels))
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		s.Labels = labels
+
+		state = &CumulativeSeries{Series: s, Kind: kind, Start: time.Now()}
+		c.series[key] = state
+	}
+
+	return state
+}
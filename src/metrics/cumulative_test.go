@@ -0,0 +1,91 @@
+package metrics_test
+
+import (
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CumulativeStore", func() {
+	var store *metrics.CumulativeStore
+
+	BeforeEach(func() {
+		store = metrics.NewCumulativeStore()
+	})
+
+	series := func(name string, labels map[string]string) metrics.Series {
+		return metrics.Series{Name: name, Help: "The " + name + ".", Labels: labels}
+	}
+
+	It("keeps the latest value of gauges and the total of counters", func() {
+		store.SetGauge(series("size", map[string]string{"db": "one"}), 1)
+		store.SetGauge(series("size", map[string]string{"db": "one"}), 2)
+		store.AddCounter(series("requests", nil), 3)
+		store.AddCounter(series("requests", nil), 4)
+
+		s := store.Series()
+		Expect(s).To(HaveLen(2))
+		Expect(s[0].Series.Name).To(Equal("requests"))
+		Expect(s[0].Kind).To(Equal(metrics.CumulativeCounter))
+		Expect(s[0].Value).To(Equal(7.0))
+		Expect(s[1].Series).To(Equal(series("size", map[string]string{"db": "one"})))
+		Expect(s[1].Kind).To(Equal(metrics.CumulativeGauge))
+		Expect(s[1].Value).To(Equal(2.0))
+		Expect(s[1].Start).NotTo(BeZero())
+	})
+
+	It("orders the series by name and labels", func() {
+		store.SetGauge(series("size", map[string]string{"db": "two"}), 1)
+		store.SetGauge(series("count", nil), 1)
+		store.SetGauge(series("size", map[string]string{"db": "one"}), 1)
+
+		var names []string
+		for _, s := range store.Series() {
+			names = append(names, s.Series.Name+s.Series.Labels["db"])
+		}
+		Expect(names).To(Equal([]string{"count", "sizeone", "sizetwo"}))
+	})
+
+	It("buckets the observations of histograms", func() {
+		h := series("latency", nil)
+		store.ObserveHistogram(h, []float64{1, 5}, 0.5)
+		store.ObserveHistogram(h, []float64{1, 5}, 5)
+		store.ObserveHistogram(h, []float64{1, 5}, 7)
+
+		s := store.Series()[0]
+		Expect(s.Kind).To(Equal(metrics.CumulativeHistogram))
+		Expect(s.Bounds).To(Equal([]float64{1, 5}))
+		Expect(s.BucketCounts).To(Equal([]uint64{1, 1, 1}))
+		Expect(s.Count).To(BeEquivalentTo(3))
+		Expect(s.Sum).To(Equal(12.5))
+	})
+
+	It("adds counts to the buckets that hold their upper bounds", func() {
+		h := series("latency", nil)
+		store.ObserveHistogram(h, []float64{1, 5}, 0.5)
+		store.AddHistogramCounts(h, []float64{0.5, 5, 10}, []uint64{1, 2, 3, 4}, 40)
+
+		s := store.Series()[0]
+		Expect(s.Bounds).To(Equal([]float64{1, 5}))
+		Expect(s.BucketCounts).To(Equal([]uint64{2, 2, 7}))
+		Expect(s.Count).To(BeEquivalentTo(11))
+		Expect(s.Sum).To(Equal(40.5))
+	})
+
+	It("does not keep the labels it was recorded with", func() {
+		labels := map[string]string{"db": "one"}
+		store.SetGauge(series("size", labels), 1)
+		labels["db"] = "two"
+
+		Expect(store.Series()[0].Series.Labels).To(Equal(map[string]string{"db": "one"}))
+	})
+
+	It("deletes series", func() {
+		store.SetGauge(series("size", nil), 1)
+
+		Expect(store.Delete(series("size", nil))).To(BeTrue())
+		Expect(store.Delete(series("size", nil))).To(BeFalse())
+		Expect(store.Series()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,239 @@
+package metrics
+
+import (
+	"math"
+	"strconv"
+)
+
+// maxBucketCount is the largest bucket count that a JSON number holds
+// exactly.
+const maxBucketCount = 1 << 53
+
+func (p *Processor) recordHistogram(metric map[string]interface{}) {
+	name, labels, ok := p.sanitize(metric["histogram"].(string), labelsOf(metric), "le")
+	if !ok {
+		return
+	}
+	buckets := toFloat64s(metric["buckets"].([]interface{}))
+
+	if observations, ok := metric["observations"].([]interface{}); ok {
+		p.observeHistogram(name, "", labels, buckets, toFloat64s(observations))
+		return
+	}
+
+	var counts []uint64
+	for _, c := range toFloat64s(metric["bucket_counts"].([]interface{})) {
+		counts = append(counts, uint64(c))
+	}
+
+	p.addBucketCounts(name, "", labels, buckets, counts, metric["sum"].(float64))
+}
+
+func (p *Processor) recordSummary(metric map[string]interface{}) {
+	name, labels, ok := p.sanitize(metric["summary"].(string), labelsOf(metric), "quantile")
+	if !ok {
+		return
+	}
+
+	quantiles := make(map[float64]float64)
+	for q, v := range metric["quantiles"].(map[string]interface{}) {
+		quantile, _ := strconv.ParseFloat(q, 64)
+		quantiles[quantile] = v.(float64)
+	}
+
+	p.setSummary(name, "", labels, quantiles, metric["sum"].(float64), metric["count"].(float64))
+}
+
+func (p *Processor) observeHistogram(name, help string, labels map[string]string, buckets, observations []float64) {
+	if !p.canRecord("histogram", name, help, labels) {
+		return
+	}
+	p.report.accept("histogram", name, labels)
+
+	series := Series{Name: name, Help: help, Labels: labels}
+	for _, o := range observations {
+		p.sink.ObserveHistogram(series, buckets, o)
+	}
+}
+
+// addBucketCounts records pre-aggregated, non-cumulative bucket counts, one
+// per bucket plus a final overflow count, along with the sum of the counted
+// observations.
+func (p *Processor) addBucketCounts(name, help string, labels map[string]string, buckets []float64, counts []uint64, sum float64) {
+	if !p.canRecord("histogram", name, help, labels) {
+		return
+	}
+	p.report.accept("histogram", name, labels)
+
+	p.sink.AddHistogramCounts(Series{Name: name, Help: help, Labels: labels}, buckets, counts, sum)
+}
+
+// setSummary exports a pre-computed summary as gauges, one per quantile plus
+// name_sum and name_count, since a Sink has no summary type.
+func (p *Processor) setSummary(name, help string, labels map[string]string, quantiles map[float64]float64, sum, count float64) {
+	quantileLabels := copyLabels(labels)
+	quantileLabels["quantile"] = ""
+
+	if !p.canRecord("gauge", name, help, quantileLabels) ||
+		!p.canRecord("gauge", name+"_sum", help, labels) ||
+		!p.canRecord("gauge", name+"_count", help, labels) {
+		return
+	}
+	p.report.accept("summary", name, labels)
+
+	for quantile, v := range quantiles {
+		quantileLabels["quantile"] = strconv.FormatFloat(quantile, 'g', -1, 64)
+
+		p.trackGauge(name, help, copyLabels(quantileLabels), v)
+	}
+
+	p.trackGauge(name+"_sum", help, labels, sum)
+	p.trackGauge(name+"_count", help, labels, count)
+}
+
+func validateHistogram(m map[string]interface{}) *rejection {
+	if r := requireName(m, "histogram"); r != nil {
+		return r
+	}
+
+	if r := requireFloat64Slice(m, "buckets"); r != nil {
+		return r
+	}
+
+	buckets := toFloat64s(m["buckets"].([]interface{}))
+	if len(buckets) == 0 {
+		return &rejection{reason: reasonInvalidBuckets, key: "buckets"}
+	}
+
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return &rejection{reason: reasonInvalidBuckets, key: "buckets"}
+		}
+	}
+
+	_, hasObservations := m["observations"]
+	_, hasCounts := m["bucket_counts"]
+	if !hasObservations && !hasCounts {
+		return &rejection{reason: reasonMissingKey, key: "observations"}
+	}
+
+	if hasObservations && hasCounts {
+		return &rejection{reason: reasonConflictingKeys, key: "bucket_counts"}
+	}
+
+	if hasObservations {
+		if r := requireFloat64Slice(m, "observations"); r != nil {
+			return r
+		}
+	}
+
+	if hasCounts {
+		if r := requireFloat64Slice(m, "bucket_counts"); r != nil {
+			return r
+		}
+
+		counts := toFloat64s(m["bucket_counts"].([]interface{}))
+		if len(counts) != len(buckets)+1 {
+			return &rejection{reason: reasonInvalidBuckets, key: "bucket_counts"}
+		}
+
+		for _, c := range counts {
+			if c < 0 {
+				return &rejection{reason: reasonNegativeCount, key: "bucket_counts"}
+			}
+
+			if c != math.Trunc(c) {
+				return &rejection{reason: reasonWrongType, key: "bucket_counts"}
+			}
+
+			if c > maxBucketCount {
+				return &rejection{reason: reasonInvalidBuckets, key: "bucket_counts"}
+			}
+		}
+
+		if r := requireFloat64(m, "sum"); r != nil {
+			return r
+		}
+	}
+
+	return validateLabels(m, "le")
+}
+
+func validateSummary(m map[string]interface{}) *rejection {
+	if r := requireName(m, "summary"); r != nil {
+		return r
+	}
+
+	v, ok := m["quantiles"]
+	if !ok {
+		return &rejection{reason: reasonMissingKey, key: "quantiles"}
+	}
+
+	quantiles, ok := v.(map[string]interface{})
+	if !ok {
+		return &rejection{reason: reasonWrongType, key: "quantiles"}
+	}
+
+	for q, v := range quantiles {
+		quantile, err := strconv.ParseFloat(q, 64)
+		if err != nil || quantile < 0 || quantile > 1 {
+			return &rejection{reason: reasonInvalidQuantile, key: "quantiles." + q}
+		}
+
+		if _, ok := v.(float64); !ok {
+			return &rejection{reason: reasonWrongType, key: "quantiles." + q}
+		}
+	}
+
+	if r := requireFloat64(m, "sum"); r != nil {
+		return r
+	}
+
+	if r := requireFloat64(m, "count"); r != nil {
+		return r
+	}
+
+	if m["count"].(float64) < 0 {
+		return &rejection{reason: reasonNegativeCount, key: "count"}
+	}
+
+	return validateLabels(m, "quantile")
+}
+
+func requireFloat64Slice(m map[string]interface{}, key string) *rejection {
+	v, ok := m[key]
+	if !ok {
+		return &rejection{reason: reasonMissingKey, key: key}
+	}
+
+	values, ok := v.([]interface{})
+	if !ok {
+		return &rejection{reason: reasonWrongType, key: key}
+	}
+
+	for _, value := range values {
+		if _, ok := value.(float64); !ok {
+			return &rejection{reason: reasonWrongType, key: key}
+		}
+	}
+
+	return nil
+}
+
+func toFloat64s(values []interface{}) []float64 {
+	floats := make([]float64, 0, len(values))
+	for _, v := range values {
+		floats = append(floats, v.(float64))
+	}
+
+	return floats
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		c[k] = v
+	}
+
+	return c
+}
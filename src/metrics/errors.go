@@ -0,0 +1,21 @@
+package metrics
+
+import "errors"
+
+var (
+	// ErrNotReady is returned when the metrics command exits with status 10
+	// to signal that it is not yet ready to emit metrics.
+	ErrNotReady = errors.New("metrics command not ready")
+
+	// ErrCommandFailed is returned when the metrics command cannot be started
+	// or exits with any other non-zero status.
+	ErrCommandFailed = errors.New("metrics command failed")
+
+	// ErrTimedOut is returned when the metrics command was killed for
+	// running longer than its timeout.
+	ErrTimedOut = errors.New("metrics command timed out")
+
+	// ErrParseFailed is returned when the metrics command output cannot be
+	// parsed in the configured format.
+	ErrParseFailed = errors.New("parsing metrics output failed")
+)
@@ -0,0 +1,280 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// Format is the format the metrics command prints its metrics in.
+type Format string
+
+const (
+	// FormatJSON is a JSON array of gauge, counter, histogram and summary
+	// entries.
+	FormatJSON Format = "json"
+
+	// FormatNDJSON is one FormatJSON entry per line. Lines that are not
+	// valid JSON are rejected like invalid entries instead of failing the
+	// whole run.
+	FormatNDJSON Format = "ndjson"
+
+	// FormatPrometheus is the Prometheus text exposition format. OpenMetrics
+	// text output is accepted as long as it does not rely on OpenMetrics
+	// only metric types.
+	FormatPrometheus Format = "prometheus"
+
+	// FormatAuto parses output starting with '[' as FormatJSON, output
+	// starting with '{' as FormatNDJSON and anything else as
+	// FormatPrometheus.
+	FormatAuto Format = "auto"
+)
+
+// ParseFormat returns the Format with the given name.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatJSON, FormatNDJSON, FormatPrometheus, FormatAuto:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown metrics format %q, must be one of %s, %s, %s or %s", s, FormatJSON, FormatNDJSON, FormatPrometheus, FormatAuto)
+}
+
+func (f Format) detect(out []byte) Format {
+	if f != FormatAuto {
+		return f
+	}
+
+	trimmed := bytes.TrimSpace(out)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		return FormatJSON
+	}
+
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return FormatNDJSON
+	}
+
+	return FormatPrometheus
+}
+
+func (p *Processor) processExposition(out []byte) error {
+	parser := expfmt.NewTextParser(model.LegacyValidation)
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(normalizeOpenMetrics(out)))
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if p.filtered(name) {
+			continue
+		}
+
+		p.recordFamily(families[name])
+	}
+
+	return nil
+}
+
+// familyKinds are the types series of Prometheus text output are counted as
+// parsed entries of.
+var familyKinds = map[dto.MetricType]string{
+	dto.MetricType_GAUGE:     "gauge",
+	dto.MetricType_UNTYPED:   "gauge",
+	dto.MetricType_COUNTER:   "counter",
+	dto.MetricType_SUMMARY:   "summary",
+	dto.MetricType_HISTOGRAM: "histogram",
+}
+
+// familyReservedLabels are the labels series of Prometheus text output cannot
+// have by type, as the Sink sets them itself.
+var familyReservedLabels = map[dto.MetricType][]string{
+	dto.MetricType_SUMMARY:   {"quantile"},
+	dto.MetricType_HISTOGRAM: {"le"},
+}
+
+func (p *Processor) recordFamily(mf *dto.MetricFamily) {
+	for _, m := range mf.GetMetric() {
+		labels := make(map[string]string, len(m.GetLabel()))
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+
+		if kind, ok := familyKinds[mf.GetType()]; ok {
+			p.parsed[kind]++
+		}
+
+		name, labels, ok := p.sanitize(mf.GetName(), labels, familyReservedLabels[mf.GetType()]...)
+		if !ok {
+			continue
+		}
+		help := mf.GetHelp()
+
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE:
+			p.setGauge(name, help, labels, m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			p.setGauge(name, help, labels, m.GetUntyped().GetValue())
+		case dto.MetricType_COUNTER:
+			p.setCounterTotal(name, help, labels, m.GetCounter().GetValue())
+		case dto.MetricType_SUMMARY:
+			quantiles := make(map[float64]float64)
+			for _, q := range m.GetSummary().GetQuantile() {
+				quantiles[q.GetQuantile()] = q.GetValue()
+			}
+
+			p.setSummary(
+				name,
+				help,
+				labels,
+				quantiles,
+				m.GetSummary().GetSampleSum(),
+				float64(m.GetSummary().GetSampleCount()),
+			)
+		case dto.MetricType_HISTOGRAM:
+			p.setHistogramTotals(name, help, labels, m.GetHistogram())
+		}
+	}
+}
+
+// setCounterTotal adds the increase since the previous cumulative value of
+// the series. A decrease means the source of the counter was reset, in which
+// case the whole new value is added.
+func (p *Processor) setCounterTotal(name, help string, labels map[string]string, total float64) {
+	key := seriesKey(name, labels)
+
+	delta := total - p.counterTotals[key]
+	if delta < 0 {
+		delta = total
+	}
+	p.counterTotals[key] = total
+
+	p.addCounter(name, help, labels, delta)
+}
+
+// setHistogramTotals adds the increase of each bucket and of the sum since
+// the previous cumulative totals of the series, resetting like
+// setCounterTotal when a bucket decreases.
+func (p *Processor) setHistogramTotals(name, help string, labels map[string]string, h *dto.Histogram) {
+	var buckets, totals []float64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+
+		buckets = append(buckets, b.GetUpperBound())
+		totals = append(totals, float64(b.GetCumulativeCount()))
+	}
+	totals = append(totals, float64(h.GetSampleCount()), h.GetSampleSum())
+
+	if len(buckets) == 0 {
+		return
+	}
+
+	key := seriesKey(name, labels)
+	previous := p.bucketTotals[key]
+	p.bucketTotals[key] = totals
+
+	// The last total is the sum, which can decrease when observations are
+	// negative, so only the counts tell whether the histogram was reset.
+	increases := make([]float64, len(totals))
+	for i := range totals {
+		increases[i] = totals[i]
+		if len(previous) == len(totals) {
+			increases[i] -= previous[i]
+		}
+
+		if increases[i] < 0 && i < len(totals)-1 {
+			copy(increases, totals)
+			break
+		}
+	}
+
+	counts := make([]uint64, len(buckets)+1)
+	for i := range counts {
+		count := increases[i]
+		if i > 0 {
+			count -= increases[i-1]
+		}
+
+		counts[i] = uint64(math.Max(count, 0))
+	}
+
+	p.addBucketCounts(name, help, labels, buckets, counts, increases[len(increases)-1])
+}
+
+// normalizeOpenMetrics rewrites OpenMetrics text output into the Prometheus
+// text format understood by the parser. Output without an "# EOF" marker is
+// returned unchanged.
+func normalizeOpenMetrics(out []byte) []byte {
+	if !bytes.Contains(out, []byte("# EOF")) {
+		return out
+	}
+
+	lines := strings.Split(string(out), "\n")
+
+	counters := make(map[string]bool)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" && fields[3] == "counter" {
+			counters[fields[2]] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		fields := strings.Fields(line)
+
+		switch {
+		case len(fields) == 0, line == "# EOF":
+			continue
+		case fields[0] != "#":
+			if isCreatedSample(fields[0], counters) {
+				continue
+			}
+
+			// Drop exemplars, which follow the sample value.
+			if i := strings.Index(line, " # {"); i >= 0 {
+				line = line[:i]
+			}
+		case len(fields) == 1:
+		case fields[1] == "UNIT":
+			continue
+		case len(fields) >= 3 && fields[1] == "HELP" && counters[fields[2]]:
+			line = strings.Replace(line, fields[2], fields[2]+"_total", 1)
+		case len(fields) == 4 && fields[1] == "TYPE":
+			switch fields[3] {
+			case "counter":
+				fields[2] += "_total"
+			case "unknown":
+				fields[3] = "untyped"
+			case "info", "stateset":
+				fields[3] = "gauge"
+			}
+			line = strings.Join(fields, " ")
+		}
+
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
+
+func isCreatedSample(sample string, counters map[string]bool) bool {
+	name, _, _ := strings.Cut(sample, "{")
+
+	base, ok := strings.CutSuffix(name, "_created")
+	return ok && counters[base]
+}
@@ -0,0 +1,236 @@
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processor with Prometheus text output", func() {
+	var (
+		spyExecutor *spyExecutor
+		m           *testhelpers.SpyMetricsRegistry
+		p           metrics.Processor
+	)
+
+	BeforeEach(func() {
+		spyExecutor = newSpyExecutor(nil, nil)
+		m = testhelpers.NewMetricsRegistry()
+		p = metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithFormat(metrics.FormatPrometheus),
+		)
+	})
+
+	It("sends gauges with their labels and help text", func() {
+		spyExecutor.out = []byte(`
+# HELP connections Open connections.
+# TYPE connections gauge
+connections{db="one"} 3
+connections{db="two"} 5
+# TYPE untyped_thing untyped
+untyped_thing 7
+`)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("connections", map[string]string{"db": "one"})).To(Equal(3.0))
+		Expect(m.GetMetricValue("connections", map[string]string{"db": "two"})).To(Equal(5.0))
+		Expect(m.GetMetric("connections", map[string]string{"db": "one"}).HelpText()).To(Equal("Open connections."))
+		Expect(m.GetMetricValue("untyped_thing", nil)).To(Equal(7.0))
+	})
+
+	It("adds the increase of counters between runs", func() {
+		spyExecutor.out = []byte(`
+# TYPE queries_total counter
+queries_total{db="one"} 10
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+		Expect(m.GetMetricValue("queries_total", map[string]string{"db": "one"})).To(Equal(10.0))
+
+		spyExecutor.out = []byte(`
+# TYPE queries_total counter
+queries_total{db="one"} 15
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+		Expect(m.GetMetricValue("queries_total", map[string]string{"db": "one"})).To(Equal(15.0))
+
+		By("treating a decrease as a counter reset")
+		spyExecutor.out = []byte(`
+# TYPE queries_total counter
+queries_total{db="one"} 2
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+		Expect(m.GetMetricValue("queries_total", map[string]string{"db": "one"})).To(Equal(17.0))
+	})
+
+	It("continues from the totals of a previous processor", func() {
+		spyExecutor.out = []byte(`
+# TYPE queries_total counter
+queries_total 10
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		p = metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithFormat(metrics.FormatPrometheus),
+			metrics.WithStateOf(p),
+		)
+
+		spyExecutor.out = []byte(`
+# TYPE queries_total counter
+queries_total 15
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("queries_total", nil)).To(Equal(15.0))
+	})
+
+	It("observes the increase of histogram buckets between runs", func() {
+		spyExecutor.out = []byte(`
+# TYPE latency histogram
+latency_bucket{le="0.1"} 1
+latency_bucket{le="0.5"} 3
+latency_bucket{le="+Inf"} 3
+latency_sum 0.7
+latency_count 3
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		h := m.GetMetric("latency", nil)
+		Expect(h.Buckets()).To(Equal([]float64{0.1, 0.5}))
+		Expect(h.Value()).To(BeNumerically("~", 0.7))
+
+		spyExecutor.out = []byte(`
+# TYPE latency histogram
+latency_bucket{le="0.1"} 2
+latency_bucket{le="0.5"} 4
+latency_bucket{le="+Inf"} 4
+latency_sum 0.8
+latency_count 4
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(h.Value()).To(BeNumerically("~", 0.8))
+	})
+
+	It("adds the increase of large histogram buckets and of their sum at once", func() {
+		r := metrics.NewPrometheusRegistry()
+		p = metrics.NewProcessor(&spyLogger{}, metrics.NewRegistrySink(r), spyExecutor, metrics.WithFormat(metrics.FormatPrometheus))
+
+		latency := func(bucket, count int, sum float64) {
+			spyExecutor.out = []byte(fmt.Sprintf(`
+# TYPE latency histogram
+latency_bucket{le="0.1"} %d
+latency_bucket{le="+Inf"} %d
+latency_sum %g
+latency_count %d
+`, bucket, count, sum, count))
+
+			start := time.Now()
+			Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		}
+
+		histogram := func() *dto.Histogram {
+			families, err := r.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(families).To(HaveLen(1))
+
+			return families[0].GetMetric()[0].GetHistogram()
+		}
+
+		latency(2000000, 2000001, 12345.5)
+		Expect(histogram().GetSampleCount()).To(BeEquivalentTo(2000001))
+		Expect(histogram().GetSampleSum()).To(Equal(12345.5))
+
+		latency(3000000, 3000002, 20000)
+		Expect(histogram().GetSampleCount()).To(BeEquivalentTo(3000002))
+		Expect(histogram().GetBucket()[0].GetCumulativeCount()).To(BeEquivalentTo(3000000))
+		Expect(histogram().GetSampleSum()).To(Equal(20000.0))
+
+		By("adding the whole totals after a reset")
+		latency(1, 1, 0.5)
+		Expect(histogram().GetSampleCount()).To(BeEquivalentTo(3000003))
+		Expect(histogram().GetSampleSum()).To(Equal(20000.5))
+	})
+
+	It("sends summaries as gauges", func() {
+		spyExecutor.out = []byte(`
+# TYPE rpc summary
+rpc{quantile="0.5"} 0.2
+rpc{quantile="0.9"} 0.4
+rpc_sum 12
+rpc_count 40
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("rpc", map[string]string{"quantile": "0.5"})).To(Equal(0.2))
+		Expect(m.GetMetricValue("rpc", map[string]string{"quantile": "0.9"})).To(Equal(0.4))
+		Expect(m.GetMetricValue("rpc_sum", nil)).To(Equal(12.0))
+		Expect(m.GetMetricValue("rpc_count", nil)).To(Equal(40.0))
+	})
+
+	It("accepts OpenMetrics text output", func() {
+		spyExecutor.out = []byte(`# HELP queries Queries run.
+# TYPE queries counter
+# UNIT queries queries
+queries_total{db="one"} 10 # {trace_id="abc"} 1
+queries_created{db="one"} 1.6e9
+# TYPE build info
+build_info{version="1.2"} 1
+# TYPE mystery unknown
+mystery 4
+# EOF
+`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("queries_total", map[string]string{"db": "one"})).To(Equal(10.0))
+		Expect(m.GetMetric("queries_total", map[string]string{"db": "one"}).HelpText()).To(Equal("Queries run."))
+		Expect(m.HasMetric("queries_created", map[string]string{"db": "one"})).To(BeFalse())
+		Expect(m.GetMetricValue("build_info", map[string]string{"version": "1.2"})).To(Equal(1.0))
+		Expect(m.GetMetricValue("mystery", nil)).To(Equal(4.0))
+	})
+
+	It("detects the format when configured to", func() {
+		p = metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithFormat(metrics.FormatAuto),
+		)
+
+		spyExecutor.out = []byte(`[{"key": "json-gauge", "value": 1, "unit": "things"}]`)
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		spyExecutor.out = []byte("prom_gauge 2\n")
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("json_gauge", map[string]string{"unit": "things"})).To(Equal(1.0))
+		Expect(m.GetMetricValue("prom_gauge", nil)).To(Equal(2.0))
+	})
+})
+
+var _ = Describe("ParseFormat", func() {
+	It("parses known formats", func() {
+		for _, f := range []metrics.Format{metrics.FormatJSON, metrics.FormatNDJSON, metrics.FormatPrometheus, metrics.FormatAuto} {
+			Expect(metrics.ParseFormat(string(f))).To(Equal(f))
+		}
+	})
+
+	It("rejects unknown formats", func() {
+		_, err := metrics.ParseFormat("xml")
+		Expect(err).To(MatchError(ContainSubstring(`unknown metrics format "xml"`)))
+	})
+})
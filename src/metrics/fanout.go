@@ -0,0 +1,267 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// defaultFanOutBufferSize is the number of samples buffered for an output
+// by default.
+const defaultFanOutBufferSize = 10000
+
+// FanOut is a Sink that records every sample in its primary Sink, such as the
+// registry served for prom_scraper, and forwards it to each of its outputs,
+// such as the outputs pushing metrics elsewhere. The primary Sink records the
+// sample before the call returns, so it never loses samples. Every output
+// receives its samples in order from its own goroutine, so an output that is
+// slow, blocked or panics does not hold up the others or the collectors.
+// When the buffer of an output is full, its samples are dropped until it
+// catches up.
+//
+// The outputs are instrumented in the primary Sink, labelled with the output
+// name:
+//
+//   - service_metrics_sink_samples, the samples delivered to the output
+//   - service_metrics_sink_dropped_samples, the samples dropped because the
+//     output fell behind
+//   - service_metrics_sink_failures, the failures of the output, such as
+//     failed sends it reports and panics
+type FanOut struct {
+	logger     Logger
+	primary    Sink
+	bufferSize int
+
+	outputs []*fanOutput
+	wg      sync.WaitGroup
+
+	// mu guards closed, so that no sample is sent to an output after it
+	// was closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+type fanOutput struct {
+	name    string
+	sink    Sink
+	samples chan sample
+
+	delivered Series
+	dropped   Series
+	failures  Series
+
+	// dropping is set while samples are dropped, so that only the first
+	// one is logged.
+	dropping atomic.Bool
+}
+
+type sampleKind int
+
+const (
+	sampleGauge sampleKind = iota
+	sampleCounter
+	sampleHistogram
+	sampleHistogramCounts
+	sampleDelete
+)
+
+type sample struct {
+	kind    sampleKind
+	series  Series
+	buckets []float64
+	counts  []uint64
+	value   float64
+}
+
+// FanOutOption configures optional FanOut behaviour.
+type FanOutOption func(*FanOut)
+
+// WithBufferSize sets the number of samples buffered for each output, 10000
+// by default.
+func WithBufferSize(n int) FanOutOption {
+	return func(f *FanOut) {
+		f.bufferSize = n
+	}
+}
+
+// NewFanOut returns a FanOut without outputs that records every sample, and
+// its own metrics, in primary. As primary holds up the collectors, it should
+// not be slow.
+func NewFanOut(l Logger, primary Sink, opts ...FanOutOption) *FanOut {
+	f := &FanOut{
+		logger:     l,
+		primary:    primary,
+		bufferSize: defaultFanOutBufferSize,
+	}
+
+	for _, o := range opts {
+		o(f)
+	}
+
+	return f
+}
+
+// AddOutput starts forwarding samples to s. Outputs must be added before any
+// sample is recorded.
+func (f *FanOut) AddOutput(name string, s Sink) {
+	labels := map[string]string{"sink": name}
+	o := &fanOutput{
+		name:    name,
+		sink:    s,
+		samples: make(chan sample, f.bufferSize),
+		delivered: Series{
+			Name:   "service_metrics_sink_samples",
+			Help:   "Number of samples delivered to the sink.",
+			Labels: labels,
+		},
+		dropped: Series{
+			Name:   "service_metrics_sink_dropped_samples",
+			Help:   "Number of samples dropped because the sink fell behind.",
+			Labels: labels,
+		},
+		failures: sinkFailures(name),
+	}
+
+	f.primary.AddCounter(o.delivered, 0)
+	f.primary.AddCounter(o.dropped, 0)
+	f.primary.AddCounter(o.failures, 0)
+
+	f.outputs = append(f.outputs, o)
+
+	f.wg.Add(1)
+	go f.forward(o)
+}
+
+func sinkFailures(name string) Series {
+	return Series{
+		Name:   "service_metrics_sink_failures",
+		Help:   "Number of failures of the sink.",
+		Labels: map[string]string{"sink": name},
+	}
+}
+
+// FailureHandler returns a function that counts the failures an output
+// reports, such as sends that failed, as failures of the output name.
+func (f *FanOut) FailureHandler(name string) func(error) {
+	failures := sinkFailures(name)
+
+	return func(error) {
+		f.primary.AddCounter(failures, 1)
+	}
+}
+
+// Close delivers the buffered samples and stops forwarding. Samples recorded
+// after Close are only recorded in the primary Sink.
+func (f *FanOut) Close() {
+	f.mu.Lock()
+	f.closed = true
+	for _, o := range f.outputs {
+		close(o.samples)
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+}
+
+// CheckSeries checks the series with the primary Sink if it implements
+// SeriesChecker. Outputs are not checked, they record what the primary Sink
+// records.
+func (f *FanOut) CheckSeries(kind string, s Series) error {
+	if c, ok := f.primary.(SeriesChecker); ok {
+		return c.CheckSeries(kind, s)
+	}
+
+	return nil
+}
+
+func (f *FanOut) SetGauge(s Series, value float64) {
+	f.send(sample{kind: sampleGauge, series: s, value: value})
+}
+
+func (f *FanOut) AddCounter(s Series, delta float64) {
+	f.send(sample{kind: sampleCounter, series: s, value: delta})
+}
+
+func (f *FanOut) ObserveHistogram(s Series, buckets []float64, value float64) {
+	f.send(sample{kind: sampleHistogram, series: s, buckets: buckets, value: value})
+}
+
+func (f *FanOut) AddHistogramCounts(s Series, buckets []float64, counts []uint64, sum float64) {
+	f.send(sample{kind: sampleHistogramCounts, series: s, buckets: buckets, counts: counts, value: sum})
+}
+
+func (f *FanOut) DeleteSeries(s Series) {
+	f.send(sample{kind: sampleDelete, series: s})
+}
+
+func (f *FanOut) send(s sample) {
+	s.recordIn(f.primary)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return
+	}
+
+	for _, o := range f.outputs {
+		select {
+		case o.samples <- s:
+			o.dropping.Store(false)
+		default:
+			f.primary.AddCounter(o.dropped, 1)
+			if !o.dropping.Swap(true) {
+				f.logger.Error("forwarding-samples", errors.New("buffer full"), lager.Data{
+					"sink":  o.name,
+					"event": "dropping",
+				})
+			}
+		}
+	}
+}
+
+func (f *FanOut) forward(o *fanOutput) {
+	defer f.wg.Done()
+
+	for s := range o.samples {
+		if f.deliver(o, s) {
+			f.primary.AddCounter(o.delivered, 1)
+		}
+	}
+}
+
+// deliver records s in the output and reports whether it did not panic.
+func (f *FanOut) deliver(o *fanOutput, s sample) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.primary.AddCounter(o.failures, 1)
+			f.logger.Error("forwarding-samples", fmt.Errorf("sink panicked: %v", r), lager.Data{
+				"sink":   o.name,
+				"metric": s.series.Name,
+			})
+			ok = false
+		}
+	}()
+
+	s.recordIn(o.sink)
+
+	return true
+}
+
+func (s sample) recordIn(sink Sink) {
+	switch s.kind {
+	case sampleGauge:
+		sink.SetGauge(s.series, s.value)
+	case sampleCounter:
+		sink.AddCounter(s.series, s.value)
+	case sampleHistogram:
+		sink.ObserveHistogram(s.series, s.buckets, s.value)
+	case sampleHistogramCounts:
+		sink.AddHistogramCounts(s.series, s.buckets, s.counts, s.value)
+	case sampleDelete:
+		sink.DeleteSeries(s.series)
+	}
+}
@@ -0,0 +1,230 @@
+package metrics_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FanOut", func() {
+	var (
+		logger      *spyLogger
+		instruments *testhelpers.SpyMetricsRegistry
+		series      metrics.Series
+	)
+
+	BeforeEach(func() {
+		logger = &spyLogger{}
+		instruments = testhelpers.NewMetricsRegistry()
+		series = metrics.Series{Name: "size", Help: "The size.", Labels: map[string]string{"db": "one"}}
+	})
+
+	sinkMetric := func(name, sink string) float64 {
+		return instruments.GetMetricValue(name, map[string]string{"sink": sink})
+	}
+
+	It("forwards every sample to every output", func() {
+		one, two := &recordingSink{}, &recordingSink{}
+		f := metrics.NewFanOut(logger, metrics.NewRegistrySink(instruments))
+		f.AddOutput("one", one)
+		f.AddOutput("two", two)
+
+		f.SetGauge(series, 1)
+		f.AddCounter(series, 2)
+		f.ObserveHistogram(series, []float64{1, 5}, 3)
+
+		// The spy registry does not lock its removals, so the outputs must be
+		// idle when the series is deleted from it.
+		Eventually(func() float64 { return sinkMetric("service_metrics_sink_samples", "one") }).Should(Equal(3.0))
+		Eventually(func() float64 { return sinkMetric("service_metrics_sink_samples", "two") }).Should(Equal(3.0))
+		f.DeleteSeries(series)
+		f.Close()
+
+		expected := []string{"gauge size 1", "counter size 2", "histogram size 3", "delete size"}
+		Expect(one.recorded()).To(Equal(expected))
+		Expect(two.recorded()).To(Equal(expected))
+		Expect(sinkMetric("service_metrics_sink_samples", "one")).To(Equal(4.0))
+		Expect(sinkMetric("service_metrics_sink_samples", "two")).To(Equal(4.0))
+	})
+
+	It("records every sample in the primary sink before returning", func() {
+		f := metrics.NewFanOut(logger, metrics.NewRegistrySink(instruments))
+
+		f.SetGauge(series, 1)
+		Expect(instruments.GetMetricValue("size", series.Labels)).To(Equal(1.0))
+
+		f.AddCounter(metrics.Series{Name: "requests"}, 2)
+		Expect(instruments.GetMetricValue("requests", nil)).To(Equal(2.0))
+		f.Close()
+	})
+
+	It("records a burst larger than the buffer in the primary sink", func() {
+		release := make(chan struct{})
+		blocked := &recordingSink{block: release}
+		f := metrics.NewFanOut(logger, metrics.NewRegistrySink(instruments), metrics.WithBufferSize(10))
+		f.AddOutput("blocked", blocked)
+
+		for i := 0; i < 1000; i++ {
+			f.AddCounter(metrics.Series{Name: "requests"}, 1)
+		}
+
+		Expect(instruments.GetMetricValue("requests", nil)).To(Equal(1000.0))
+		Expect(sinkMetric("service_metrics_sink_dropped_samples", "blocked")).To(BeNumerically(">=", 989))
+
+		close(release)
+		f.Close()
+	})
+
+	It("registers the metrics of an output at zero", func() {
+		f := metrics.NewFanOut(logger, metrics.NewRegistrySink(instruments))
+		f.AddOutput("one", &recordingSink{})
+		f.Close()
+
+		for _, name := range []string{
+			"service_metrics_sink_samples",
+			"service_metrics_sink_dropped_samples",
+			"service_metrics_sink_failures",
+		} {
+			Expect(instruments.HasMetric(name, map[string]string{"sink": "one"})).To(BeTrue(), name)
+			Expect(sinkMetric(name, "one")).To(BeZero(), name)
+		}
+	})
+
+	It("drops the samples of an output that falls behind without holding up the others", func() {
+		release := make(chan struct{})
+		blocked, other := &recordingSink{block: release}, &recordingSink{}
+		f := metrics.NewFanOut(logger, metrics.NewRegistrySink(instruments), metrics.WithBufferSize(1))
+		f.AddOutput("blocked", blocked)
+		f.AddOutput("other", other)
+
+		for i := 0; i < 5; i++ {
+			f.SetGauge(series, float64(i))
+			Eventually(other.recorded).Should(HaveLen(i + 1))
+		}
+
+		Expect(sinkMetric("service_metrics_sink_dropped_samples", "blocked")).To(BeNumerically(">=", 3))
+		Expect(sinkMetric("service_metrics_sink_dropped_samples", "other")).To(BeZero())
+		Expect(logger.errAction).To(Equal("forwarding-samples"))
+		Expect(logger.errData[0]).To(HaveKeyWithValue("sink", "blocked"))
+
+		close(release)
+		f.Close()
+
+		Expect(sinkMetric("service_metrics_sink_samples", "blocked") +
+			sinkMetric("service_metrics_sink_dropped_samples", "blocked")).To(Equal(5.0))
+		Expect(sinkMetric("service_metrics_sink_samples", "other")).To(Equal(5.0))
+	})
+
+	It("counts a panic of an output as a failure without affecting the others", func() {
+		panicking, other := &recordingSink{panics: true}, &recordingSink{}
+		f := metrics.NewFanOut(logger, metrics.NewRegistrySink(instruments))
+		f.AddOutput("panicking", panicking)
+		f.AddOutput("other", other)
+
+		f.SetGauge(series, 1)
+		f.SetGauge(series, 2)
+		f.Close()
+
+		Expect(sinkMetric("service_metrics_sink_failures", "panicking")).To(Equal(2.0))
+		Expect(sinkMetric("service_metrics_sink_samples", "panicking")).To(BeZero())
+		Expect(other.recorded()).To(Equal([]string{"gauge size 1", "gauge size 2"}))
+		Expect(logger.errAction).To(Equal("forwarding-samples"))
+		Expect(logger.err).To(MatchError(ContainSubstring("sink panicked")))
+	})
+
+	It("delivers the buffered samples on Close and discards later ones", func() {
+		release := make(chan struct{})
+		slow := &recordingSink{block: release}
+		f := metrics.NewFanOut(logger, metrics.NewRegistrySink(instruments))
+		f.AddOutput("slow", slow)
+
+		f.SetGauge(series, 1)
+		f.SetGauge(series, 2)
+
+		closed := make(chan struct{})
+		go func() {
+			f.Close()
+			close(closed)
+		}()
+		Consistently(closed).ShouldNot(BeClosed())
+
+		close(release)
+		Eventually(closed).Should(BeClosed())
+		Expect(slow.recorded()).To(Equal([]string{"gauge size 1", "gauge size 2"}))
+
+		f.SetGauge(series, 3)
+		Expect(slow.recorded()).To(HaveLen(2))
+	})
+
+	It("counts the failures an output reports", func() {
+		f := metrics.NewFanOut(logger, metrics.NewRegistrySink(instruments))
+		f.AddOutput("one", &recordingSink{})
+
+		onError := f.FailureHandler("one")
+		onError(errors.New("unavailable"))
+		onError(errors.New("unavailable"))
+		f.Close()
+
+		Expect(sinkMetric("service_metrics_sink_failures", "one")).To(Equal(2.0))
+	})
+})
+
+// recordingSink records the samples it receives. When block is set, every
+// sample waits until it is closed.
+type recordingSink struct {
+	block  chan struct{}
+	panics bool
+
+	mu      sync.Mutex
+	samples []string
+}
+
+func (s *recordingSink) SetGauge(series metrics.Series, value float64) {
+	s.record("gauge", series, value)
+}
+
+func (s *recordingSink) AddCounter(series metrics.Series, delta float64) {
+	s.record("counter", series, delta)
+}
+
+func (s *recordingSink) ObserveHistogram(series metrics.Series, _ []float64, value float64) {
+	s.record("histogram", series, value)
+}
+
+func (s *recordingSink) AddHistogramCounts(series metrics.Series, _ []float64, _ []uint64, sum float64) {
+	s.record("histogram counts", series, sum)
+}
+
+func (s *recordingSink) DeleteSeries(series metrics.Series) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples = append(s.samples, "delete "+series.Name)
+}
+
+func (s *recordingSink) record(kind string, series metrics.Series, value float64) {
+	if s.block != nil {
+		<-s.block
+	}
+	if s.panics {
+		panic("output failed")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples = append(s.samples, fmt.Sprintf("%s %s %g", kind, series.Name, value))
+}
+
+func (s *recordingSink) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.samples...)
+}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"errors"
+	"time"
+)
+
+// ReservedPrefix is the prefix of the metrics service metrics exports about
+// itself. Series reported by the metrics command with this prefix are
+// skipped.
+const ReservedPrefix = "service_metrics_"
+
+// Run results counted by the service_metrics_runs counter.
+const (
+	resultSuccess    = "success"
+	resultNotReady   = "not_ready"
+	resultFailed     = "failed"
+	resultParseError = "parse_error"
+	resultTimeout    = "timeout"
+)
+
+var (
+	runResults = []string{resultSuccess, resultNotReady, resultFailed, resultParseError, resultTimeout}
+	entryTypes = []string{"gauge", "counter", "histogram", "summary"}
+
+	durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+)
+
+// WithInstrumentation records metrics about every run of the metrics command,
+// labelled with the given collector name:
+//
+//   - service_metrics_command_duration_seconds, a histogram of run durations
+//   - service_metrics_last_success_timestamp_seconds, the Unix time of the
+//     last successful run
+//   - service_metrics_runs, runs counted by result: success, not_ready,
+//     failed, parse_error or timeout
+//   - service_metrics_parsed_entries, the entries of the last successful run
+//     by type
+//   - service_metrics_dropped_entries, the entries of the last successful run
+//     that were dropped as invalid
+//   - service_metrics_output_bytes, the size of the last output
+//
+// Batches written by long-running metrics commands are recorded as runs
+// without a duration. Runs canceled by their context are not recorded.
+func WithInstrumentation(collector string) ProcessorOption {
+	return func(p *Processor) {
+		p.instruments = newInstruments(p.sink, map[string]string{"collector": collector})
+	}
+}
+
+type instruments struct {
+	sink        Sink
+	duration    Series
+	lastSuccess Series
+	runs        map[string]Series
+	parsed      map[string]Series
+	dropped     Series
+	outputBytes Series
+}
+
+// newInstruments returns the instruments labelled with labels. The run
+// counters and the gauges are exported from the start, at zero, the duration
+// histogram once the first run has been observed.
+func newInstruments(s Sink, labels map[string]string) *instruments {
+	i := &instruments{
+		sink: s,
+		duration: Series{
+			Name:   ReservedPrefix + "command_duration_seconds",
+			Help:   "Duration of metrics command runs.",
+			Labels: labels,
+		},
+		lastSuccess: Series{
+			Name:   ReservedPrefix + "last_success_timestamp_seconds",
+			Help:   "Unix time of the last successful metrics command run.",
+			Labels: labels,
+		},
+		runs:   make(map[string]Series, len(runResults)),
+		parsed: make(map[string]Series, len(entryTypes)),
+		dropped: Series{
+			Name:   ReservedPrefix + "dropped_entries",
+			Help:   "Number of invalid entries dropped from the output of the last successful metrics command run.",
+			Labels: labels,
+		},
+		outputBytes: Series{
+			Name:   ReservedPrefix + "output_bytes",
+			Help:   "Size of the output of the last metrics command run.",
+			Labels: labels,
+		},
+	}
+
+	for _, r := range runResults {
+		i.runs[r] = Series{
+			Name:   ReservedPrefix + "runs",
+			Help:   "Number of metrics command runs by result.",
+			Labels: withLabel(labels, "result", r),
+		}
+		s.AddCounter(i.runs[r], 0)
+	}
+
+	for _, t := range entryTypes {
+		i.parsed[t] = Series{
+			Name:   ReservedPrefix + "parsed_entries",
+			Help:   "Number of entries by type in the output of the last successful metrics command run.",
+			Labels: withLabel(labels, "type", t),
+		}
+		s.SetGauge(i.parsed[t], 0)
+	}
+
+	for _, g := range []Series{i.lastSuccess, i.dropped, i.outputBytes} {
+		s.SetGauge(g, 0)
+	}
+
+	return i
+}
+
+// observe records a run that took duration and produced size bytes of
+// output, which failed with err unless it is nil. Nothing is recorded when i
+// is nil.
+func (i *instruments) observe(duration time.Duration, size int, err error, parsed map[string]int, dropped int) {
+	if i == nil {
+		return
+	}
+
+	i.sink.ObserveHistogram(i.duration, durationBuckets, duration.Seconds())
+	i.observeResult(size, err, parsed, dropped)
+}
+
+// observeResult records the result of a run or batch, without its duration.
+func (i *instruments) observeResult(size int, err error, parsed map[string]int, dropped int) {
+	if i == nil {
+		return
+	}
+
+	result := runResult(err)
+	i.sink.AddCounter(i.runs[result], 1)
+
+	if result == resultSuccess || result == resultParseError {
+		i.sink.SetGauge(i.outputBytes, float64(size))
+	}
+
+	if result != resultSuccess {
+		return
+	}
+
+	i.sink.SetGauge(i.lastSuccess, float64(time.Now().UnixNano())/float64(time.Second))
+	i.sink.SetGauge(i.dropped, float64(dropped))
+	for t, g := range i.parsed {
+		i.sink.SetGauge(g, float64(parsed[t]))
+	}
+}
+
+func runResult(err error) string {
+	switch {
+	case err == nil:
+		return resultSuccess
+	case errors.Is(err, ErrNotReady):
+		return resultNotReady
+	case errors.Is(err, ErrTimedOut):
+		return resultTimeout
+	case errors.Is(err, ErrParseFailed):
+		return resultParseError
+	default:
+		return resultFailed
+	}
+}
+
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	l := copyLabels(labels)
+	l[name] = value
+
+	return l
+}
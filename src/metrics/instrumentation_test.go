@@ -0,0 +1,111 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processor with instrumentation", func() {
+	var (
+		spyExecutor *spyExecutor
+		m           *testhelpers.SpyMetricsRegistry
+		p           metrics.Processor
+	)
+
+	runs := func(result string) float64 {
+		return m.GetMetricValue("service_metrics_runs", map[string]string{
+			"collector": "my-collector",
+			"result":    result,
+		})
+	}
+
+	BeforeEach(func() {
+		spyExecutor = newSpyExecutor(nil, nil)
+		m = testhelpers.NewMetricsRegistry()
+		p = metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithInstrumentation("my-collector"),
+		)
+	})
+
+	It("records successful runs", func() {
+		spyExecutor.out = []byte(`[
+			{"key": "my-key", "value": 1, "unit": "things"},
+			{"name": "my-counter", "delta": 2},
+			{"name": "negative-counter", "delta": -2}
+		]`)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		collector := map[string]string{"collector": "my-collector"}
+		Expect(runs("success")).To(Equal(1.0))
+		Expect(runs("failed")).To(Equal(0.0))
+		Expect(m.HasMetric("service_metrics_command_duration_seconds", collector)).To(BeTrue())
+		Expect(m.GetMetricValue("service_metrics_last_success_timestamp_seconds", collector)).To(BeNumerically(">", 0))
+		Expect(m.GetMetricValue("service_metrics_output_bytes", collector)).To(Equal(float64(len(spyExecutor.out))))
+		Expect(m.GetMetricValue("service_metrics_dropped_entries", collector)).To(Equal(1.0))
+		Expect(m.GetMetricValue("service_metrics_parsed_entries", map[string]string{
+			"collector": "my-collector",
+			"type":      "gauge",
+		})).To(Equal(1.0))
+		Expect(m.GetMetricValue("service_metrics_parsed_entries", map[string]string{
+			"collector": "my-collector",
+			"type":      "counter",
+		})).To(Equal(1.0))
+	})
+
+	It("counts runs by result", func() {
+		spyExecutor.err = fmt.Errorf("%w: exit status 10", metrics.ErrNotReady)
+		Expect(p.Process(context.Background(), "/bin/echo")).ToNot(Succeed())
+
+		spyExecutor.err = metrics.ErrTimedOut
+		Expect(p.Process(context.Background(), "/bin/echo")).ToNot(Succeed())
+
+		spyExecutor.err = fmt.Errorf("%w: exit status 1", metrics.ErrCommandFailed)
+		Expect(p.Process(context.Background(), "/bin/echo")).ToNot(Succeed())
+
+		spyExecutor.err = nil
+		spyExecutor.out = []byte("not json")
+		Expect(p.Process(context.Background(), "/bin/echo")).ToNot(Succeed())
+
+		Expect(runs("not_ready")).To(Equal(1.0))
+		Expect(runs("timeout")).To(Equal(1.0))
+		Expect(runs("failed")).To(Equal(1.0))
+		Expect(runs("parse_error")).To(Equal(1.0))
+		Expect(runs("success")).To(Equal(0.0))
+		Expect(m.GetMetricValue("service_metrics_last_success_timestamp_seconds", map[string]string{
+			"collector": "my-collector",
+		})).To(Equal(0.0))
+	})
+
+	It("does not record canceled runs", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		spyExecutor.err = errors.New("killed")
+
+		Expect(p.Process(ctx, "/bin/echo")).To(MatchError(context.Canceled))
+
+		for _, result := range []string{"success", "not_ready", "failed", "parse_error", "timeout"} {
+			Expect(runs(result)).To(Equal(0.0))
+		}
+	})
+
+	It("skips metrics with the reserved prefix", func() {
+		spyExecutor.out = []byte(`[
+			{"key": "service_metrics_runs", "value": 1, "unit": "things"}
+		]`)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(m.HasMetric("service_metrics_runs", map[string]string{"unit": "things"})).To(BeFalse())
+	})
+})
@@ -1,12 +1,34 @@
 package metrics
 
 type GaugeMetric struct {
-	Key   string  `json:"key"`
-	Value float64 `json:"value"`
-	Unit  string  `json:"unit"`
+	Key    string            `json:"key"`
+	Value  float64           `json:"value"`
+	Unit   string            `json:"unit"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type CounterMetric struct {
-	Name  string `json:"name"`
-	Delta uint64 `json:"delta"`
+	Name   string            `json:"name"`
+	Delta  uint64            `json:"delta"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// HistogramMetric carries either raw Observations or pre-aggregated
+// BucketCounts, one per bucket plus a final overflow count, along with Sum,
+// the sum of the counted observations.
+type HistogramMetric struct {
+	Histogram    string            `json:"histogram"`
+	Buckets      []float64         `json:"buckets"`
+	Observations []float64         `json:"observations,omitempty"`
+	BucketCounts []uint64          `json:"bucket_counts,omitempty"`
+	Sum          *float64          `json:"sum,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+type SummaryMetric struct {
+	Summary   string             `json:"summary"`
+	Quantiles map[string]float64 `json:"quantiles"`
+	Sum       float64            `json:"sum"`
+	Count     uint64             `json:"count"`
+	Labels    map[string]string  `json:"labels,omitempty"`
 }
@@ -1,8 +1,10 @@
 package metrics_test
 
 import (
+	"strings"
 	"testing"
 
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
 	"code.cloudfoundry.org/lager/v3"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -15,12 +17,21 @@ func TestMetrics(t *testing.T) {
 
 type spyLogger struct {
 	// map of action strings to slice of data called against the actions
-	infoKey   string
-	infoData  []lager.Data
-	errAction string
-	errData   []lager.Data
-	err       error
-	errCalled bool
+	debugKey   string
+	debugData  []lager.Data
+	debugCalls int
+	infoKey    string
+	infoData   []lager.Data
+	errAction  string
+	errData    []lager.Data
+	err        error
+	errCalled  bool
+}
+
+func (l *spyLogger) Debug(action string, data ...lager.Data) {
+	l.debugKey = action
+	l.debugData = data
+	l.debugCalls++
 }
 
 func (l *spyLogger) Info(action string, data ...lager.Data) {
@@ -34,3 +45,16 @@ func (l *spyLogger) Error(action string, err error, data ...lager.Data) {
 	l.err = err
 	l.errCalled = true
 }
+
+// recordedMetrics returns the keys of the metrics in m, except for the
+// counter of rejected entries.
+func recordedMetrics(m *testhelpers.SpyMetricsRegistry) []string {
+	var keys []string
+	for k := range m.Metrics {
+		if !strings.HasPrefix(k, "service_metrics_rejected_entries") {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// maxNDJSONLine is the longest line of NDJSON output that can be parsed.
+const maxNDJSONLine = 1024 * 1024
+
+// processNDJSON records every line of r that is a valid entry. Lines that
+// are not a JSON object are rejected, empty lines are skipped. Only reading
+// r, or a line longer than maxNDJSONLine, fails the whole output.
+func (p *Processor) processNDJSON(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLine)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var metric map[string]interface{}
+		if err := json.Unmarshal(line, &metric); err != nil || metric == nil {
+			p.reject(nil, &rejection{reason: reasonMalformedJSON})
+			continue
+		}
+
+		p.recordEntry(metric)
+	}
+
+	return scanner.Err()
+}
+
+// stream runs the command with a StreamingExecutor, recording its NDJSON
+// output as it is read.
+func (p *Processor) stream(ctx context.Context, s StreamingExecutor, cmd *exec.Cmd) error {
+	var (
+		size    int
+		readErr error
+	)
+
+	start := time.Now()
+	err := s.Stream(cmd, func(r io.Reader) {
+		counter := &countingReader{r: r}
+		readErr = p.processNDJSON(counter)
+		size = counter.n
+	})
+	duration := time.Since(start)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err == nil && readErr != nil {
+		err = p.parseFailed(readErr, nil)
+	}
+
+	if err == nil {
+		p.removeStaleGauges()
+	}
+
+	p.instruments.observe(duration, size, err, p.parsed, p.dropped)
+
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+
+	return n, err
+}
@@ -0,0 +1,111 @@
+package metrics_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processor with NDJSON output", func() {
+	var m *testhelpers.SpyMetricsRegistry
+
+	BeforeEach(func() {
+		m = testhelpers.NewMetricsRegistry()
+	})
+
+	It("records every valid line and rejects malformed ones", func() {
+		spyExecutor := newSpyExecutor([]byte(`{"key": "my-key", "value": 1, "unit": "things"}
+{"key": "broken",
+[1, 2]
+
+{"name": "my-counter", "delta": 2}
+`), nil)
+
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithFormat(metrics.FormatNDJSON),
+		)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things"})).To(Equal(1.0))
+		Expect(m.GetMetricValue("my_counter", nil)).To(Equal(2.0))
+		Expect(m.GetMetricValue("service_metrics_rejected_entries", map[string]string{"reason": "malformed_json"})).To(Equal(2.0))
+	})
+
+	It("records the output while a streaming executor runs the command", func() {
+		spyExecutor := &spyStreamingExecutor{spyExecutor: newSpyExecutor(
+			[]byte(`{"key": "my-key", "value": 1, "unit": "things"}`+"\n"),
+			fmt.Errorf("%w: exit status 1", metrics.ErrCommandFailed),
+		)}
+
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithFormat(metrics.FormatNDJSON),
+		)
+
+		err := p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(err).To(MatchError(metrics.ErrCommandFailed))
+		Expect(spyExecutor.streamed).To(BeTrue())
+		Expect(spyExecutor.cmd.Args).To(Equal([]string{"/bin/echo", "my", "command"}))
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things"})).To(Equal(1.0))
+	})
+
+	It("does not stream other formats", func() {
+		spyExecutor := &spyStreamingExecutor{spyExecutor: newSpyExecutor(
+			[]byte(`[{"key": "my-key", "value": 1, "unit": "things"}]`),
+			nil,
+		)}
+
+		p := metrics.NewProcessor(&spyLogger{}, metrics.NewRegistrySink(m), spyExecutor)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(spyExecutor.streamed).To(BeFalse())
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things"})).To(Equal(1.0))
+	})
+
+	It("is detected when configured to", func() {
+		spyExecutor := newSpyExecutor([]byte(`{"key": "my-key", "value": 1, "unit": "things"}
+{"key": "my-other-key", "value": 2, "unit": "things"}
+`), nil)
+
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithFormat(metrics.FormatAuto),
+		)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(m.GetMetricValue("my_other_key", map[string]string{"unit": "things"})).To(Equal(2.0))
+	})
+})
+
+type spyStreamingExecutor struct {
+	*spyExecutor
+	streamed bool
+}
+
+func (e *spyStreamingExecutor) Stream(c *exec.Cmd, read func(io.Reader)) error {
+	e.cmd = c
+	e.streamed = true
+
+	read(bytes.NewReader(e.out))
+
+	return e.err
+}
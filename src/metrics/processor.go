@@ -2,24 +2,40 @@ package metrics
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"os"
+	"fmt"
+	"io"
 	"os/exec"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
-	metrics "code.cloudfoundry.org/go-metric-registry"
 	"code.cloudfoundry.org/lager/v3"
 )
 
 var (
-	invalidNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	invalidNameRegex      = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	invalidLabelNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 )
 
+// Executor runs the metrics command and returns its output. Failures should
+// be reported by wrapping ErrNotReady, ErrCommandFailed or ErrTimedOut.
 type Executor interface {
 	Run(*exec.Cmd) ([]byte, error)
 }
 
+// StreamingExecutor is an Executor that can also hand the output of the
+// command to read while the command is running. Stream returns once read has
+// returned and the command has exited, with the same errors as Run.
+type StreamingExecutor interface {
+	Executor
+	Stream(c *exec.Cmd, read func(io.Reader)) error
+}
+
 type Logger interface {
+	Debug(string, ...lager.Data)
 	Info(string, ...lager.Data)
 	Error(action string, err error, data ...lager.Data)
 }
@@ -27,136 +43,545 @@ type Logger interface {
 type Processor struct {
 	logger   Logger
 	executor Executor
-	metrics  metricsRegistry
+	sink     Sink
+	format   Format
+
+	signatures *Signatures
+	labels     map[string]string
+
+	// counterTotals and bucketTotals hold the last cumulative values seen in
+	// Prometheus text output, so they can be turned into deltas. The totals
+	// of a histogram are its cumulative bucket counts followed by its count
+	// and sum.
+	counterTotals map[string]float64
+	bucketTotals  map[string][]float64
+
+	staleGaugeRuns int
+	gauges         map[string]*trackedGauge
+
+	// parsed counts the entries of the current run by type and dropped the
+	// entries rejected by validation.
+	parsed  map[string]int
+	dropped int
+
+	// rejectionLogs holds when a rejection for each reason was last logged.
+	rejectionLogs map[string]*rejectionLog
+
+	instruments *instruments
+	report      *Report
+
+	keep, drop *regexp.Regexp
+
+	relabelRules []RelabelRule
+}
+
+// ProcessorOption configures optional Processor behaviour.
+type ProcessorOption func(*Processor)
+
+// WithLabels adds the given labels to every series recorded by the
+// Processor. Labels reported by the metrics command take precedence.
+func WithLabels(labels map[string]string) ProcessorOption {
+	return func(p *Processor) {
+		p.labels = labels
+	}
+}
+
+// WithSignatures shares the record of registered series between Processors
+// that record into the same Sink.
+func WithSignatures(s *Signatures) ProcessorOption {
+	return func(p *Processor) {
+		p.signatures = s
+	}
+}
+
+// WithStateOf continues from the cumulative counter and histogram totals and
+// the tracked gauges of prev, so that replacing the Processor for a metrics
+// command, e.g. when its configuration is reloaded, does not record the
+// totals the command reports again.
+func WithStateOf(prev Processor) ProcessorOption {
+	return func(p *Processor) {
+		p.counterTotals = prev.counterTotals
+		p.bucketTotals = prev.bucketTotals
+		p.gauges = prev.gauges
+	}
+}
+
+// WithNameFilter only records the metrics whose name, as reported before it
+// is sanitized, matches keep and does not match drop. A nil keep keeps every
+// metric and a nil drop drops none. Filtered metrics are skipped without
+// being rejected.
+func WithNameFilter(keep, drop *regexp.Regexp) ProcessorOption {
+	return func(p *Processor) {
+		p.keep, p.drop = keep, drop
+	}
+}
+
+// filtered returns whether the metric with the given name is left out by
+// the name filter.
+func (p *Processor) filtered(name string) bool {
+	if p.keep != nil && !p.keep.MatchString(name) {
+		return true
+	}
+
+	return p.drop != nil && p.drop.MatchString(name)
+}
+
+// WithFormat sets the format the metrics command output is parsed as.
+// Defaults to FormatJSON.
+func WithFormat(f Format) ProcessorOption {
+	return func(p *Processor) {
+		p.format = f
+	}
+}
+
+// NewProcessor returns a Processor that records the metrics e reports in s.
+func NewProcessor(l Logger, s Sink, e Executor, opts ...ProcessorOption) Processor {
+	p := Processor{
+		logger:        l,
+		sink:          s,
+		executor:      e,
+		format:        FormatJSON,
+		signatures:    NewSignatures(),
+		counterTotals: make(map[string]float64),
+		bucketTotals:  make(map[string][]float64),
+		gauges:        make(map[string]*trackedGauge),
+		rejectionLogs: make(map[string]*rejectionLog),
+	}
+
+	for _, o := range opts {
+		o(&p)
+	}
+
+	return p
 }
 
-type metricsRegistry interface {
-	NewCounter(name, helpText string, opts ...metrics.MetricOption) metrics.Counter
-	NewGauge(name, helpText string, opts ...metrics.MetricOption) metrics.Gauge
+// Process runs the metrics command once and records its output. The command
+// is killed when ctx is canceled, in which case the context error is
+// returned. Other errors from the Executor are returned as is, while output
+// that cannot be parsed is logged and returned wrapping ErrParseFailed.
+//
+// With FormatNDJSON and a StreamingExecutor, the output is recorded line by
+// line while the command is running, so lines read before the command fails
+// are recorded regardless.
+func (p *Processor) Process(ctx context.Context, cmdPath string, args ...string) error {
+	cmd := exec.CommandContext(ctx, cmdPath, args...)
+	p.parsed, p.dropped = make(map[string]int), 0
+
+	if s, ok := p.executor.(StreamingExecutor); ok && p.format == FormatNDJSON {
+		return p.stream(ctx, s, cmd)
+	}
+
+	return p.ProcessFetched(ctx, func() ([]byte, error) {
+		return p.executor.Run(cmd)
+	})
 }
 
-func NewProcessor(l Logger, m metricsRegistry, e Executor) Processor {
-	return Processor{
-		logger:   l,
-		metrics:  m,
-		executor: e,
+// ProcessFetched records the output returned by fetch, such as the body of
+// an HTTP response, like Process records the output of the metrics command.
+// fetch should fail with the same errors as an Executor. If ctx is canceled
+// the context error is returned.
+func (p *Processor) ProcessFetched(ctx context.Context, fetch func() ([]byte, error)) error {
+	p.parsed, p.dropped = make(map[string]int), 0
+
+	start := time.Now()
+	out, err := fetch()
+	duration := time.Since(start)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err == nil {
+		err = p.record(out)
 	}
+
+	p.instruments.observe(duration, len(out), err, p.parsed, p.dropped)
+
+	return err
 }
 
-func (p *Processor) Process(cmdPath string, args ...string) {
-	out, err := p.executor.Run(exec.Command(cmdPath, args...))
+// ProcessBatch records a batch of metrics written by a long-running metrics
+// command, which is parsed and recorded like the output of a run of Process.
+// Output that cannot be parsed is logged and returned wrapping
+// ErrParseFailed.
+func (p *Processor) ProcessBatch(batch []byte) error {
+	p.parsed, p.dropped = make(map[string]int), 0
+
+	err := p.record(batch)
+	p.instruments.observeResult(len(batch), err, p.parsed, p.dropped)
+
+	return err
+}
+
+// record parses the output of a successful run and records its metrics.
+func (p *Processor) record(out []byte) error {
+	var err error
+	switch p.format.detect(out) {
+	case FormatPrometheus:
+		err = p.processExposition(out)
+	case FormatNDJSON:
+		err = p.processNDJSON(bytes.NewReader(out))
+	default:
+		err = p.processJSON(out)
+	}
+
 	if err != nil {
-		return
+		return p.parseFailed(err, out)
+	}
+
+	p.removeStaleGauges()
+
+	return nil
+}
+
+func (p *Processor) parseFailed(err error, out []byte) error {
+	data := lager.Data{"event": "failed"}
+	if out != nil {
+		data["output"] = string(out)
 	}
 
+	p.logger.Error("parsing-metrics-output", err, data)
+
+	return fmt.Errorf("%w: %w", ErrParseFailed, err)
+}
+
+func (p *Processor) processJSON(out []byte) error {
 	var parsedMetrics []map[string]interface{}
-	err = json.NewDecoder(bytes.NewReader(out)).Decode(&parsedMetrics)
+	err := json.NewDecoder(bytes.NewReader(out)).Decode(&parsedMetrics)
 	if err != nil {
-		p.logger.Error("parsing-metrics-output", err, lager.Data{
-			"event":  "failed",
-			"output": string(out),
-		})
-		os.Exit(1)
+		return err
 	}
 
 	for _, metric := range parsedMetrics {
-		if isGauge(metric) {
-			p.recordGauge(metric)
-			continue
-		}
+		p.recordEntry(metric)
+	}
 
-		if isCounter(metric) {
-			p.recordCounter(metric)
-		}
+	return nil
+}
+
+// recordEntry records a single entry of JSON or NDJSON output, or rejects it
+// if it is invalid.
+func (p *Processor) recordEntry(metric map[string]interface{}) {
+	kind, r := classify(metric)
+	if r != nil {
+		p.reject(metric, r)
+		return
 	}
+
+	if p.filtered(metric[kind.nameKey].(string)) {
+		return
+	}
+
+	p.parsed[kind.name]++
+	kind.record(p, metric)
 }
 
 func (p *Processor) recordGauge(metric map[string]interface{}) {
-	sanitizeName, modified := sanitizeName(metric["key"].(string))
-	if modified {
-		p.metrics.NewCounter("modified_metric_name", "").Add(1.0)
+	labels := labelsOf(metric)
+	labels["unit"] = metric["unit"].(string)
+
+	name, labels, ok := p.sanitize(metric["key"].(string), labels)
+	if !ok {
+		return
 	}
 
-	p.metrics.NewGauge(
-		sanitizeName,
-		"",
-		metrics.WithMetricLabels(
-			map[string]string{"unit": metric["unit"].(string)},
-		),
-	).Set(metric["value"].(float64))
+	// Relabeling drops empty labels, but every gauge carries its unit.
+	if _, ok := labels["unit"]; !ok {
+		labels["unit"] = ""
+	}
+
+	p.setGauge(name, "", labels, metric["value"].(float64))
 }
 
 func (p *Processor) recordCounter(metric map[string]interface{}) {
-	sanitizeName, modified := sanitizeName(metric["name"].(string))
+	name, labels, ok := p.sanitize(metric["name"].(string), labelsOf(metric))
+	if !ok {
+		return
+	}
+
+	p.addCounter(name, "", labels, metric["delta"].(float64))
+}
+
+// sanitize replaces invalid characters in the metric and label names and
+// prefixes the ones starting with a digit, counting every entry that had to
+// be renamed, and applies the relabel rules. It returns false if a rule dropped the series, or if the resulting
+// series has one of the reserved labels, such as "le" for a histogram, which
+// the Sink sets itself.
+func (p *Processor) sanitize(name string, labels map[string]string, reserved ...string) (string, map[string]string, bool) {
+	sanitizedName, modified := sanitizeName(name)
+	if modified {
+		p.report.rename("metric", name, sanitizedName)
+	}
+
+	sanitizedLabels := make(map[string]string, len(labels)+len(p.labels))
+	for k, v := range labels {
+		sanitizedKey, labelModified := sanitizeLabelName(k)
+		if labelModified {
+			p.report.rename("label", k, sanitizedKey)
+		}
+		modified = modified || labelModified
+		sanitizedLabels[sanitizedKey] = v
+	}
+
+	for k, v := range p.labels {
+		if _, ok := sanitizedLabels[k]; !ok {
+			sanitizedLabels[k] = v
+		}
+	}
+
 	if modified {
-		p.metrics.NewCounter("modified_metric_name", "").Add(1.0)
+		p.sink.AddCounter(Series{
+			Name: ReservedPrefix + "modified_metric_names",
+			Help: "Number of entries whose metric or label names were sanitized.",
+		}, 1.0)
 	}
 
-	p.metrics.NewCounter(
-		sanitizeName,
-		"",
-	).Add(metric["delta"].(float64))
+	name, sanitizedLabels, ok := p.relabel(sanitizedName, sanitizedLabels)
+	if !ok {
+		return "", nil, false
+	}
+
+	for _, r := range reserved {
+		if _, ok := sanitizedLabels[r]; ok {
+			p.logger.Info("recording-metric", lager.Data{
+				"event":  "skipped",
+				"name":   name,
+				"reason": "reserved label " + r,
+			})
+			p.report.reject(RejectedEntry{Reason: "reserved_label", Name: name})
+			return "", nil, false
+		}
+	}
+
+	return name, sanitizedLabels, true
 }
 
-func isGauge(m map[string]interface{}) bool {
-	if !hasStringKey(m, "key") {
-		return false
+func (p *Processor) setGauge(name, help string, labels map[string]string, value float64) {
+	if !p.canRecord("gauge", name, help, labels) {
+		return
+	}
+	p.report.accept("gauge", name, labels)
+
+	p.trackGauge(name, help, labels, value)
+}
+
+func (p *Processor) addCounter(name, help string, labels map[string]string, delta float64) {
+	if !p.canRecord("counter", name, help, labels) {
+		return
 	}
+	p.report.accept("counter", name, labels)
 
-	if !hasFloat64Key(m, "value") {
+	p.sink.AddCounter(Series{Name: name, Help: help, Labels: labels}, delta)
+}
+
+// canRecord reports whether the series may be recorded. Names with the
+// ReservedPrefix are rejected, as are series whose kind, label names or help
+// text differ from an earlier series with the same name, which the
+// Prometheus endpoint cannot export together, and series a Sink that is a
+// SeriesChecker cannot record.
+func (p *Processor) canRecord(kind, name, help string, labels map[string]string) bool {
+	if strings.HasPrefix(name, ReservedPrefix) {
+		p.logger.Info("recording-metric", lager.Data{
+			"event":  "skipped",
+			"name":   name,
+			"reason": "reserved prefix " + ReservedPrefix,
+		})
+		p.report.reject(RejectedEntry{Reason: "reserved_prefix", Name: name})
 		return false
 	}
 
-	if !hasStringKey(m, "unit") {
+	signature := kind + labelNamesOf(labels) + " " + help
+
+	registered, ok := p.signatures.register(name, signature)
+	if !ok {
+		p.logger.Info("recording-metric", lager.Data{
+			"event":              "skipped",
+			"name":               name,
+			"signature":          signature,
+			"expected_signature": registered,
+		})
+		p.report.reject(RejectedEntry{Reason: "inconsistent_signature", Name: name})
 		return false
 	}
 
+	if c, ok := p.sink.(SeriesChecker); ok {
+		if err := c.CheckSeries(kind, Series{Name: name, Help: help, Labels: labels}); err != nil {
+			p.logger.Info("recording-metric", lager.Data{
+				"event": "skipped",
+				"name":  name,
+				"error": err.Error(),
+			})
+			p.report.reject(RejectedEntry{Reason: "unregistrable", Name: name})
+			return false
+		}
+	}
+
 	return true
 }
 
-func isCounter(m map[string]interface{}) bool {
-	if !hasStringKey(m, "name") {
-		return false
+func validateGauge(m map[string]interface{}) *rejection {
+	if r := requireName(m, "key"); r != nil {
+		return r
 	}
 
-	if !hasFloat64Key(m, "delta") {
-		return false
+	if r := requireFloat64(m, "value"); r != nil {
+		return r
+	}
+
+	if r := requireString(m, "unit"); r != nil {
+		return r
+	}
+
+	return validateLabels(m, "unit")
+}
+
+func validateCounter(m map[string]interface{}) *rejection {
+	if r := requireName(m, "name"); r != nil {
+		return r
+	}
+
+	if r := requireFloat64(m, "delta"); r != nil {
+		return r
 	}
 
 	if m["delta"].(float64) < 0 {
-		return false
+		return &rejection{reason: reasonNegativeDelta, key: "delta"}
 	}
 
-	return true
+	return validateLabels(m)
 }
 
-func hasStringKey(m map[string]interface{}, key string) bool {
+// validateLabels checks that the optional "labels" entry is an object of
+// string values whose sanitized names are usable as Prometheus labels and do
+// not collide with each other or with any of the reserved names.
+func validateLabels(m map[string]interface{}, reserved ...string) *rejection {
+	v, ok := m["labels"]
+	if !ok {
+		return nil
+	}
+
+	labels, ok := v.(map[string]interface{})
+	if !ok {
+		return &rejection{reason: reasonWrongType, key: "labels"}
+	}
+
+	seen := make(map[string]bool, len(labels)+len(reserved))
+	for _, r := range reserved {
+		seen[r] = true
+	}
+
+	for name, value := range labels {
+		if _, ok := value.(string); !ok {
+			return &rejection{reason: reasonWrongType, key: "labels." + name}
+		}
+
+		sanitized, _ := sanitizeLabelName(name)
+		if sanitized == "" || strings.HasPrefix(sanitized, "__") || seen[sanitized] {
+			return &rejection{reason: reasonInvalidLabel, key: "labels." + name}
+		}
+		seen[sanitized] = true
+	}
+
+	return nil
+}
+
+// requireName requires a non-empty string value for key.
+func requireName(m map[string]interface{}, key string) *rejection {
+	if r := requireString(m, key); r != nil {
+		return r
+	}
+
+	if m[key].(string) == "" {
+		return &rejection{reason: reasonEmptyName, key: key}
+	}
+
+	return nil
+}
+
+func requireString(m map[string]interface{}, key string) *rejection {
 	v, ok := m[key]
 	if !ok {
-		return false
+		return &rejection{reason: reasonMissingKey, key: key}
 	}
 
 	if _, ok = v.(string); !ok {
-		return false
+		return &rejection{reason: reasonWrongType, key: key}
 	}
 
-	return true
+	return nil
 }
 
-func hasFloat64Key(m map[string]interface{}, key string) bool {
+func requireFloat64(m map[string]interface{}, key string) *rejection {
 	v, ok := m[key]
 	if !ok {
-		return false
+		return &rejection{reason: reasonMissingKey, key: key}
 	}
 
 	if _, ok = v.(float64); !ok {
-		return false
+		return &rejection{reason: reasonWrongType, key: key}
 	}
 
-	return true
+	return nil
 }
 
+// labelsOf returns the optional labels of an entry that has already been
+// checked by validateLabels.
+func labelsOf(m map[string]interface{}) map[string]string {
+	labels := make(map[string]string)
+	raw, _ := m["labels"].(map[string]interface{})
+
+	for name, value := range raw {
+		labels[name] = value.(string)
+	}
+
+	return labels
+}
+
+// labelNamesOf returns the sorted label names, formatted as {a,b}.
+func labelNamesOf(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return "{" + strings.Join(names, ",") + "}"
+}
+
+// seriesKey identifies a single series by name and label values.
+func seriesKey(name string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	key := name
+	for _, k := range names {
+		key += fmt.Sprintf(",%s=%q", k, labels[k])
+	}
+
+	return key
+}
+
+// sanitizeLabelName replaces the characters that are invalid in a label
+// name with "_" and prefixes a name starting with a digit with "_", which
+// Prometheus would otherwise only accept quoted.
+func sanitizeLabelName(name string) (string, bool) {
+	sanitized := withoutLeadingDigit(invalidLabelNameRegex.ReplaceAllString(name, "_"))
+	return sanitized, sanitized != name
+}
+
+// sanitizeName is sanitizeLabelName for metric names, which may also
+// contain colons.
 func sanitizeName(name string) (string, bool) {
-	sanitized := invalidNameRegex.ReplaceAllString(name, "_")
+	sanitized := withoutLeadingDigit(invalidNameRegex.ReplaceAllString(name, "_"))
 	return sanitized, sanitized != name
 }
+
+func withoutLeadingDigit(name string) string {
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		return "_" + name
+	}
+
+	return name
+}
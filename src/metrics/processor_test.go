@@ -1,8 +1,10 @@
 package metrics_test
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
+	"regexp"
 	"strings"
 
 	"code.cloudfoundry.org/go-metric-registry/testhelpers"
@@ -22,11 +24,11 @@ var _ = Describe("Processor", func() {
 		m := testhelpers.NewMetricsRegistry()
 		p := metrics.NewProcessor(
 			&spyLogger{},
-			m,
+			metrics.NewRegistrySink(m),
 			spyExecutor,
 		)
 
-		p.Process("/bin/echo", "my", "command")
+		p.Process(context.Background(), "/bin/echo", "my", "command")
 
 		Expect(spyExecutor.cmd.Args).To(Equal([]string{"/bin/echo", "my", "command"}))
 
@@ -51,14 +53,14 @@ var _ = Describe("Processor", func() {
 		m := testhelpers.NewMetricsRegistry()
 		p := metrics.NewProcessor(
 			&spyLogger{},
-			m,
+			metrics.NewRegistrySink(m),
 			spyExecutor,
 		)
 
-		p.Process("/bin/echo", "my", "command")
+		p.Process(context.Background(), "/bin/echo", "my", "command")
 		Expect(spyExecutor.cmd.Args).To(Equal([]string{"/bin/echo", "my", "command"}))
 
-		Expect(m.Metrics).To(HaveLen(0))
+		Expect(recordedMetrics(m)).To(BeEmpty())
 	})
 
 	It("sends counter metrics to the egress client", func() {
@@ -70,11 +72,11 @@ var _ = Describe("Processor", func() {
 		m := testhelpers.NewMetricsRegistry()
 		p := metrics.NewProcessor(
 			&spyLogger{},
-			m,
+			metrics.NewRegistrySink(m),
 			spyExecutor,
 		)
 
-		p.Process("/bin/echo", "my", "command")
+		p.Process(context.Background(), "/bin/echo", "my", "command")
 
 		Expect(m.GetMetricValue("my_name", nil)).To(Equal(1.0))
 		Expect(m.GetMetricValue("my_other_name", nil)).To(Equal(14.0))
@@ -94,14 +96,14 @@ var _ = Describe("Processor", func() {
 		m := testhelpers.NewMetricsRegistry()
 		p := metrics.NewProcessor(
 			&spyLogger{},
-			m,
+			metrics.NewRegistrySink(m),
 			spyExecutor,
 		)
 
-		p.Process("/bin/echo", "my", "command")
+		p.Process(context.Background(), "/bin/echo", "my", "command")
 		Expect(spyExecutor.cmd.Args).To(Equal([]string{"/bin/echo", "my", "command"}))
 
-		Expect(m.Metrics).To(HaveLen(0))
+		Expect(recordedMetrics(m)).To(BeEmpty())
 	})
 
 	It("ignores counters with negative values", func() {
@@ -112,14 +114,14 @@ var _ = Describe("Processor", func() {
 		m := testhelpers.NewMetricsRegistry()
 		p := metrics.NewProcessor(
 			&spyLogger{},
-			m,
+			metrics.NewRegistrySink(m),
 			spyExecutor,
 		)
 
-		p.Process("/bin/echo", "my", "command")
+		p.Process(context.Background(), "/bin/echo", "my", "command")
 		Expect(spyExecutor.cmd.Args).To(Equal([]string{"/bin/echo", "my", "command"}))
 
-		Expect(m.Metrics).To(HaveLen(0))
+		Expect(recordedMetrics(m)).To(BeEmpty())
 	})
 
 	It("converts names with invalid characters", func() {
@@ -131,11 +133,11 @@ var _ = Describe("Processor", func() {
 		m := testhelpers.NewMetricsRegistry()
 		p := metrics.NewProcessor(
 			&spyLogger{},
-			m,
+			metrics.NewRegistrySink(m),
 			spyExecutor,
 		)
 
-		p.Process("/bin/echo", "my", "command")
+		p.Process(context.Background(), "/bin/echo", "my", "command")
 
 		Expect(spyExecutor.cmd.Args).To(Equal([]string{"/bin/echo", "my", "command"}))
 
@@ -147,6 +149,348 @@ var _ = Describe("Processor", func() {
 			return m.GetMetricValue("counter_also_wrong", nil)
 		}).Should(Equal(1.0))
 	})
+
+	It("prefixes metric and label names starting with a digit", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"key": "1abc", "value": 21.4, "unit": "things", "labels": {"2xx": "one"}},
+			{"name": "3-requests", "delta": 1}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("_1abc", map[string]string{"unit": "things", "_2xx": "one"})).To(Equal(21.4))
+		Expect(m.GetMetricValue("_3_requests", nil)).To(Equal(1.0))
+		Expect(m.GetMetricValue("service_metrics_modified_metric_names", nil)).To(Equal(2.0))
+	})
+
+	It("attaches labels to gauges and counters", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"key": "my-key", "value": 21.4, "unit": "things", "labels": {"db": "one"}},
+			{"key": "my-key", "value": 39.9, "unit": "things", "labels": {"db": "two"}},
+			{"name": "my-name", "delta": 3, "labels": {"node": "a"}}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things", "db": "one"})).To(Equal(21.4))
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things", "db": "two"})).To(Equal(39.9))
+		Expect(m.GetMetricValue("my_name", map[string]string{"node": "a"})).To(Equal(3.0))
+	})
+
+	It("converts label names with invalid characters", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"key": "my-key", "value": 21.4, "unit": "things", "labels": {"db.name": "one"}}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things", "db_name": "one"})).To(Equal(21.4))
+		Expect(m.GetMetricValue("service_metrics_modified_metric_names", nil)).To(Equal(1.0))
+	})
+
+	It("doesn't emit metrics with invalid labels", func() {
+		invalidMetrics := []string{
+			`{"key": "my-key", "value": 21.4, "unit": "things", "labels": "db"}`,                     // Labels not an object
+			`{"key": "my-key", "value": 21.4, "unit": "things", "labels": {"db": 1}}`,                // Label value not a string
+			`{"key": "my-key", "value": 21.4, "unit": "things", "labels": {"unit": "other"}}`,        // Label overrides unit
+			`{"key": "my-key", "value": 21.4, "unit": "things", "labels": {"__name__": "x"}}`,        // Reserved label name
+			`{"key": "my-key", "value": 21.4, "unit": "things", "labels": {"a.b": "x", "a_b": "y"}}`, // Colliding label names
+			`{"name": "my-name", "delta": 1, "labels": ["db"]}`,                                      // Labels not an object
+		}
+		out := fmt.Sprintf("[%s]", strings.Join(invalidMetrics, ","))
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			newSpyExecutor([]byte(out), nil),
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(recordedMetrics(m)).To(BeEmpty())
+	})
+
+	It("skips metrics whose label names differ from the first registration", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"key": "my-key", "value": 21.4, "unit": "things", "labels": {"db": "one"}},
+			{"key": "my-key", "value": 39.9, "unit": "things", "labels": {"node": "two"}}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things", "db": "one"})).To(Equal(21.4))
+		Expect(m.HasMetric("my_key", map[string]string{"unit": "things", "node": "two"})).To(BeFalse())
+	})
+
+	It("sends histogram observations to the egress client", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"histogram": "my-latency", "buckets": [0.1, 0.5, 1], "observations": [0.2, 0.3], "labels": {"db": "one"}}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		h := m.GetMetric("my_latency", map[string]string{"db": "one"})
+		Expect(h.Buckets()).To(Equal([]float64{0.1, 0.5, 1}))
+		Expect(h.Value()).To(BeNumerically("~", 0.5))
+	})
+
+	It("records pre-aggregated histogram bucket counts with their sum", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"histogram": "my-latency", "buckets": [0.1, 0.5], "bucket_counts": [1, 2, 0], "sum": 1.1}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("my_latency", nil)).To(BeNumerically("~", 1.1))
+	})
+
+	It("doesn't emit histograms when the output isn't a histogram", func() {
+		invalidMetrics := []string{
+			`{"histogram": "h", "buckets": [], "observations": [1]}`,                               // No buckets
+			`{"histogram": "h", "buckets": [1, 0.5], "observations": [1]}`,                         // Unsorted buckets
+			`{"histogram": "h", "buckets": [1, 1], "observations": [1]}`,                           // Duplicate buckets
+			`{"histogram": "h", "buckets": [1]}`,                                                   // No observations or counts
+			`{"histogram": "h", "buckets": [1], "observations": [1], "bucket_counts": [1, 0]}`,     // Both observations and counts
+			`{"histogram": "h", "buckets": [1], "observations": ["1"]}`,                            // Invalid observation
+			`{"histogram": "h", "buckets": [1], "bucket_counts": [1]}`,                             // Missing overflow count
+			`{"histogram": "h", "buckets": [1], "bucket_counts": [1, -1]}`,                         // Negative count
+			`{"histogram": "h", "buckets": [1], "bucket_counts": [1, 0.5], "sum": 1}`,              // Fractional count
+			`{"histogram": "h", "buckets": [1], "bucket_counts": [1, 9007199254740994], "sum": 1}`, // Count above 2^53
+			`{"histogram": "h", "buckets": [1], "bucket_counts": [1, 0]}`,                          // Missing sum
+			`{"histogram": "h", "buckets": [1], "bucket_counts": [1, 0], "sum": "1"}`,              // Invalid sum
+			`{"histogram": "h", "buckets": [1], "observations": [1], "labels": {"le": "1"}}`,       // Reserved label
+		}
+		out := fmt.Sprintf("[%s]", strings.Join(invalidMetrics, ","))
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			newSpyExecutor([]byte(out), nil),
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(recordedMetrics(m)).To(BeEmpty())
+	})
+
+	It("sends summaries to the egress client as gauges", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"summary": "my-latency", "quantiles": {"0.5": 0.2, "0.99": 0.9}, "sum": 12.5, "count": 40, "labels": {"db": "one"}}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("my_latency", map[string]string{"db": "one", "quantile": "0.5"})).To(Equal(0.2))
+		Expect(m.GetMetricValue("my_latency", map[string]string{"db": "one", "quantile": "0.99"})).To(Equal(0.9))
+		Expect(m.GetMetricValue("my_latency_sum", map[string]string{"db": "one"})).To(Equal(12.5))
+		Expect(m.GetMetricValue("my_latency_count", map[string]string{"db": "one"})).To(Equal(40.0))
+	})
+
+	It("doesn't emit summaries when the output isn't a summary", func() {
+		invalidMetrics := []string{
+			`{"summary": "s", "quantiles": {"1.5": 1}, "sum": 1, "count": 1}`,                              // Quantile out of range
+			`{"summary": "s", "quantiles": {"p50": 1}, "sum": 1, "count": 1}`,                              // Quantile not a number
+			`{"summary": "s", "quantiles": {"0.5": "1"}, "sum": 1, "count": 1}`,                            // Invalid quantile value
+			`{"summary": "s", "quantiles": {"0.5": 1}, "count": 1}`,                                        // Missing sum
+			`{"summary": "s", "quantiles": {"0.5": 1}, "sum": 1, "count": -1}`,                             // Negative count
+			`{"summary": "s", "quantiles": {"0.5": 1}, "sum": 1, "count": 1, "labels": {"quantile": "x"}}`, // Reserved label
+		}
+		out := fmt.Sprintf("[%s]", strings.Join(invalidMetrics, ","))
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			newSpyExecutor([]byte(out), nil),
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(recordedMetrics(m)).To(BeEmpty())
+	})
+
+	It("skips metrics whose type differs from the first registration", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"key": "my-metric", "value": 21.4, "unit": "things"},
+			{"histogram": "my-metric", "buckets": [1], "observations": [0.5], "labels": {"unit": "things"}}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("my_metric", map[string]string{"unit": "things"})).To(Equal(21.4))
+	})
+
+	It("returns errors from the executor", func() {
+		executorErr := fmt.Errorf("%w: exit status 10", metrics.ErrNotReady)
+		spyExecutor := newSpyExecutor(nil, executorErr)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+		)
+
+		err := p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(err).To(MatchError(metrics.ErrNotReady))
+		Expect(m.Metrics).To(HaveLen(0))
+	})
+
+	It("returns a parse error when the output isn't valid", func() {
+		logger := &spyLogger{}
+		p := metrics.NewProcessor(
+			logger,
+			metrics.NewRegistrySink(testhelpers.NewMetricsRegistry()),
+			newSpyExecutor([]byte(`not json`), nil),
+		)
+
+		err := p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(err).To(MatchError(metrics.ErrParseFailed))
+		Expect(logger.errAction).To(Equal("parsing-metrics-output"))
+		Expect(logger.errData[0]["output"]).To(Equal("not json"))
+	})
+
+	It("adds the configured labels to every metric", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"key": "my-key", "value": 21.4, "unit": "things"},
+			{"name": "my-name", "delta": 1, "labels": {"collector": "own"}}
+		]`), nil)
+
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithLabels(map[string]string{"collector": "health"}),
+		)
+
+		p.Process(context.Background(), "/bin/echo", "my", "command")
+
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things", "collector": "health"})).To(Equal(21.4))
+		Expect(m.GetMetricValue("my_name", map[string]string{"collector": "own"})).To(Equal(1.0))
+	})
+
+	It("shares registered signatures between processors", func() {
+		m := testhelpers.NewMetricsRegistry()
+		signatures := metrics.NewSignatures()
+
+		first := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			newSpyExecutor([]byte(`[{"key": "my-key", "value": 1, "unit": "things"}]`), nil),
+			metrics.WithSignatures(signatures),
+		)
+		second := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			newSpyExecutor([]byte(`[{"key": "my-key", "value": 2, "unit": "things", "labels": {"db": "one"}}]`), nil),
+			metrics.WithSignatures(signatures),
+		)
+
+		first.Process(context.Background(), "/bin/echo")
+		second.Process(context.Background(), "/bin/echo")
+
+		Expect(m.GetMetricValue("my_key", map[string]string{"unit": "things"})).To(Equal(1.0))
+		Expect(m.HasMetric("my_key", map[string]string{"unit": "things", "db": "one"})).To(BeFalse())
+	})
+
+	It("only records metrics whose name passes the name filter", func() {
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			newSpyExecutor([]byte(`[
+				{"key": "pg.up", "value": 1, "unit": "things"},
+				{"key": "pg.debug", "value": 1, "unit": "things"},
+				{"name": "other", "delta": 1}
+			]`), nil),
+			metrics.WithNameFilter(regexp.MustCompile(`^pg\..*$`), regexp.MustCompile(`^.*debug$`)),
+		)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(m.GetMetricValue("pg_up", map[string]string{"unit": "things"})).To(Equal(1.0))
+		Expect(m.HasMetric("pg_debug", map[string]string{"unit": "things"})).To(BeFalse())
+		Expect(m.HasMetric("other", nil)).To(BeFalse())
+	})
+
+	It("records fetched output like the output of the metrics command", func() {
+		m := testhelpers.NewMetricsRegistry()
+		p := metrics.NewProcessor(&spyLogger{}, metrics.NewRegistrySink(m), nil, metrics.WithInstrumentation("fetched"))
+
+		err := p.ProcessFetched(context.Background(), func() ([]byte, error) {
+			return []byte(`[{"name": "my-counter", "delta": 3}]`), nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = p.ProcessFetched(context.Background(), func() ([]byte, error) {
+			return nil, metrics.ErrTimedOut
+		})
+		Expect(err).To(MatchError(metrics.ErrTimedOut))
+
+		Expect(m.GetMetricValue("my_counter", nil)).To(Equal(3.0))
+		Expect(m.GetMetricValue("service_metrics_runs", map[string]string{"collector": "fetched", "result": "timeout"})).To(Equal(1.0))
+	})
 })
 
 type spyExecutor struct {
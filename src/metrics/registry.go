@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+
+	metrics "code.cloudfoundry.org/go-metric-registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// PrometheusRegistry is a Registry that keeps its instruments in a Prometheus
+// registry, like the egress registry, but whose histograms can also record
+// pre-aggregated bucket counts. It serves its metrics through Handler and
+// gathers them in-process through Gather.
+//
+// Unlike the egress registry, it does not panic on a series it cannot
+// register, e.g. because its name is registered with other label names. The
+// instrument it returns for such a series is not exported, and CheckSeries
+// reports why.
+type PrometheusRegistry struct {
+	registry *prometheus.Registry
+
+	// mu serializes registrations, so that CheckSeries can register a series
+	// and unregister it again without another caller getting hold of it.
+	mu sync.Mutex
+}
+
+// NewPrometheusRegistry returns an empty PrometheusRegistry.
+func NewPrometheusRegistry() *PrometheusRegistry {
+	return &PrometheusRegistry{registry: prometheus.NewRegistry()}
+}
+
+// NewCounter returns the counter, which is created if it is not registered
+// yet.
+func (r *PrometheusRegistry) NewCounter(name, helpText string, opts ...metrics.MetricOption) metrics.Counter {
+	c, _ := r.register(newCounter(name, helpText, opts))
+	return c.(metrics.Counter)
+}
+
+// NewGauge returns the gauge, which is created if it is not registered yet.
+func (r *PrometheusRegistry) NewGauge(name, helpText string, opts ...metrics.MetricOption) metrics.Gauge {
+	g, _ := r.register(newGauge(name, helpText, opts))
+	return g.(metrics.Gauge)
+}
+
+// NewHistogram returns the histogram, which is created with buckets if it is
+// not registered yet.
+func (r *PrometheusRegistry) NewHistogram(name, helpText string, buckets []float64, opts ...metrics.MetricOption) metrics.Histogram {
+	h, _ := r.register(newHistogram(name, helpText, buckets, opts))
+	return h.(metrics.Histogram)
+}
+
+// RemoveGauge stops exporting the gauge.
+func (r *PrometheusRegistry) RemoveGauge(g metrics.Gauge) {
+	r.registry.Unregister(g.(prometheus.Collector))
+}
+
+// CheckSeries returns the error registering the series of the kind, "gauge",
+// "counter" or "histogram", fails with, without registering it.
+func (r *PrometheusRegistry) CheckSeries(kind string, s Series) error {
+	opts := []metrics.MetricOption{metrics.WithMetricLabels(s.Labels)}
+
+	var c prometheus.Collector
+	switch kind {
+	case "gauge":
+		c = newGauge(s.Name, s.Help, opts)
+	case "counter":
+		c = newCounter(s.Name, s.Help, opts)
+	case "histogram":
+		c = newHistogram(s.Name, s.Help, nil, opts)
+	default:
+		return fmt.Errorf("unable to register metric: unknown kind %q", kind)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	registered, err := r.registerLocked(c)
+	if err == nil && registered == c {
+		r.registry.Unregister(c)
+	}
+
+	return err
+}
+
+// Gather implements prometheus.Gatherer.
+func (r *PrometheusRegistry) Gather() ([]*dto.MetricFamily, error) {
+	return r.registry.Gather()
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (r *PrometheusRegistry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{Registry: r.registry})
+}
+
+// register registers c, or returns the collector of the same type already
+// registered for the same series. If c cannot be registered, it is returned
+// unregistered along with the reason, so that what is recorded in it is not
+// exported.
+func (r *PrometheusRegistry) register(c prometheus.Collector) (prometheus.Collector, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.registerLocked(c)
+}
+
+func (r *PrometheusRegistry) registerLocked(c prometheus.Collector) (prometheus.Collector, error) {
+	err := r.registry.Register(c)
+	if err == nil {
+		return c, nil
+	}
+
+	registered, ok := err.(prometheus.AlreadyRegisteredError)
+	if !ok {
+		return c, fmt.Errorf("unable to register metric: %w", err)
+	}
+
+	if reflect.TypeOf(registered.ExistingCollector) != reflect.TypeOf(c) {
+		return c, errors.New("unable to register metric: a metric of another type is registered with the same name and labels")
+	}
+
+	return registered.ExistingCollector, nil
+}
+
+func newCounter(name, helpText string, opts []metrics.MetricOption) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts(promOpts(name, helpText, opts)))
+}
+
+func newGauge(name, helpText string, opts []metrics.MetricOption) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts(promOpts(name, helpText, opts)))
+}
+
+func newHistogram(name, helpText string, buckets []float64, opts []metrics.MetricOption) *histogram {
+	o := promOpts(name, helpText, opts)
+
+	return &histogram{
+		desc:   prometheus.NewDesc(name, helpText, nil, o.ConstLabels),
+		bounds: buckets,
+		counts: make([]uint64, len(buckets)+1),
+	}
+}
+
+func promOpts(name, helpText string, opts []metrics.MetricOption) prometheus.Opts {
+	o := prometheus.Opts{
+		Name:        name,
+		Help:        helpText,
+		ConstLabels: make(map[string]string),
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// histogram is a Prometheus histogram that can also add pre-aggregated
+// bucket counts.
+type histogram struct {
+	desc   *prometheus.Desc
+	bounds []float64
+
+	mu sync.Mutex
+	// counts holds the non-cumulative count of each bucket plus a final
+	// overflow count.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[sort.SearchFloat64s(h.bounds, value)]++
+	h.count++
+	h.sum += value
+}
+
+// AddCounts adds the observations counted in the buckets, along with their
+// sum. A count is added to the first bucket of h that holds the upper bound
+// of its bucket.
+func (h *histogram) AddCounts(buckets []float64, counts []uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, c := range counts {
+		b := len(h.bounds)
+		if i < len(buckets) {
+			b = sort.SearchFloat64s(h.bounds, buckets[i])
+		}
+
+		h.counts[b] += c
+		h.count += c
+	}
+	h.sum += sum
+}
+
+func (h *histogram) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *histogram) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cumulative := make(map[float64]uint64, len(h.bounds))
+	var total uint64
+	for i, bound := range h.bounds {
+		total += h.counts[i]
+		cumulative[bound] = total
+	}
+
+	ch <- prometheus.MustNewConstHistogram(h.desc, h.count, h.sum, cumulative)
+}
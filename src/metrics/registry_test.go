@@ -0,0 +1,145 @@
+package metrics_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"time"
+
+	egress "code.cloudfoundry.org/go-metric-registry"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PrometheusRegistry", func() {
+	var r *metrics.PrometheusRegistry
+
+	BeforeEach(func() {
+		r = metrics.NewPrometheusRegistry()
+	})
+
+	family := func(name string) *dto.MetricFamily {
+		families, err := r.Gather()
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, f := range families {
+			if f.GetName() == name {
+				return f
+			}
+		}
+
+		return nil
+	}
+
+	It("returns the registered instrument of a series", func() {
+		labels := egress.WithMetricLabels(map[string]string{"db": "one"})
+		r.NewCounter("requests", "Requests.", labels).Add(1)
+		r.NewCounter("requests", "Requests.", labels).Add(2)
+		r.NewGauge("size", "Size.", labels).Set(3)
+
+		Expect(family("requests").GetMetric()).To(HaveLen(1))
+		Expect(family("requests").GetMetric()[0].GetCounter().GetValue()).To(Equal(3.0))
+		Expect(family("size").GetMetric()[0].GetGauge().GetValue()).To(Equal(3.0))
+	})
+
+	It("does not export a series it cannot register, and reports why", func() {
+		r.NewCounter("size", "Size.").Add(1)
+
+		Expect(func() { r.NewGauge("size", "Size.").Set(3) }).NotTo(Panic())
+		Expect(func() {
+			r.NewCounter("size", "Size.", egress.WithMetricLabels(map[string]string{"db": "one"})).Add(2)
+		}).NotTo(Panic())
+
+		Expect(family("size").GetMetric()).To(HaveLen(1))
+		Expect(family("size").GetMetric()[0].GetCounter().GetValue()).To(Equal(1.0))
+
+		Expect(r.CheckSeries("counter", metrics.Series{Name: "size", Help: "Size."})).To(Succeed())
+		Expect(r.CheckSeries("gauge", metrics.Series{Name: "size", Help: "Size."})).To(MatchError(ContainSubstring("another type")))
+		Expect(r.CheckSeries("counter", metrics.Series{
+			Name:   "size",
+			Help:   "Size.",
+			Labels: map[string]string{"db": "one"},
+		})).To(MatchError(ContainSubstring("unable to register metric")))
+	})
+
+	It("checks a series without registering it", func() {
+		Expect(r.CheckSeries("histogram", metrics.Series{Name: "latency", Help: "Latency."})).To(Succeed())
+
+		Expect(family("latency")).To(BeNil())
+	})
+
+	It("removes gauges", func() {
+		g := r.NewGauge("size", "Size.")
+		g.Set(3)
+		r.RemoveGauge(g)
+
+		Expect(family("size")).To(BeNil())
+	})
+
+	It("observes histograms", func() {
+		h := r.NewHistogram("latency", "Latency.", []float64{1, 5})
+		h.Observe(0.5)
+		h.Observe(5)
+		h.Observe(10)
+
+		hist := family("latency").GetMetric()[0].GetHistogram()
+		Expect(hist.GetSampleCount()).To(BeEquivalentTo(3))
+		Expect(hist.GetSampleSum()).To(Equal(15.5))
+		Expect(hist.GetBucket()[0].GetCumulativeCount()).To(BeEquivalentTo(1))
+		Expect(hist.GetBucket()[1].GetCumulativeCount()).To(BeEquivalentTo(2))
+	})
+
+	It("adds large pre-aggregated bucket counts at once", func() {
+		sink := metrics.NewRegistrySink(r)
+		series := metrics.Series{Name: "latency", Help: "Latency."}
+
+		start := time.Now()
+		sink.AddHistogramCounts(series, []float64{1, 5}, []uint64{2000000, 0, 4}, 1234.5)
+		sink.AddHistogramCounts(series, []float64{1, 5}, []uint64{1, 2, 0}, 6)
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+		hist := family("latency").GetMetric()[0].GetHistogram()
+		Expect(hist.GetSampleCount()).To(BeEquivalentTo(2000007))
+		Expect(hist.GetSampleSum()).To(Equal(1240.5))
+		Expect(hist.GetBucket()[0].GetCumulativeCount()).To(BeEquivalentTo(2000001))
+		Expect(hist.GetBucket()[1].GetCumulativeCount()).To(BeEquivalentTo(2000003))
+	})
+
+	It("adds counts to the bucket of the registered histogram that holds their bound", func() {
+		sink := metrics.NewRegistrySink(r)
+		series := metrics.Series{Name: "latency", Help: "Latency."}
+		sink.ObserveHistogram(series, []float64{1, 5}, 0.5)
+
+		sink.AddHistogramCounts(series, []float64{0.5, 2, 10}, []uint64{1, 2, 3, 4}, 100)
+
+		hist := family("latency").GetMetric()[0].GetHistogram()
+		Expect(hist.GetSampleCount()).To(BeEquivalentTo(11))
+		Expect(hist.GetBucket()[0].GetCumulativeCount()).To(BeEquivalentTo(2))
+		Expect(hist.GetBucket()[1].GetCumulativeCount()).To(BeEquivalentTo(4))
+	})
+
+	It("serves its metrics in the Prometheus exposition format", func() {
+		r.NewGauge("size", "Size.").Set(3)
+
+		rec := httptest.NewRecorder()
+		r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+		Expect(rec.Body.String()).To(ContainSubstring("# TYPE size gauge\nsize 3\n"))
+	})
+
+	It("records pre-aggregated bucket counts of the JSON output with their sum", func() {
+		p := metrics.NewProcessor(&spyLogger{}, metrics.NewRegistrySink(r), newSpyExecutor([]byte(`[
+			{"histogram": "latency", "buckets": [0.1, 0.5], "bucket_counts": [2000000, 0, 0], "sum": 12345.5}
+		]`), nil))
+
+		start := time.Now()
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+		hist := family("latency").GetMetric()[0].GetHistogram()
+		Expect(hist.GetSampleCount()).To(BeEquivalentTo(2000000))
+		Expect(hist.GetSampleSum()).To(Equal(12345.5))
+	})
+})
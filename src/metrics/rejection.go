@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// Reasons an entry of the metrics command output is rejected for, used as
+// the reason label of the service_metrics_rejected_entries counter.
+const (
+	reasonMissingKey      = "missing_key"
+	reasonWrongType       = "wrong_type"
+	reasonEmptyName       = "empty_name"
+	reasonNegativeDelta   = "negative_delta"
+	reasonNegativeCount   = "negative_count"
+	reasonInvalidLabel    = "invalid_label"
+	reasonInvalidBuckets  = "invalid_buckets"
+	reasonInvalidQuantile = "invalid_quantile"
+	reasonConflictingKeys = "conflicting_keys"
+	reasonMalformedJSON   = "malformed_json"
+	reasonMalformedStatsD = "malformed_statsd"
+)
+
+// rejectionLogInterval is how often a rejection for the same reason is
+// logged at most, so that a metrics command reporting invalid entries on
+// every run does not flood the logs.
+const rejectionLogInterval = 10 * time.Minute
+
+// rejectionLog is when a rejection for a reason was last logged and how many
+// have not been logged since.
+type rejectionLog struct {
+	last       time.Time
+	suppressed int
+}
+
+// rejection describes why an entry is invalid and the key it is invalid for.
+type rejection struct {
+	reason string
+	key    string
+}
+
+type entryKind struct {
+	name     string
+	nameKey  string
+	validate func(map[string]interface{}) *rejection
+	record   func(*Processor, map[string]interface{})
+}
+
+// entryKinds are tried in order, the first kind an entry is valid for is
+// recorded.
+var entryKinds = []entryKind{
+	{"gauge", "key", validateGauge, (*Processor).recordGauge},
+	{"counter", "name", validateCounter, (*Processor).recordCounter},
+	{"histogram", "histogram", validateHistogram, (*Processor).recordHistogram},
+	{"summary", "summary", validateSummary, (*Processor).recordSummary},
+}
+
+// classify returns the kind of a valid entry. An invalid entry is rejected
+// for the reason of the first kind whose name key it has, or as a gauge if
+// it has none of them.
+func classify(m map[string]interface{}) (entryKind, *rejection) {
+	var first *rejection
+	for _, k := range entryKinds {
+		r := k.validate(m)
+		if r == nil {
+			return k, nil
+		}
+
+		if _, ok := m[k.nameKey]; ok && first == nil {
+			first = r
+		}
+	}
+
+	if first == nil {
+		first = entryKinds[0].validate(m)
+	}
+
+	return entryKind{}, first
+}
+
+// reject counts an invalid entry and logs it at debug level, at most once
+// per rejectionLogInterval for the same reason. The log of a rejection
+// carries the number of rejections for the reason that were not logged
+// since the previous one.
+func (p *Processor) reject(m map[string]interface{}, r *rejection) {
+	p.dropped++
+
+	p.sink.AddCounter(Series{
+		Name:   ReservedPrefix + "rejected_entries",
+		Help:   "Number of entries in the metrics command output that were rejected as invalid.",
+		Labels: map[string]string{"reason": r.reason},
+	}, 1)
+
+	name := entryName(m)
+	p.report.reject(RejectedEntry{Reason: r.reason, Key: r.key, Name: name, Entry: m})
+
+	l, ok := p.rejectionLogs[r.reason]
+	if !ok {
+		l = &rejectionLog{}
+		p.rejectionLogs[r.reason] = l
+	}
+
+	if ok && time.Since(l.last) < rejectionLogInterval {
+		l.suppressed++
+		return
+	}
+
+	data := lager.Data{
+		"event":  "rejected",
+		"reason": r.reason,
+		"key":    r.key,
+		"name":   name,
+		"entry":  m,
+	}
+	if l.suppressed > 0 {
+		data["suppressed"] = l.suppressed
+	}
+	p.logger.Debug("recording-metric", data)
+
+	l.last, l.suppressed = time.Now(), 0
+}
+
+// entryName returns the name of an entry for logging, whichever kind it is.
+func entryName(m map[string]interface{}) string {
+	for _, k := range entryKinds {
+		if name, ok := m[k.nameKey].(string); ok {
+			return name
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,111 @@
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processor rejecting entries", func() {
+	var (
+		spyExecutor *spyExecutor
+		logger      *spyLogger
+		m           *testhelpers.SpyMetricsRegistry
+		p           metrics.Processor
+	)
+
+	rejected := func(reason string) float64 {
+		return m.GetMetricValue("service_metrics_rejected_entries", map[string]string{"reason": reason})
+	}
+
+	BeforeEach(func() {
+		spyExecutor = newSpyExecutor(nil, nil)
+		logger = &spyLogger{}
+		m = testhelpers.NewMetricsRegistry()
+		p = metrics.NewProcessor(logger, metrics.NewRegistrySink(m), spyExecutor)
+	})
+
+	It("counts rejected entries by reason", func() {
+		spyExecutor.out = []byte(`[
+			{"value": 1, "unit": "things"},
+			{"key": "my-key", "value": "1", "unit": "things"},
+			{"key": "", "value": 1, "unit": "things"},
+			{"name": "my-counter", "delta": -1},
+			{"name": "other-counter", "delta": -2},
+			{"name": "my-counter", "delta": 1, "labels": {"__name": "x"}},
+			{"histogram": "my-histogram", "buckets": [2, 1], "observations": [1]},
+			{"summary": "my-summary", "quantiles": {"2": 1}, "sum": 1, "count": 1},
+			{"histogram": "my-histogram", "buckets": [1], "observations": [1], "bucket_counts": [1, 0]},
+			{"summary": "my-summary", "quantiles": {"0.5": 1}, "sum": 1, "count": -1}
+		]`)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(rejected("missing_key")).To(Equal(1.0))
+		Expect(rejected("wrong_type")).To(Equal(1.0))
+		Expect(rejected("empty_name")).To(Equal(1.0))
+		Expect(rejected("negative_delta")).To(Equal(2.0))
+		Expect(rejected("invalid_label")).To(Equal(1.0))
+		Expect(rejected("invalid_buckets")).To(Equal(1.0))
+		Expect(rejected("invalid_quantile")).To(Equal(1.0))
+		Expect(rejected("conflicting_keys")).To(Equal(1.0))
+		Expect(rejected("negative_count")).To(Equal(1.0))
+		Expect(recordedMetrics(m)).To(BeEmpty())
+	})
+
+	It("logs rejected entries at debug level", func() {
+		spyExecutor.out = []byte(`[{"name": "my-counter", "delta": -1}]`)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(logger.debugKey).To(Equal("recording-metric"))
+		Expect(logger.debugData).To(ConsistOf(lager.Data{
+			"event":  "rejected",
+			"reason": "negative_delta",
+			"key":    "delta",
+			"name":   "my-counter",
+			"entry":  map[string]interface{}{"name": "my-counter", "delta": -1.0},
+		}))
+	})
+
+	It("logs rejections for the same reason only once in a while", func() {
+		spyExecutor.out = []byte(`[{"name": "my-counter", "delta": -1}]`)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(logger.debugCalls).To(Equal(1))
+		Expect(rejected("negative_delta")).To(Equal(2.0))
+
+		spyExecutor.out = []byte(`[{"name": "other-counter", "delta": -1}]`)
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(logger.debugCalls).To(Equal(1))
+
+		spyExecutor.out = []byte(`[{"key": "my-gauge", "value": "1", "unit": "things"}]`)
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(logger.debugCalls).To(Equal(2))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("reason", "wrong_type"))
+	})
+
+	It("logs a flood of rejections with distinct names once", func() {
+		var entries []string
+		for i := 0; i < 10000; i++ {
+			entries = append(entries, fmt.Sprintf(`{"name": "counter-%d", "delta": -1}`, i))
+		}
+		spyExecutor.out = []byte("[" + strings.Join(entries, ",") + "]")
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(logger.debugCalls).To(Equal(1))
+		Expect(rejected("negative_delta")).To(Equal(10000.0))
+	})
+})
@@ -0,0 +1,229 @@
+package metrics
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// RelabelAction is what a RelabelRule does with a series.
+type RelabelAction string
+
+const (
+	// RelabelKeep drops the series unless its source value matches.
+	RelabelKeep RelabelAction = "keep"
+
+	// RelabelDrop drops the series if its source value matches.
+	RelabelDrop RelabelAction = "drop"
+
+	// RelabelReplace sets the target label to the replacement, expanded
+	// with the groups of the regex, if the source value matches. An empty
+	// result removes the target label.
+	RelabelReplace RelabelAction = "replace"
+
+	// RelabelLabelMap copies the value of every label whose name matches to
+	// the label named by the replacement, expanded with the groups of the
+	// regex.
+	RelabelLabelMap RelabelAction = "labelmap"
+
+	// RelabelLabelDrop removes every label whose name matches.
+	RelabelLabelDrop RelabelAction = "labeldrop"
+
+	// RelabelHashMod sets the target label to the hash of the source value
+	// modulo the modulus, e.g. to shard series.
+	RelabelHashMod RelabelAction = "hashmod"
+)
+
+// ParseRelabelAction returns the RelabelAction with the given name.
+func ParseRelabelAction(s string) (RelabelAction, error) {
+	switch a := RelabelAction(s); a {
+	case RelabelKeep, RelabelDrop, RelabelReplace, RelabelLabelMap, RelabelLabelDrop, RelabelHashMod:
+		return a, nil
+	}
+
+	return "", fmt.Errorf("unknown relabel action %q, must be one of %s, %s, %s, %s, %s or %s", s, RelabelKeep, RelabelDrop, RelabelReplace, RelabelLabelMap, RelabelLabelDrop, RelabelHashMod)
+}
+
+// RelabelRule rewrites the labels of a series like a Prometheus
+// metric_relabel_config, where the metric name is the "__name__" label. The
+// source value is the values of SourceLabels joined with Separator, and
+// labels that are not set have an empty value. Regex must match the whole
+// source value, or label name for RelabelLabelMap and RelabelLabelDrop.
+type RelabelRule struct {
+	// Name identifies the rule in the logs.
+	Name string
+
+	Action       RelabelAction
+	SourceLabels []string
+	Separator    string
+	Regex        *regexp.Regexp
+	TargetLabel  string
+	Replacement  string
+	Modulus      uint64
+}
+
+// WithRelabelRules applies rules, in order, to every series after its names
+// are sanitized and the labels of WithLabels and, for gauges, the "unit"
+// label are added. A series a rule
+// drops, or whose name a rule removes, is skipped without being rejected.
+// Labels starting with "__" can hold temporary values and are removed once
+// all rules are applied. What every rule changed is logged at debug level.
+func WithRelabelRules(rules []RelabelRule) ProcessorOption {
+	return func(p *Processor) {
+		p.relabelRules = rules
+	}
+}
+
+// relabel applies the relabel rules to the series and returns its new name
+// and labels, or false if it is dropped.
+func (p *Processor) relabel(name string, labels map[string]string) (string, map[string]string, bool) {
+	if len(p.relabelRules) == 0 {
+		return name, labels, true
+	}
+
+	series := seriesKey(name, labels)
+
+	labels["__name__"] = name
+	for _, r := range p.relabelRules {
+		before := seriesKey(labels["__name__"], withoutName(labels))
+
+		keep, changed := r.apply(labels)
+		if !keep {
+			p.logRelabel(r, before, lager.Data{"event": "dropped"})
+			return "", nil, false
+		}
+
+		if changed {
+			p.logRelabel(r, before, lager.Data{
+				"event":  "relabeled",
+				"result": seriesKey(labels["__name__"], withoutName(labels)),
+			})
+		}
+	}
+
+	name = labels["__name__"]
+	if name == "" {
+		p.logger.Debug("relabeling-metric", lager.Data{
+			"event":  "dropped",
+			"reason": "empty name",
+			"series": series,
+		})
+		return "", nil, false
+	}
+	name, _ = sanitizeName(name)
+
+	relabeled := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if strings.HasPrefix(k, "__") || v == "" {
+			continue
+		}
+
+		k, _ = sanitizeLabelName(k)
+		relabeled[k] = v
+	}
+
+	return name, relabeled, true
+}
+
+func (p *Processor) logRelabel(r RelabelRule, series string, data lager.Data) {
+	data["rule"] = r.Name
+	data["action"] = r.Action
+	data["series"] = series
+
+	p.logger.Debug("relabeling-metric", data)
+}
+
+// withoutName returns labels without the "__name__" label.
+func withoutName(labels map[string]string) map[string]string {
+	l := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != "__name__" {
+			l[k] = v
+		}
+	}
+
+	return l
+}
+
+// apply applies the rule to labels, reporting whether the series is kept and
+// whether its labels changed.
+func (r RelabelRule) apply(labels map[string]string) (keep, changed bool) {
+	switch r.Action {
+	case RelabelKeep:
+		return r.Regex.MatchString(r.sourceValue(labels)), false
+	case RelabelDrop:
+		return !r.Regex.MatchString(r.sourceValue(labels)), false
+	case RelabelReplace:
+		value := r.sourceValue(labels)
+		match := r.Regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true, false
+		}
+
+		target := string(r.Regex.ExpandString(nil, r.TargetLabel, value, match))
+		if target == "" {
+			return true, false
+		}
+		result := string(r.Regex.ExpandString(nil, r.Replacement, value, match))
+
+		return true, setLabel(labels, target, result)
+	case RelabelLabelMap:
+		mapped := make(map[string]string)
+		for k, v := range labels {
+			if match := r.Regex.FindStringSubmatchIndex(k); match != nil {
+				if target := string(r.Regex.ExpandString(nil, r.Replacement, k, match)); target != "" {
+					mapped[target] = v
+				}
+			}
+		}
+
+		for k, v := range mapped {
+			changed = setLabel(labels, k, v) || changed
+		}
+
+		return true, changed
+	case RelabelLabelDrop:
+		for k := range labels {
+			if k != "__name__" && r.Regex.MatchString(k) {
+				delete(labels, k)
+				changed = true
+			}
+		}
+
+		return true, changed
+	case RelabelHashMod:
+		sum := md5.Sum([]byte(r.sourceValue(labels)))
+		mod := binary.BigEndian.Uint64(sum[8:]) % r.Modulus
+
+		return true, setLabel(labels, r.TargetLabel, fmt.Sprint(mod))
+	}
+
+	return true, false
+}
+
+func (r RelabelRule) sourceValue(labels map[string]string) string {
+	values := make([]string, len(r.SourceLabels))
+	for i, l := range r.SourceLabels {
+		values[i] = labels[l]
+	}
+
+	return strings.Join(values, r.Separator)
+}
+
+// setLabel sets the label, removing it if value is empty, and reports
+// whether labels changed.
+func setLabel(labels map[string]string, name, value string) bool {
+	old, ok := labels[name]
+	if value == "" {
+		delete(labels, name)
+		return ok
+	}
+
+	labels[name] = value
+
+	return !ok || old != value
+}
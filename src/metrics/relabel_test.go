@@ -0,0 +1,330 @@
+package metrics_test
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processor with relabel rules", func() {
+	var (
+		spyExecutor *spyExecutor
+		logger      *spyLogger
+		m           *testhelpers.SpyMetricsRegistry
+	)
+
+	BeforeEach(func() {
+		spyExecutor = newSpyExecutor([]byte(`
+			# TYPE http_requests_total counter
+			http_requests_total{code="200",path="/a"} 3
+			http_requests_total{code="500",path="/a"} 1
+			# TYPE legacy_queue_depth gauge
+			legacy_queue_depth{queue="jobs"} 7
+		`), nil)
+		logger = &spyLogger{}
+		m = testhelpers.NewMetricsRegistry()
+	})
+
+	regex := func(re string) *regexp.Regexp {
+		return regexp.MustCompile("^(?:" + re + ")$")
+	}
+
+	process := func(opts ...metrics.ProcessorOption) {
+		opts = append(opts, metrics.WithFormat(metrics.FormatPrometheus))
+		p := metrics.NewProcessor(logger, metrics.NewRegistrySink(m), spyExecutor, opts...)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+	}
+
+	It("drops the series a drop rule matches", func() {
+		process(metrics.WithRelabelRules([]metrics.RelabelRule{{
+			Name:         "noisy",
+			Action:       metrics.RelabelDrop,
+			SourceLabels: []string{"__name__", "code"},
+			Separator:    ";",
+			Regex:        regex("http_requests_total;5.."),
+		}}))
+
+		Expect(m.HasMetric("http_requests_total", map[string]string{"code": "200", "path": "/a"})).To(BeTrue())
+		Expect(m.HasMetric("http_requests_total", map[string]string{"code": "500", "path": "/a"})).To(BeFalse())
+		Expect(m.HasMetric("legacy_queue_depth", map[string]string{"queue": "jobs"})).To(BeTrue())
+		Expect(m.Metrics).NotTo(HaveKey(HavePrefix("service_metrics_rejected_entries")))
+	})
+
+	It("only keeps the series a keep rule matches", func() {
+		process(metrics.WithRelabelRules([]metrics.RelabelRule{{
+			Action:       metrics.RelabelKeep,
+			SourceLabels: []string{"__name__"},
+			Regex:        regex("http_.*"),
+		}}))
+
+		Expect(m.HasMetric("http_requests_total", map[string]string{"code": "200", "path": "/a"})).To(BeTrue())
+		Expect(m.HasMetric("legacy_queue_depth", map[string]string{"queue": "jobs"})).To(BeFalse())
+	})
+
+	It("renames metrics and sets labels with replace rules", func() {
+		process(metrics.WithRelabelRules([]metrics.RelabelRule{
+			{
+				Action:       metrics.RelabelReplace,
+				SourceLabels: []string{"__name__"},
+				Regex:        regex("legacy_(.*)"),
+				TargetLabel:  "__name__",
+				Replacement:  "$1",
+			},
+			{
+				Action:       metrics.RelabelReplace,
+				SourceLabels: []string{"code"},
+				Regex:        regex("(.)xx|(.).."),
+				TargetLabel:  "class",
+				Replacement:  "${1}${2}xx",
+			},
+			{
+				Action:      metrics.RelabelReplace,
+				Regex:       regex("(.*)"),
+				TargetLabel: "env",
+				Replacement: "prod",
+			},
+		}))
+
+		Expect(m.GetMetricValue("queue_depth", map[string]string{"queue": "jobs", "env": "prod"})).To(Equal(7.0))
+		Expect(m.HasMetric("legacy_queue_depth", map[string]string{"queue": "jobs", "env": "prod"})).To(BeFalse())
+		Expect(m.GetMetricValue("http_requests_total", map[string]string{
+			"code":  "500",
+			"path":  "/a",
+			"class": "5xx",
+			"env":   "prod",
+		})).To(Equal(1.0))
+	})
+
+	It("removes the target label of a replace rule whose replacement is empty", func() {
+		process(metrics.WithRelabelRules([]metrics.RelabelRule{{
+			Action:       metrics.RelabelReplace,
+			SourceLabels: []string{"path"},
+			Regex:        regex("/a"),
+			TargetLabel:  "path",
+		}}))
+
+		Expect(m.GetMetricValue("http_requests_total", map[string]string{"code": "200"})).To(Equal(3.0))
+	})
+
+	It("copies labels with labelmap rules and removes them with labeldrop rules", func() {
+		process(metrics.WithRelabelRules([]metrics.RelabelRule{
+			{
+				Action:      metrics.RelabelLabelMap,
+				Regex:       regex("(path|queue)"),
+				Replacement: "source_$1",
+			},
+			{
+				Action: metrics.RelabelLabelDrop,
+				Regex:  regex("path|queue"),
+			},
+		}))
+
+		Expect(m.HasMetric("http_requests_total", map[string]string{"code": "200", "source_path": "/a"})).To(BeTrue())
+		Expect(m.HasMetric("legacy_queue_depth", map[string]string{"source_queue": "jobs"})).To(BeTrue())
+	})
+
+	It("shards series by the hash of their source value with hashmod rules", func() {
+		rules := []metrics.RelabelRule{
+			{
+				Action:       metrics.RelabelHashMod,
+				SourceLabels: []string{"__name__"},
+				Regex:        regex("(.*)"),
+				TargetLabel:  "__shard",
+				Modulus:      4,
+			},
+			{
+				Action:       metrics.RelabelReplace,
+				SourceLabels: []string{"__shard"},
+				Regex:        regex("(.*)"),
+				TargetLabel:  "shard",
+				Replacement:  "$1",
+			},
+		}
+		process(metrics.WithRelabelRules(rules))
+
+		var shard string
+		for key, metric := range m.Metrics {
+			if strings.HasPrefix(key, "http_requests_total") {
+				Expect(metric.Opts.ConstLabels).NotTo(HaveKey("__shard"))
+				Expect(metric.Opts.ConstLabels).To(HaveKeyWithValue("shard", BeElementOf("0", "1", "2", "3")))
+				if shard != "" {
+					Expect(metric.Opts.ConstLabels["shard"]).To(Equal(shard))
+				}
+				shard = metric.Opts.ConstLabels["shard"]
+			}
+		}
+		Expect(shard).NotTo(BeEmpty())
+	})
+
+	It("drops series whose name a rule removes", func() {
+		process(metrics.WithRelabelRules([]metrics.RelabelRule{{
+			Action:       metrics.RelabelReplace,
+			SourceLabels: []string{"__name__"},
+			Regex:        regex("legacy_.*"),
+			TargetLabel:  "__name__",
+		}}))
+
+		Expect(recordedMetrics(m)).To(ConsistOf(
+			HavePrefix("http_requests_total"),
+			HavePrefix("http_requests_total"),
+		))
+	})
+
+	It("applies the rules after the configured labels are added", func() {
+		process(
+			metrics.WithLabels(map[string]string{"deployment": "db"}),
+			metrics.WithRelabelRules([]metrics.RelabelRule{{
+				Action:       metrics.RelabelKeep,
+				SourceLabels: []string{"deployment"},
+				Regex:        regex("web"),
+			}}),
+		)
+
+		Expect(recordedMetrics(m)).To(BeEmpty())
+	})
+
+	It("applies the rules to the entries of JSON output", func() {
+		spyExecutor.out = []byte(`[
+			{"key": "size", "value": 1, "unit": "bytes", "labels": {"db": "one"}},
+			{"name": "requests", "delta": 2, "labels": {"db": "one"}},
+			{"histogram": "latency", "buckets": [1], "observations": [0.5], "labels": {"db": "two"}}
+		]`)
+
+		p := metrics.NewProcessor(logger, metrics.NewRegistrySink(m), spyExecutor, metrics.WithRelabelRules([]metrics.RelabelRule{
+			{
+				Action:       metrics.RelabelDrop,
+				SourceLabels: []string{"db"},
+				Regex:        regex("two"),
+			},
+			{
+				Action:      metrics.RelabelReplace,
+				Regex:       regex("(.*)"),
+				TargetLabel: "env",
+				Replacement: "prod",
+			},
+		}))
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(m.GetMetricValue("size", map[string]string{"db": "one", "env": "prod", "unit": "bytes"})).To(Equal(1.0))
+		Expect(m.GetMetricValue("requests", map[string]string{"db": "one", "env": "prod"})).To(Equal(2.0))
+		Expect(m.HasMetric("latency", map[string]string{"db": "two", "env": "prod"})).To(BeFalse())
+		Expect(m.HasMetric("latency", map[string]string{"db": "two"})).To(BeFalse())
+	})
+
+	It("applies the rules to gauges with their unit label", func() {
+		spyExecutor.out = []byte(`[
+			{"key": "size", "value": 1, "unit": "bytes", "labels": {"db": "one"}},
+			{"key": "count", "value": 2, "unit": "", "labels": {"db": "two"}},
+			{"key": "uptime", "value": 3, "unit": "seconds"}
+		]`)
+
+		p := metrics.NewProcessor(logger, metrics.NewRegistrySink(m), spyExecutor, metrics.WithRelabelRules([]metrics.RelabelRule{
+			{
+				Action:       metrics.RelabelDrop,
+				SourceLabels: []string{"unit"},
+				Regex:        regex("seconds"),
+			},
+			{
+				Action:       metrics.RelabelReplace,
+				SourceLabels: []string{"unit"},
+				Regex:        regex("(.+)"),
+				TargetLabel:  "measured_in",
+				Replacement:  "$1",
+			},
+		}))
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(m.GetMetricValue("size", map[string]string{"db": "one", "unit": "bytes", "measured_in": "bytes"})).To(Equal(1.0))
+		Expect(m.GetMetricValue("count", map[string]string{"db": "two", "unit": ""})).To(Equal(2.0))
+		Expect(m.HasMetric("uptime", map[string]string{"unit": "seconds"})).To(BeFalse())
+	})
+
+	It("skips histograms and summaries the rules give a label they cannot have", func() {
+		spyExecutor.out = []byte(`[
+			{"histogram": "latency", "buckets": [1], "observations": [0.5]},
+			{"summary": "duration", "quantiles": {"0.5": 1}, "sum": 1, "count": 1},
+			{"name": "requests", "delta": 2}
+		]`)
+
+		report := &metrics.Report{}
+		p := metrics.NewProcessor(logger, metrics.NewRegistrySink(m), spyExecutor, metrics.WithReport(report), metrics.WithRelabelRules([]metrics.RelabelRule{
+			{
+				Action:      metrics.RelabelReplace,
+				Regex:       regex("(.*)"),
+				TargetLabel: "le",
+				Replacement: "1",
+			},
+			{
+				Action:      metrics.RelabelReplace,
+				Regex:       regex("(.*)"),
+				TargetLabel: "quantile",
+				Replacement: "0.5",
+			},
+		}))
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(recordedMetrics(m)).To(ConsistOf(HavePrefix("requests")))
+		Expect(report.Rejected()).To(ConsistOf(
+			metrics.RejectedEntry{Reason: "reserved_label", Name: "latency"},
+			metrics.RejectedEntry{Reason: "reserved_label", Name: "duration"},
+		))
+	})
+
+	It("logs which rule affected which series", func() {
+		spyExecutor.out = []byte("legacy_queue_depth{queue=\"jobs\"} 7\n")
+
+		process(metrics.WithRelabelRules([]metrics.RelabelRule{{
+			Name:         "rename",
+			Action:       metrics.RelabelReplace,
+			SourceLabels: []string{"__name__"},
+			Regex:        regex("legacy_(.*)"),
+			TargetLabel:  "__name__",
+			Replacement:  "$1",
+		}}))
+
+		Expect(logger.debugKey).To(Equal("relabeling-metric"))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("rule", "rename"))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("action", metrics.RelabelReplace))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("event", "relabeled"))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("series", `legacy_queue_depth,queue="jobs"`))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("result", `queue_depth,queue="jobs"`))
+	})
+
+	It("logs which rule dropped which series", func() {
+		spyExecutor.out = []byte("legacy_queue_depth{queue=\"jobs\"} 7\n")
+
+		process(metrics.WithRelabelRules([]metrics.RelabelRule{{
+			Name:         "noisy",
+			Action:       metrics.RelabelDrop,
+			SourceLabels: []string{"queue"},
+			Regex:        regex("jobs"),
+		}}))
+
+		Expect(logger.debugKey).To(Equal("relabeling-metric"))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("rule", "noisy"))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("event", "dropped"))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("series", `legacy_queue_depth,queue="jobs"`))
+	})
+})
+
+var _ = Describe("ParseRelabelAction", func() {
+	It("parses the supported actions", func() {
+		for _, a := range []string{"keep", "drop", "replace", "labelmap", "labeldrop", "hashmod"} {
+			action, err := metrics.ParseRelabelAction(a)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(action).To(Equal(metrics.RelabelAction(a)))
+		}
+	})
+
+	It("rejects unknown actions", func() {
+		_, err := metrics.ParseRelabelAction("labelkeep")
+		Expect(err).To(MatchError(ContainSubstring(`unknown relabel action "labelkeep"`)))
+	})
+})
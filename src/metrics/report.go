@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// Report lists what a Processor made of the output of the metrics command:
+// the series it recorded, the names it had to sanitize and the entries it
+// rejected. It is safe for concurrent use.
+type Report struct {
+	mu       sync.Mutex
+	accepted []AcceptedSeries
+	renamed  []Rename
+	rejected []RejectedEntry
+}
+
+// AcceptedSeries is a series that was recorded.
+type AcceptedSeries struct {
+	Type   string            `json:"type"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Rename is a metric or label name that was sanitized.
+type Rename struct {
+	Kind string `json:"kind"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// RejectedEntry is an entry, or a series of Prometheus text output, that was
+// not recorded.
+type RejectedEntry struct {
+	Reason string                 `json:"reason"`
+	Key    string                 `json:"key,omitempty"`
+	Name   string                 `json:"name,omitempty"`
+	Entry  map[string]interface{} `json:"entry,omitempty"`
+}
+
+// WithReport adds everything the Processor records, renames and rejects to
+// r.
+func WithReport(r *Report) ProcessorOption {
+	return func(p *Processor) {
+		p.report = r
+	}
+}
+
+// Accepted returns the series that were recorded, in order.
+func (r *Report) Accepted() []AcceptedSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]AcceptedSeries(nil), r.accepted...)
+}
+
+// Renamed returns the names that were sanitized, in order.
+func (r *Report) Renamed() []Rename {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Rename(nil), r.renamed...)
+}
+
+// Rejected returns the entries that were rejected, in order.
+func (r *Report) Rejected() []RejectedEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]RejectedEntry(nil), r.rejected...)
+}
+
+// The methods below do nothing when the Processor has no Report.
+
+func (r *Report) accept(kind, name string, labels map[string]string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.accepted = append(r.accepted, AcceptedSeries{Type: kind, Name: name, Labels: copyLabels(labels)})
+}
+
+func (r *Report) rename(kind, from, to string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.renamed = append(r.renamed, Rename{Kind: kind, From: from, To: to})
+}
+
+func (r *Report) reject(e RejectedEntry) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rejected = append(r.rejected, e)
+}
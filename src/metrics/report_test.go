@@ -0,0 +1,54 @@
+package metrics_test
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processor with a report", func() {
+	It("reports accepted series, renamed names and rejected entries", func() {
+		spyExecutor := newSpyExecutor([]byte(`[
+			{"key": "my-key", "value": 1, "unit": "things", "labels": {"a.b": "c"}},
+			{"name": "my_counter", "delta": 1},
+			{"histogram": "my_histogram", "buckets": [1], "observations": [0.5]},
+			{"summary": "my_summary", "quantiles": {"0.5": 1}, "sum": 2, "count": 3},
+			{"name": "negative", "delta": -1},
+			{"key": "service_metrics_runs", "value": 1, "unit": "things"}
+		]`), nil)
+
+		report := &metrics.Report{}
+		p := metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(testhelpers.NewMetricsRegistry()),
+			spyExecutor,
+			metrics.WithReport(report),
+		)
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		Expect(report.Accepted()).To(Equal([]metrics.AcceptedSeries{
+			{Type: "gauge", Name: "my_key", Labels: map[string]string{"a_b": "c", "unit": "things"}},
+			{Type: "counter", Name: "my_counter", Labels: map[string]string{}},
+			{Type: "histogram", Name: "my_histogram", Labels: map[string]string{}},
+			{Type: "summary", Name: "my_summary", Labels: map[string]string{}},
+		}))
+		Expect(report.Renamed()).To(Equal([]metrics.Rename{
+			{Kind: "metric", From: "my-key", To: "my_key"},
+			{Kind: "label", From: "a.b", To: "a_b"},
+		}))
+		Expect(report.Rejected()).To(Equal([]metrics.RejectedEntry{
+			{
+				Reason: "negative_delta",
+				Key:    "delta",
+				Name:   "negative",
+				Entry:  map[string]interface{}{"name": "negative", "delta": -1.0},
+			},
+			{Reason: "reserved_prefix", Name: "service_metrics_runs"},
+		}))
+	})
+})
@@ -0,0 +1,33 @@
+package metrics
+
+import "sync"
+
+// Signatures records the type, help text and label names each metric name
+// was first registered with. The registry refuses to register a metric name
+// with a different type, help text or set of label names, so entries that
+// disagree are dropped. It is safe for concurrent use.
+type Signatures struct {
+	mu         sync.Mutex
+	signatures map[string]string
+}
+
+func NewSignatures() *Signatures {
+	return &Signatures{
+		signatures: make(map[string]string),
+	}
+}
+
+// register records the signature for name if it is the first one, and
+// reports whether it matches the registered signature.
+func (s *Signatures) register(name, signature string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	registered, ok := s.signatures[name]
+	if !ok {
+		s.signatures[name] = signature
+		return signature, true
+	}
+
+	return registered, registered == signature
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	metrics "code.cloudfoundry.org/go-metric-registry"
+)
+
+// Series identifies a series by the name of its metric and its labels. Help
+// is the help text of the metric.
+type Series struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+}
+
+// Sink receives the samples a Processor records. Samples are validated and
+// sanitized before they reach the Sink, so every series of a metric has the
+// same type, help text and label names. Gauges carry their unit in the
+// "unit" label.
+type Sink interface {
+	SetGauge(s Series, value float64)
+	// AddCounter adds a non-negative delta to the counter series.
+	AddCounter(s Series, delta float64)
+	ObserveHistogram(s Series, buckets []float64, value float64)
+	// AddHistogramCounts adds pre-aggregated observations to the histogram
+	// series: counts holds the number of observations in each bucket, not
+	// cumulative, plus a final count of those above the highest bucket, and
+	// sum is the sum of all of them.
+	AddHistogramCounts(s Series, buckets []float64, counts []uint64, sum float64)
+	// DeleteSeries stops exporting the gauge series, e.g. because it has
+	// become stale.
+	DeleteSeries(s Series)
+}
+
+// SeriesChecker is a Sink that can fail to record a series, such as the Sink
+// of a PrometheusRegistry, which cannot register a series whose name is
+// registered with other label names. CheckSeries returns the error recording
+// the series of the kind, "gauge", "counter" or "histogram", fails with. The
+// Processor rejects the entries of such series instead of recording them.
+type SeriesChecker interface {
+	CheckSeries(kind string, s Series) error
+}
+
+// Registry creates the instruments series are recorded in, such as the
+// PrometheusRegistry that serves them for prom_scraper.
+type Registry interface {
+	NewCounter(name, helpText string, opts ...metrics.MetricOption) metrics.Counter
+	NewGauge(name, helpText string, opts ...metrics.MetricOption) metrics.Gauge
+	NewHistogram(name, helpText string, buckets []float64, opts ...metrics.MetricOption) metrics.Histogram
+	RemoveGauge(metrics.Gauge)
+}
+
+// NewRegistrySink returns a Sink that records samples in the instruments of
+// r.
+func NewRegistrySink(r Registry) Sink {
+	return registrySink{registry: r}
+}
+
+type registrySink struct {
+	registry Registry
+}
+
+// CheckSeries checks the series with a registry that implements
+// SeriesChecker, such as a PrometheusRegistry.
+func (s registrySink) CheckSeries(kind string, series Series) error {
+	if c, ok := s.registry.(SeriesChecker); ok {
+		return c.CheckSeries(kind, series)
+	}
+
+	return nil
+}
+
+func (s registrySink) SetGauge(series Series, value float64) {
+	s.gauge(series).Set(value)
+}
+
+func (s registrySink) AddCounter(series Series, delta float64) {
+	s.registry.NewCounter(
+		series.Name,
+		series.Help,
+		metrics.WithMetricLabels(series.Labels),
+	).Add(delta)
+}
+
+func (s registrySink) ObserveHistogram(series Series, buckets []float64, value float64) {
+	s.registry.NewHistogram(
+		series.Name,
+		series.Help,
+		buckets,
+		metrics.WithMetricLabels(series.Labels),
+	).Observe(value)
+}
+
+// AddHistogramCounts adds the counts to a histogram of the registry that
+// implements histogramCounts, such as those of a PrometheusRegistry. Other
+// histograms only take single observations, so they observe the sum once,
+// which keeps their sum right.
+func (s registrySink) AddHistogramCounts(series Series, buckets []float64, counts []uint64, sum float64) {
+	h := s.registry.NewHistogram(
+		series.Name,
+		series.Help,
+		buckets,
+		metrics.WithMetricLabels(series.Labels),
+	)
+
+	if hc, ok := h.(histogramCounts); ok {
+		hc.AddCounts(buckets, counts, sum)
+		return
+	}
+
+	h.Observe(sum)
+}
+
+// histogramCounts is a histogram that can add pre-aggregated bucket counts.
+type histogramCounts interface {
+	AddCounts(buckets []float64, counts []uint64, sum float64)
+}
+
+// DeleteSeries removes the gauge for the series, which the registry returns
+// again since it is already registered.
+func (s registrySink) DeleteSeries(series Series) {
+	s.registry.RemoveGauge(s.gauge(series))
+}
+
+func (s registrySink) gauge(series Series) metrics.Gauge {
+	return s.registry.NewGauge(
+		series.Name,
+		series.Help,
+		metrics.WithMetricLabels(series.Labels),
+	)
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// WithStaleGaugeRemoval removes gauge series that the metrics command has
+// not reported for the given number of consecutive successful runs, so that
+// they stop being exported. A value of 0, the default, keeps every gauge
+// forever.
+func WithStaleGaugeRemoval(runs int) ProcessorOption {
+	return func(p *Processor) {
+		p.staleGaugeRuns = runs
+	}
+}
+
+type trackedGauge struct {
+	series Series
+	missed int
+	seen   bool
+}
+
+// trackGauge sets the gauge series to value, remembering that it was
+// reported in the current run.
+func (p *Processor) trackGauge(name, help string, labels map[string]string, value float64) {
+	series := Series{Name: name, Help: help, Labels: labels}
+	p.sink.SetGauge(series, value)
+
+	if p.staleGaugeRuns > 0 {
+		key := seriesKey(name, labels)
+		t, ok := p.gauges[key]
+		if !ok {
+			t = &trackedGauge{series: series}
+			p.gauges[key] = t
+		}
+		t.seen = true
+	}
+}
+
+// removeStaleGauges is called after every successful run and removes the
+// gauges that have now been missing for staleGaugeRuns runs.
+func (p *Processor) removeStaleGauges() {
+	if p.staleGaugeRuns <= 0 {
+		return
+	}
+
+	for key, t := range p.gauges {
+		if t.seen {
+			t.seen = false
+			t.missed = 0
+			continue
+		}
+
+		t.missed++
+		if t.missed < p.staleGaugeRuns {
+			continue
+		}
+
+		p.logger.Info("removing-stale-gauge", lager.Data{
+			"name":   t.series.Name,
+			"labels": t.series.Labels,
+			"runs":   t.missed,
+		})
+		p.sink.DeleteSeries(t.series)
+		delete(p.gauges, key)
+	}
+}
@@ -0,0 +1,87 @@
+package metrics_test
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processor with stale gauge removal", func() {
+	var (
+		spyExecutor *spyExecutor
+		m           *testhelpers.SpyMetricsRegistry
+		p           metrics.Processor
+	)
+
+	BeforeEach(func() {
+		spyExecutor = newSpyExecutor(nil, nil)
+		m = testhelpers.NewMetricsRegistry()
+		p = metrics.NewProcessor(
+			&spyLogger{},
+			metrics.NewRegistrySink(m),
+			spyExecutor,
+			metrics.WithStaleGaugeRemoval(2),
+		)
+	})
+
+	It("removes gauges missing for the configured number of runs", func() {
+		spyExecutor.out = []byte(`[
+			{"key": "size", "value": 1, "unit": "bytes", "labels": {"db": "one"}},
+			{"key": "size", "value": 2, "unit": "bytes", "labels": {"db": "two"}}
+		]`)
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		spyExecutor.out = []byte(`[
+			{"key": "size", "value": 1, "unit": "bytes", "labels": {"db": "one"}}
+		]`)
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+		Expect(m.HasMetric("size", map[string]string{"unit": "bytes", "db": "two"})).To(BeTrue())
+
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+		Expect(m.HasMetric("size", map[string]string{"unit": "bytes", "db": "two"})).To(BeFalse())
+		Expect(m.GetMetricValue("size", map[string]string{"unit": "bytes", "db": "one"})).To(Equal(1.0))
+	})
+
+	It("resets the count when a gauge is reported again", func() {
+		withGauge := []byte(`[{"key": "size", "value": 1, "unit": "bytes"}]`)
+		withoutGauge := []byte(`[]`)
+
+		for _, out := range [][]byte{withGauge, withoutGauge, withGauge, withoutGauge} {
+			spyExecutor.out = out
+			Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+		}
+
+		Expect(m.HasMetric("size", map[string]string{"unit": "bytes"})).To(BeTrue())
+	})
+
+	It("does not count failed runs", func() {
+		spyExecutor.out = []byte(`[{"key": "size", "value": 1, "unit": "bytes"}]`)
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		spyExecutor.out = nil
+		spyExecutor.err = metrics.ErrCommandFailed
+		for i := 0; i < 3; i++ {
+			Expect(p.Process(context.Background(), "/bin/echo")).ToNot(Succeed())
+		}
+
+		Expect(m.HasMetric("size", map[string]string{"unit": "bytes"})).To(BeTrue())
+	})
+
+	It("keeps gauges forever by default", func() {
+		p = metrics.NewProcessor(&spyLogger{}, metrics.NewRegistrySink(m), spyExecutor)
+
+		spyExecutor.out = []byte(`[{"key": "size", "value": 1, "unit": "bytes"}]`)
+		Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+
+		spyExecutor.out = []byte(`[]`)
+		for i := 0; i < 3; i++ {
+			Expect(p.Process(context.Background(), "/bin/echo")).To(Succeed())
+		}
+
+		Expect(m.HasMetric("size", map[string]string{"unit": "bytes"})).To(BeTrue())
+	})
+})
@@ -0,0 +1,328 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// statsdBuckets are the buckets of the histograms StatsD timers, converted
+// from milliseconds to seconds, and unscaled histogram and distribution
+// values are recorded in.
+var statsdBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// maxMalformedStatsD is how many rejected lines are kept per flush to be
+// reported, the others are only counted.
+const maxMalformedStatsD = 100
+
+// errNegativeStatsDCounter is returned for a counter with a negative value,
+// which cannot be recorded as counters only increase.
+var errNegativeStatsDCounter = errors.New("negative counter")
+
+// StatsD aggregates StatsD metrics between flushes, which record them with
+// Processor.ProcessStatsD. Counters are summed, gauges keep their last value,
+// timers, histograms and distributions are counted in the buckets of a
+// histogram and sets are counted as the number of unique values. Counters,
+// timers, histograms and distributions are scaled by their sample rate.
+// Counters with a negative value are rejected. DogStatsD tags are turned into
+// labels, where a "unit" tag sets the unit of gauges. It is safe for
+// concurrent use.
+type StatsD struct {
+	mu sync.Mutex
+
+	counters map[string]*statsdSeries
+	// gauges are kept across flushes, so that relative changes apply to the
+	// last value.
+	gauges map[string]*statsdSeries
+	timers map[string]*statsdSeries
+	sets   map[string]*statsdSeries
+
+	size     int
+	rejected []statsdRejection
+	// extra is how many more lines were rejected for each reason.
+	extra map[string]int
+}
+
+// statsdRejection is a line rejected for reason.
+type statsdRejection struct {
+	line   string
+	reason string
+}
+
+type statsdSeries struct {
+	name   string
+	labels map[string]interface{}
+
+	value  float64
+	values map[string]struct{}
+
+	// counts are the number of timer observations in each of statsdBuckets
+	// and above them, scaled by their sample rate, and sum is their sum.
+	counts []float64
+	sum    float64
+
+	// updated is set for gauges changed since the last flush.
+	updated bool
+}
+
+func NewStatsD() *StatsD {
+	return &StatsD{
+		counters: make(map[string]*statsdSeries),
+		gauges:   make(map[string]*statsdSeries),
+		timers:   make(map[string]*statsdSeries),
+		sets:     make(map[string]*statsdSeries),
+		extra:    make(map[string]int),
+	}
+}
+
+// Add aggregates a packet of newline separated StatsD lines, such as
+// "name:1|c|@0.5|#tag:value". Malformed lines and negative counters are
+// rejected on the next flush.
+func (s *StatsD) Add(packet []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.size += len(packet)
+
+	for _, line := range bytes.Split(packet, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		if err := s.add(string(line)); err != nil {
+			reason := reasonMalformedStatsD
+			if errors.Is(err, errNegativeStatsDCounter) {
+				reason = reasonNegativeDelta
+			}
+
+			if len(s.rejected) < maxMalformedStatsD {
+				s.rejected = append(s.rejected, statsdRejection{line: string(line), reason: reason})
+			} else {
+				s.extra[reason]++
+			}
+		}
+	}
+}
+
+func (s *StatsD) add(line string) error {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return errors.New("missing name")
+	}
+
+	sections := strings.Split(rest, "|")
+	if len(sections) < 2 {
+		return errors.New("missing type")
+	}
+	value, kind := sections[0], sections[1]
+
+	rate := 1.0
+	labels := make(map[string]interface{})
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			r, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate %q", section)
+			}
+			rate = r
+		case strings.HasPrefix(section, "#"):
+			for _, tag := range strings.Split(section[1:], ",") {
+				// Tags without a value cannot be turned into a label.
+				if k, v, ok := strings.Cut(tag, ":"); ok && k != "" {
+					labels[k] = v
+				}
+			}
+		}
+	}
+
+	if kind == "s" {
+		series := seriesOf(s.sets, name, labels)
+		if series.values == nil {
+			series.values = make(map[string]struct{})
+		}
+		series.values[value] = struct{}{}
+		return nil
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case "c":
+		if v < 0 {
+			return errNegativeStatsDCounter
+		}
+		series := seriesOf(s.counters, name, labels)
+		series.value += v / rate
+	case "g":
+		series := seriesOf(s.gauges, name, labels)
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			series.value += v
+		} else {
+			series.value = v
+		}
+		series.updated = true
+	case "ms", "h", "d":
+		if kind == "ms" {
+			v /= 1000
+		}
+		series := seriesOf(s.timers, name, labels)
+		if series.counts == nil {
+			series.counts = make([]float64, len(statsdBuckets)+1)
+		}
+		series.counts[sort.SearchFloat64s(statsdBuckets, v)] += 1 / rate
+		series.sum += v / rate
+	default:
+		return fmt.Errorf("unknown type %q", kind)
+	}
+
+	return nil
+}
+
+func seriesOf(series map[string]*statsdSeries, name string, labels map[string]interface{}) *statsdSeries {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	key := name
+	for _, k := range names {
+		key += "," + k + "=" + labels[k].(string)
+	}
+
+	s, ok := series[key]
+	if !ok {
+		s = &statsdSeries{name: name, labels: labels}
+		series[key] = s
+	}
+
+	return s
+}
+
+// flush returns the entries aggregated since the last flush, the rejected
+// lines and how many more there were for each reason, and the size of the
+// packets received, and starts over.
+func (s *StatsD) flush() ([]map[string]interface{}, []statsdRejection, map[string]int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []map[string]interface{}
+	for _, c := range sortedSeries(s.counters) {
+		entries = append(entries, map[string]interface{}{
+			"name":   c.name,
+			"delta":  c.value,
+			"labels": c.labels,
+		})
+	}
+
+	for _, g := range sortedSeries(s.gauges) {
+		if !g.updated {
+			continue
+		}
+		g.updated = false
+
+		entries = append(entries, gaugeEntry(g.name, g.value, g.labels))
+	}
+
+	buckets := make([]interface{}, 0, len(statsdBuckets))
+	for _, b := range statsdBuckets {
+		buckets = append(buckets, b)
+	}
+
+	for _, t := range sortedSeries(s.timers) {
+		// Observations scaled by a sample rate are counted as the nearest
+		// whole number of observations.
+		counts := make([]interface{}, 0, len(t.counts))
+		for _, c := range t.counts {
+			counts = append(counts, math.Round(c))
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"histogram":     t.name,
+			"buckets":       buckets,
+			"bucket_counts": counts,
+			"sum":           t.sum,
+			"labels":        t.labels,
+		})
+	}
+
+	for _, set := range sortedSeries(s.sets) {
+		entries = append(entries, gaugeEntry(set.name, float64(len(set.values)), set.labels))
+	}
+
+	rejected, extra, size := s.rejected, s.extra, s.size
+
+	s.counters = make(map[string]*statsdSeries)
+	s.timers = make(map[string]*statsdSeries)
+	s.sets = make(map[string]*statsdSeries)
+	s.rejected, s.extra, s.size = nil, make(map[string]int), 0
+
+	return entries, rejected, extra, size
+}
+
+// gaugeEntry returns a gauge entry whose unit is the "unit" tag, if any.
+func gaugeEntry(name string, value float64, tags map[string]interface{}) map[string]interface{} {
+	labels := make(map[string]interface{}, len(tags))
+	for k, v := range tags {
+		labels[k] = v
+	}
+
+	unit, _ := labels["unit"].(string)
+	delete(labels, "unit")
+
+	return map[string]interface{}{
+		"key":    name,
+		"value":  value,
+		"unit":   unit,
+		"labels": labels,
+	}
+}
+
+func sortedSeries(series map[string]*statsdSeries) []*statsdSeries {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]*statsdSeries, 0, len(keys))
+	for _, k := range keys {
+		sorted = append(sorted, series[k])
+	}
+
+	return sorted
+}
+
+// ProcessStatsD records the metrics s has aggregated since the last call and
+// rejects the lines it could not aggregate, like the output of a run of
+// Process.
+func (p *Processor) ProcessStatsD(s *StatsD) {
+	p.parsed, p.dropped = make(map[string]int), 0
+
+	entries, rejected, extra, size := s.flush()
+	for _, entry := range entries {
+		p.recordEntry(entry)
+	}
+
+	for _, r := range rejected {
+		p.reject(map[string]interface{}{"line": r.line}, &rejection{reason: r.reason})
+	}
+
+	for reason, n := range extra {
+		for i := 0; i < n; i++ {
+			p.reject(nil, &rejection{reason: reason})
+		}
+	}
+
+	p.instruments.observeResult(size, nil, p.parsed, p.dropped)
+}
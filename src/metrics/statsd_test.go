@@ -0,0 +1,153 @@
+package metrics_test
+
+import (
+	"code.cloudfoundry.org/go-metric-registry/testhelpers"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processor with StatsD metrics", func() {
+	var (
+		m      *testhelpers.SpyMetricsRegistry
+		p      metrics.Processor
+		statsd *metrics.StatsD
+	)
+
+	BeforeEach(func() {
+		m = testhelpers.NewMetricsRegistry()
+		p = metrics.NewProcessor(&spyLogger{}, metrics.NewRegistrySink(m), nil)
+		statsd = metrics.NewStatsD()
+	})
+
+	It("sums counters, scaled by their sample rate", func() {
+		statsd.Add([]byte("hits:1|c|#env:prod\nhits:2|c|@0.5|#env:prod"))
+		p.ProcessStatsD(statsd)
+
+		statsd.Add([]byte("hits:1|c|#env:prod"))
+		p.ProcessStatsD(statsd)
+
+		Expect(m.GetMetricValue("hits", map[string]string{"env": "prod"})).To(Equal(6.0))
+	})
+
+	It("keeps the last value of gauges and applies relative changes", func() {
+		statsd.Add([]byte("mem:100|g|#unit:bytes,host:a"))
+		p.ProcessStatsD(statsd)
+
+		statsd.Add([]byte("mem:+5|g|#unit:bytes,host:a\nmem:-2|g|#host:a,unit:bytes"))
+		p.ProcessStatsD(statsd)
+
+		Expect(m.GetMetricValue("mem", map[string]string{"unit": "bytes", "host": "a"})).To(Equal(103.0))
+	})
+
+	It("observes timers in seconds", func() {
+		statsd.Add([]byte("latency:250|ms\nlatency:20|ms"))
+		p.ProcessStatsD(statsd)
+
+		h := m.GetMetric("latency", nil)
+		Expect(h.Buckets()).To(ContainElement(0.25))
+		Expect(h.Value()).To(BeNumerically("~", 0.27))
+	})
+
+	It("counts the unique values of sets", func() {
+		statsd.Add([]byte("users:a|s\nusers:b|s\nusers:a|s"))
+		p.ProcessStatsD(statsd)
+
+		Expect(m.GetMetricValue("users", map[string]string{"unit": ""})).To(Equal(2.0))
+	})
+
+	It("sanitizes names and rejects malformed lines and negative counters", func() {
+		statsd.Add([]byte("my.counter:1|c\ngarbage\nmy.counter:x|c\nother:1|q\ndecrement:-1|c"))
+		p.ProcessStatsD(statsd)
+
+		Expect(m.GetMetricValue("my_counter", nil)).To(Equal(1.0))
+		Expect(m.GetMetricValue("service_metrics_rejected_entries", map[string]string{"reason": "malformed_statsd"})).To(Equal(3.0))
+		Expect(m.GetMetricValue("service_metrics_rejected_entries", map[string]string{"reason": "negative_delta"})).To(Equal(1.0))
+	})
+
+	It("rejects negative counters as they are received, before they are summed", func() {
+		logger := &spyLogger{}
+		p = metrics.NewProcessor(logger, metrics.NewRegistrySink(m), nil)
+
+		statsd.Add([]byte("hits:5|c\nhits:-1|c\nhits:-2|c|@0.5"))
+		p.ProcessStatsD(statsd)
+
+		Expect(m.GetMetricValue("hits", nil)).To(Equal(5.0))
+		Expect(m.GetMetricValue("service_metrics_rejected_entries", map[string]string{"reason": "negative_delta"})).To(Equal(2.0))
+		Expect(logger.debugData[0]).To(HaveKeyWithValue("entry", map[string]interface{}{"line": "hits:-1|c"}))
+	})
+})
+
+var _ = Describe("StatsD timers", func() {
+	var (
+		r      *metrics.PrometheusRegistry
+		p      metrics.Processor
+		statsd *metrics.StatsD
+	)
+
+	BeforeEach(func() {
+		r = metrics.NewPrometheusRegistry()
+		p = metrics.NewProcessor(&spyLogger{}, metrics.NewRegistrySink(r), nil)
+		statsd = metrics.NewStatsD()
+	})
+
+	histogram := func(name string) *dto.Histogram {
+		families, err := r.Gather()
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, f := range families {
+			if f.GetName() == name {
+				return f.GetMetric()[0].GetHistogram()
+			}
+		}
+
+		Fail("no histogram named " + name)
+		return nil
+	}
+
+	// bucket returns the cumulative count of the bucket with the bound.
+	bucket := func(h *dto.Histogram, bound float64) uint64 {
+		for _, b := range h.GetBucket() {
+			if b.GetUpperBound() == bound {
+				return b.GetCumulativeCount()
+			}
+		}
+
+		Fail("no bucket with the bound")
+		return 0
+	}
+
+	It("counts every observation in its bucket", func() {
+		statsd.Add([]byte("latency:250|ms\nlatency:20|ms\nsize:30|h"))
+		p.ProcessStatsD(statsd)
+
+		h := histogram("latency")
+		Expect(h.GetSampleCount()).To(BeEquivalentTo(2))
+		Expect(h.GetSampleSum()).To(BeNumerically("~", 0.27))
+		Expect(bucket(h, 0.01)).To(BeZero())
+		Expect(bucket(h, 0.025)).To(BeEquivalentTo(1))
+		Expect(bucket(h, 0.25)).To(BeEquivalentTo(2))
+
+		h = histogram("size")
+		Expect(h.GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(bucket(h, 10)).To(BeZero())
+		Expect(h.GetSampleSum()).To(Equal(30.0))
+	})
+
+	DescribeTable("scales observations by their sample rate",
+		func(line string, count uint64, sum float64) {
+			statsd.Add([]byte(line))
+			p.ProcessStatsD(statsd)
+
+			h := histogram("latency")
+			Expect(h.GetSampleCount()).To(Equal(count))
+			Expect(h.GetSampleSum()).To(BeNumerically("~", sum))
+		},
+		Entry("timers", "latency:100|ms|@0.25", uint64(4), 0.4),
+		Entry("histograms", "latency:2|h|@0.5\nlatency:2|h|@0.5", uint64(4), 8.0),
+		Entry("distributions", "latency:1|d|@0.1", uint64(10), 10.0),
+		Entry("rounding to the nearest count", "latency:100|ms|@0.3", uint64(3), 0.1/0.3),
+	)
+})
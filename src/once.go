@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runOnce implements the once subcommand. It runs every configured metrics
+// command one time through the same collectors service metrics runs, and
+// with --print writes the Prometheus text exposition of the recorded metrics
+// to stdout. It returns 1 if any metrics command failed.
+func runOnce(args []string) int {
+	fs := flag.NewFlagSet("once", flag.ExitOnError)
+	printOnly := fs.Bool("print", false, "Write the resulting Prometheus text exposition to stdout")
+	selfMetrics := fs.Bool("self-metrics", false, "Include the "+metrics.ReservedPrefix+" metrics about the runs in the printed exposition")
+
+	c, err := loadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		return 1
+	}
+
+	if _, err := metrics.ParseFormat(c.MetricsFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --metrics-format: %s\n", err)
+		return 1
+	}
+
+	if err := validateStderrLogLevel(c.StderrLogLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		return 1
+	}
+
+	if _, err := compileRelabelRules("relabel_rules", c.RelabelRules); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --relabel-rule: %s\n", err)
+		return 1
+	}
+
+	if err := validateCollectors(c.collectors()); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid collectors: %s\n", err)
+		return 1
+	}
+	cfg = c
+
+	logLevel := lager.ERROR
+	if cfg.Debug {
+		logLevel = lager.DEBUG
+	}
+
+	logger := lager.NewLogger("service-metrics")
+	logger.RegisterSink(lager.NewWriterSink(os.Stderr, logLevel))
+
+	m := metrics.NewPrometheusRegistry()
+
+	failed := false
+	for _, col := range newCollectors(cfg.collectors(), nil, logger, metrics.NewRegistrySink(m), metrics.NewSignatures()) {
+		if err := col.collect(context.Background()); err != nil {
+			failed = true
+		}
+	}
+
+	if *printOnly {
+		if err := printExposition(os.Stdout, m, *selfMetrics); err != nil {
+			fmt.Fprintf(os.Stderr, "Printing metrics: %s\n", err)
+			return 1
+		}
+	}
+
+	if failed {
+		return 1
+	}
+
+	return 0
+}
+
+// printExposition writes the metric families gathered from g to w, sorted by
+// name and without the metrics about service metrics itself unless
+// selfMetrics is set, so that the output of equal runs can be diffed.
+func printExposition(w io.Writer, g prometheus.Gatherer, selfMetrics bool) error {
+	families, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range families {
+		if !selfMetrics && strings.HasPrefix(f.GetName(), metrics.ReservedPrefix) {
+			continue
+		}
+
+		if _, err := expfmt.MetricFamilyToText(w, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("printExposition", func() {
+	var reg *metrics.PrometheusRegistry
+
+	BeforeEach(func() {
+		cfg = defaultConfig()
+
+		reg = metrics.NewPrometheusRegistry()
+		c := newCollector(collectorConfig{
+			Name:    "echo",
+			Command: "/bin/echo",
+			Args: []string{`[
+				{"key": "my-key", "value": 3, "unit": "bytes"},
+				{"key": "size", "value": "three", "unit": "bytes"}
+			]`},
+			Format: "json",
+		}, nil, lager.NewLogger("test"), metrics.NewRegistrySink(reg), metrics.NewSignatures())
+
+		Expect(c.collect(context.Background())).To(Succeed())
+	})
+
+	It("leaves out every metric about service metrics itself", func() {
+		var out bytes.Buffer
+		Expect(printExposition(&out, reg, false)).To(Succeed())
+
+		Expect(out.String()).To(ContainSubstring(`my_key{unit="bytes"} 3`))
+		Expect(out.String()).NotTo(ContainSubstring(metrics.ReservedPrefix))
+	})
+
+	It("includes the metrics about service metrics with self metrics", func() {
+		var out bytes.Buffer
+		Expect(printExposition(&out, reg, true)).To(Succeed())
+
+		Expect(out.String()).To(ContainSubstring(`my_key{unit="bytes"} 3`))
+		Expect(out.String()).To(ContainSubstring("service_metrics_modified_metric_names 1"))
+		Expect(out.String()).To(ContainSubstring(`service_metrics_rejected_entries{`))
+		Expect(out.String()).To(ContainSubstring(`service_metrics_runs{`))
+	})
+})
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/otlp"
+)
+
+// startOTLP starts exporting the metrics recorded in the returned exporter
+// to the configured OTLP receiver, calling onError with every export that
+// failed.
+func startOTLP(logger lager.Logger, onError func(error)) (*otlp.Exporter, error) {
+	protocol, err := otlp.ParseProtocol(cfg.OTLPProtocol)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := clientTLSConfig(cfg.OTLPCAFile, cfg.OTLPCertFile, cfg.OTLPKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := otlp.NewClient(protocol, cfg.OTLPEndpoint, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	resource := map[string]string{"service.name": cfg.Origin}
+	if cfg.InstanceID != "" {
+		resource["service.instance.id"] = cfg.InstanceID
+	}
+	for k, v := range cfg.OTLPResourceAttributes {
+		resource[k] = v
+	}
+
+	exporter := otlp.NewExporter(
+		client,
+		logger,
+		otlp.WithResource(resource),
+		otlp.WithInterval(cfg.OTLPInterval),
+		otlp.WithErrorHandler(onError),
+	)
+	exporter.Start()
+
+	logger.Info("exporting-otlp-metrics", lager.Data{
+		"endpoint": cfg.OTLPEndpoint,
+		"protocol": cfg.OTLPProtocol,
+		"interval": cfg.OTLPInterval.String(),
+		"resource": resource,
+	})
+
+	return exporter, nil
+}
@@ -0,0 +1,175 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"code.cloudfoundry.org/service-metrics-release/grpcclient"
+)
+
+// Protocol is the OTLP transport.
+type Protocol string
+
+const (
+	ProtocolGRPC Protocol = "grpc"
+	ProtocolHTTP Protocol = "http/protobuf"
+)
+
+// ParseProtocol returns the Protocol named s.
+func ParseProtocol(s string) (Protocol, error) {
+	switch Protocol(s) {
+	case ProtocolGRPC, ProtocolHTTP:
+		return Protocol(s), nil
+	}
+
+	return "", fmt.Errorf("unknown protocol %q, must be one of grpc or http/protobuf", s)
+}
+
+const (
+	// exportMethod is the gRPC method of the OTLP metrics service.
+	exportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+	// exportPath is appended to the endpoint of OTLP/HTTP.
+	exportPath = "/v1/metrics"
+
+	maxResponseSize = 64 * 1024
+)
+
+// ErrPermanent is wrapped by the errors of exports that must not be retried.
+var ErrPermanent = errors.New("export failed permanently")
+
+// PartialSuccessError is returned when the receiver accepted the export but
+// rejected some of its data points. Exports that partially succeeded must not
+// be retried.
+type PartialSuccessError struct {
+	Rejected int64
+	Message  string
+}
+
+func (e *PartialSuccessError) Error() string {
+	return fmt.Sprintf("receiver rejected %d data points: %s", e.Rejected, e.Message)
+}
+
+// Client exports metrics to an OTLP receiver such as the OpenTelemetry
+// collector, over gRPC or HTTP.
+type Client struct {
+	protocol Protocol
+	url      string
+	client   *http.Client
+}
+
+// NewClient returns a client for the receiver at endpoint, such as
+// http://localhost:4317 for gRPC or http://localhost:4318 for HTTP. Receivers
+// with an https endpoint are verified with tlsConfig, which may also set
+// the identity of the client.
+func NewClient(protocol Protocol, endpoint string, tlsConfig *tls.Config) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint %q must be http or https", endpoint)
+	}
+
+	secure := u.Scheme == "https"
+	if secure && tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if !secure {
+		tlsConfig = nil
+	}
+
+	c := &Client{protocol: protocol}
+	if protocol == ProtocolGRPC {
+		c.url = grpcclient.URL(u.Host, secure, exportMethod)
+		c.client = grpcclient.NewHTTPClient(tlsConfig)
+		return c, nil
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + exportPath
+	c.url = u.String()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c.client = &http.Client{Transport: transport}
+
+	return c, nil
+}
+
+// Export sends r to the receiver. Errors that must not be retried wrap
+// ErrPermanent.
+func (c *Client) Export(ctx context.Context, r *Request) error {
+	var (
+		resp []byte
+		err  error
+	)
+	if c.protocol == ProtocolGRPC {
+		resp, err = c.exportGRPC(ctx, r.Marshal())
+	} else {
+		resp, err = c.exportHTTP(ctx, r.Marshal())
+	}
+	if err != nil {
+		return err
+	}
+
+	rejected, message, err := unmarshalPartialSuccess(resp)
+	if err != nil {
+		return fmt.Errorf("%w: invalid response: %w", ErrPermanent, err)
+	}
+
+	if rejected > 0 || message != "" {
+		return &PartialSuccessError{Rejected: rejected, Message: message}
+	}
+
+	return nil
+}
+
+func (c *Client) exportGRPC(ctx context.Context, msg []byte) ([]byte, error) {
+	resp, err := grpcclient.Invoke(ctx, c.client, c.url, msg)
+
+	var status *grpcclient.StatusError
+	if errors.As(err, &status) && !status.Retryable() {
+		return nil, fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	return resp, err
+}
+
+func (c *Client) exportHTTP(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return body, nil
+	case resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusGatewayTimeout:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return nil, fmt.Errorf("%w: unexpected status %s", ErrPermanent, resp.Status)
+	}
+}
@@ -0,0 +1,102 @@
+package otlp_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+
+	"code.cloudfoundry.org/service-metrics-release/otlp"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	request := &otlp.Request{
+		Resource: map[string]string{"service.name": "my-origin"},
+		Scope:    "service-metrics",
+		Metrics: []otlp.Metric{{
+			Name:   "memory",
+			Type:   otlp.TypeGauge,
+			Points: []otlp.Point{{Time: 1000, Value: 10}},
+		}},
+	}
+
+	It("parses the protocol", func() {
+		Expect(otlp.ParseProtocol("grpc")).To(Equal(otlp.ProtocolGRPC))
+		Expect(otlp.ParseProtocol("http/protobuf")).To(Equal(otlp.ProtocolHTTP))
+
+		_, err := otlp.ParseProtocol("http/json")
+		Expect(err).To(MatchError(ContainSubstring(`unknown protocol "http/json"`)))
+	})
+
+	It("requires an http or https endpoint", func() {
+		_, err := otlp.NewClient(otlp.ProtocolGRPC, "localhost:4317", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	for _, protocol := range []otlp.Protocol{otlp.ProtocolGRPC, otlp.ProtocolHTTP} {
+		Context("over "+string(protocol), func() {
+			var (
+				receiver *fakeReceiver
+				client   *otlp.Client
+			)
+
+			BeforeEach(func() {
+				receiver = newFakeReceiver(false)
+				DeferCleanup(receiver.close)
+
+				var err error
+				client, err = otlp.NewClient(protocol, receiver.url(), nil)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("exports the request", func() {
+				Expect(client.Export(context.Background(), request)).To(Succeed())
+				Expect(receiver.received()).To(Equal([]*otlp.Request{request}))
+			})
+
+			It("exports over TLS to https endpoints", func() {
+				secure := newFakeReceiver(true)
+				DeferCleanup(secure.close)
+
+				pool := x509.NewCertPool()
+				pool.AddCert(secure.server.Certificate())
+
+				client, err := otlp.NewClient(protocol, secure.url(), &tls.Config{RootCAs: pool})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(client.Export(context.Background(), request)).To(Succeed())
+				Expect(secure.received()).To(Equal([]*otlp.Request{request}))
+			})
+
+			It("returns retryable errors when the receiver is unavailable", func() {
+				receiver.fail(1)
+
+				err := client.Export(context.Background(), request)
+				Expect(err).To(HaveOccurred())
+				Expect(errors.Is(err, otlp.ErrPermanent)).To(BeFalse())
+			})
+
+			It("returns permanent errors when the receiver rejects the request", func() {
+				receiver.reject("3", http.StatusBadRequest)
+
+				err := client.Export(context.Background(), request)
+				Expect(err).To(MatchError(otlp.ErrPermanent))
+			})
+
+			It("returns the data points the receiver rejected", func() {
+				receiver.rejectPoints(2)
+
+				err := client.Export(context.Background(), request)
+
+				var partial *otlp.PartialSuccessError
+				Expect(errors.As(err, &partial)).To(BeTrue())
+				Expect(partial.Rejected).To(BeEquivalentTo(2))
+				Expect(partial.Message).To(Equal("points rejected"))
+			})
+		})
+	}
+})
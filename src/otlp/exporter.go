@@ -0,0 +1,282 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+// exportTimeout bounds every export, so that an unresponsive receiver is
+// retried like one that is unavailable.
+const exportTimeout = 10 * time.Second
+
+// scope is the instrumentation scope of the exported metrics.
+const scope = "service-metrics"
+
+// Exporter is a metrics.Sink that keeps the state of every series it
+// records and exports all of them on every interval. Gauges are exported as
+// OTLP gauges, counters as monotonic sums and histograms as histograms, all
+// cumulative from the time a series was first recorded. The "unit" label of
+// a gauge is its unit. Since every export carries the full state, an export
+// that failed is retried with exponential backoff with the state at that
+// time, and nothing is lost. It is safe for concurrent use.
+type Exporter struct {
+	client   *Client
+	logger   lager.Logger
+	resource map[string]string
+
+	interval   time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	onError func(error)
+
+	mu     sync.Mutex
+	series *metrics.CumulativeStore
+
+	stop chan struct{}
+	done chan struct{}
+	// stopCtx bounds the last export, it is set before stop is closed.
+	stopCtx context.Context
+}
+
+// ExporterOption configures optional Exporter behaviour.
+type ExporterOption func(*Exporter)
+
+// WithResource sets the attributes of the resource every metric is
+// exported for, such as service.name.
+func WithResource(attrs map[string]string) ExporterOption {
+	return func(e *Exporter) {
+		e.resource = attrs
+	}
+}
+
+// WithInterval sets how often the metrics are exported, 1 minute by
+// default.
+func WithInterval(d time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.interval = d
+	}
+}
+
+// WithBackoff sets the delay before the first retry of a failed export,
+// which doubles with every retry up to max. It is 1 second up to 1 minute by
+// default.
+func WithBackoff(min, max time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.minBackoff, e.maxBackoff = min, max
+	}
+}
+
+// WithErrorHandler sets a function that is called with the error of every
+// export that failed, including the ones that partially succeeded.
+func WithErrorHandler(f func(error)) ExporterOption {
+	return func(e *Exporter) {
+		e.onError = f
+	}
+}
+
+func NewExporter(c *Client, logger lager.Logger, opts ...ExporterOption) *Exporter {
+	e := &Exporter{
+		client:     c,
+		logger:     logger,
+		interval:   time.Minute,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		onError:    func(error) {},
+		series:     metrics.NewCumulativeStore(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(e)
+	}
+
+	return e
+}
+
+func (e *Exporter) SetGauge(s metrics.Series, value float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.series.SetGauge(s, value)
+}
+
+func (e *Exporter) AddCounter(s metrics.Series, delta float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.series.AddCounter(s, delta)
+}
+
+func (e *Exporter) ObserveHistogram(s metrics.Series, buckets []float64, value float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.series.ObserveHistogram(s, buckets, value)
+}
+
+func (e *Exporter) AddHistogramCounts(s metrics.Series, buckets []float64, counts []uint64, sum float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.series.AddHistogramCounts(s, buckets, counts, sum)
+}
+
+func (e *Exporter) DeleteSeries(s metrics.Series) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.series.Delete(s)
+}
+
+// Start starts exporting the metrics on every interval.
+func (e *Exporter) Start() {
+	go e.run()
+}
+
+// Stop stops exporting and makes a last attempt to export the metrics,
+// which is abandoned once ctx is done.
+func (e *Exporter) Stop(ctx context.Context) {
+	e.stopCtx = ctx
+	close(e.stop)
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+
+	timer := time.NewTimer(e.interval)
+	defer timer.Stop()
+
+	var backoff time.Duration
+	for {
+		select {
+		case <-timer.C:
+		case <-e.stop:
+			e.export(e.stopCtx)
+			return
+		}
+
+		if e.export(context.Background()) {
+			backoff = 0
+			timer.Reset(e.interval)
+			continue
+		}
+
+		backoff = min(max(2*backoff, e.minBackoff), e.maxBackoff)
+		e.logger.Info("exporting-otlp-metrics", lager.Data{
+			"event":    "retrying",
+			"retry_in": backoff.String(),
+		})
+		timer.Reset(backoff)
+	}
+}
+
+// export exports the current state of every series and reports whether the
+// export is done, which it also is when it must not be retried.
+func (e *Exporter) export(ctx context.Context) bool {
+	r := e.request()
+
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	err := e.client.Export(ctx, r)
+	cancel()
+
+	if err != nil {
+		e.onError(err)
+	}
+
+	var partial *PartialSuccessError
+	switch {
+	case err == nil:
+		e.logger.Debug("exporting-otlp-metrics", lager.Data{
+			"metrics": len(r.Metrics),
+		})
+		return true
+	case errors.As(err, &partial), errors.Is(err, ErrPermanent):
+		e.logger.Error("exporting-otlp-metrics", err, lager.Data{
+			"event": "dropped",
+		})
+		return true
+	default:
+		e.logger.Error("exporting-otlp-metrics", err)
+		return false
+	}
+}
+
+// request returns a request with a data point for every series, grouped
+// into metrics by name and unit.
+func (e *Exporter) request() *Request {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := uint64(time.Now().UnixNano())
+
+	r := &Request{Resource: e.resource, Scope: scope}
+	metricIndex := make(map[string]int)
+	for _, s := range e.series.Series() {
+		attrs, unit := attributes(s)
+
+		name := s.Series.Name + "," + unit
+		i, ok := metricIndex[name]
+		if !ok {
+			i = len(r.Metrics)
+			metricIndex[name] = i
+			r.Metrics = append(r.Metrics, Metric{
+				Name:        s.Series.Name,
+				Description: s.Series.Help,
+				Unit:        unit,
+				Type:        metricTypes[s.Kind],
+			})
+		}
+
+		p := Point{Attributes: attrs, StartTime: uint64(s.Start.UnixNano()), Time: now}
+		switch s.Kind {
+		case metrics.CumulativeHistogram:
+			p.Count, p.Sum = s.Count, s.Sum
+			p.Bounds = s.Bounds
+			p.BucketCounts = append([]uint64(nil), s.BucketCounts...)
+		case metrics.CumulativeGauge:
+			p.StartTime = 0
+			p.Value = s.Value
+		default:
+			p.Value = s.Value
+		}
+		r.Metrics[i].Points = append(r.Metrics[i].Points, p)
+	}
+
+	return r
+}
+
+// metricTypes are the types series of each kind are exported as.
+var metricTypes = map[metrics.CumulativeKind]MetricType{
+	metrics.CumulativeGauge:     TypeGauge,
+	metrics.CumulativeCounter:   TypeSum,
+	metrics.CumulativeHistogram: TypeHistogram,
+}
+
+// attributes returns the attributes of the series and its unit, which is
+// the "unit" label of a gauge.
+func attributes(s *metrics.CumulativeSeries) (map[string]string, string) {
+	attrs := make(map[string]string, len(s.Series.Labels))
+	for k, v := range s.Series.Labels {
+		attrs[k] = v
+	}
+
+	var unit string
+	if s.Kind == metrics.CumulativeGauge {
+		unit = attrs["unit"]
+		delete(attrs, "unit")
+	}
+
+	return attrs, unit
+}
@@ -0,0 +1,230 @@
+package otlp_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"code.cloudfoundry.org/service-metrics-release/otlp"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Exporter", func() {
+	var (
+		receiver *fakeReceiver
+		client   *otlp.Client
+	)
+
+	BeforeEach(func() {
+		receiver = newFakeReceiver(false)
+		DeferCleanup(receiver.close)
+
+		var err error
+		client, err = otlp.NewClient(otlp.ProtocolHTTP, receiver.url(), nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	newExporter := func(opts ...otlp.ExporterOption) *otlp.Exporter {
+		opts = append([]otlp.ExporterOption{
+			otlp.WithInterval(10 * time.Millisecond),
+			otlp.WithBackoff(10*time.Millisecond, 20*time.Millisecond),
+		}, opts...)
+
+		return otlp.NewExporter(client, lager.NewLogger("test"), opts...)
+	}
+
+	It("exports gauges, counters and histograms for the resource", func() {
+		e := newExporter(otlp.WithResource(map[string]string{"service.name": "my-origin"}))
+
+		memory := metrics.Series{
+			Name:   "memory",
+			Help:   "Memory in use.",
+			Labels: map[string]string{"unit": "bytes", "pool": "heap"},
+		}
+		e.SetGauge(memory, 10)
+		e.SetGauge(memory, 15)
+
+		requests := metrics.Series{Name: "requests", Labels: map[string]string{"code": "200"}}
+		e.AddCounter(requests, 2.5)
+		e.AddCounter(requests, 1)
+
+		latency := metrics.Series{Name: "latency"}
+		e.ObserveHistogram(latency, []float64{1, 5}, 0.5)
+		e.ObserveHistogram(latency, []float64{1, 5}, 5)
+		e.ObserveHistogram(latency, []float64{1, 5}, 10)
+
+		e.Start()
+		Eventually(receiver.received).ShouldNot(BeEmpty())
+		e.Stop(context.Background())
+
+		r := receiver.received()[0]
+		Expect(r.Resource).To(Equal(map[string]string{"service.name": "my-origin"}))
+		Expect(r.Scope).To(Equal("service-metrics"))
+		Expect(r.Metrics).To(HaveLen(3))
+
+		h := r.Metrics[0]
+		Expect(h.Name).To(Equal("latency"))
+		Expect(h.Type).To(Equal(otlp.TypeHistogram))
+		Expect(h.Points).To(HaveLen(1))
+		Expect(h.Points[0].StartTime).To(BeNumerically(">", 0))
+		Expect(h.Points[0].Time).To(BeNumerically(">=", h.Points[0].StartTime))
+		Expect(h.Points[0].Count).To(BeEquivalentTo(3))
+		Expect(h.Points[0].Sum).To(Equal(15.5))
+		Expect(h.Points[0].Bounds).To(Equal([]float64{1, 5}))
+		Expect(h.Points[0].BucketCounts).To(Equal([]uint64{1, 1, 1}))
+
+		g := r.Metrics[1]
+		Expect(g.Name).To(Equal("memory"))
+		Expect(g.Description).To(Equal("Memory in use."))
+		Expect(g.Unit).To(Equal("bytes"))
+		Expect(g.Type).To(Equal(otlp.TypeGauge))
+		Expect(g.Points).To(HaveLen(1))
+		Expect(g.Points[0].Attributes).To(Equal(map[string]string{"pool": "heap"}))
+		Expect(g.Points[0].Value).To(Equal(15.0))
+
+		c := r.Metrics[2]
+		Expect(c.Name).To(Equal("requests"))
+		Expect(c.Type).To(Equal(otlp.TypeSum))
+		Expect(c.Points).To(HaveLen(1))
+		Expect(c.Points[0].Attributes).To(Equal(map[string]string{"code": "200"}))
+		Expect(c.Points[0].Value).To(Equal(3.5))
+	})
+
+	It("adds pre-aggregated bucket counts to histograms", func() {
+		e := newExporter()
+		latency := metrics.Series{Name: "latency"}
+		e.ObserveHistogram(latency, []float64{1, 5}, 0.5)
+		e.AddHistogramCounts(latency, []float64{1, 5}, []uint64{2000000, 3, 1}, 1000007)
+
+		e.Start()
+		Eventually(receiver.received).ShouldNot(BeEmpty())
+		e.Stop(context.Background())
+
+		p := receiver.received()[0].Metrics[0].Points[0]
+		Expect(p.Count).To(BeEquivalentTo(2000005))
+		Expect(p.Sum).To(Equal(1000007.5))
+		Expect(p.BucketCounts).To(Equal([]uint64{2000001, 3, 1}))
+	})
+
+	It("groups the series of a metric into its data points", func() {
+		e := newExporter()
+		e.SetGauge(metrics.Series{Name: "memory", Labels: map[string]string{"pool": "heap"}}, 1)
+		e.SetGauge(metrics.Series{Name: "memory", Labels: map[string]string{"pool": "stack"}}, 2)
+
+		e.Start()
+		Eventually(receiver.received).ShouldNot(BeEmpty())
+		e.Stop(context.Background())
+
+		r := receiver.received()[0]
+		Expect(r.Metrics).To(HaveLen(1))
+		Expect(r.Metrics[0].Points).To(HaveLen(2))
+	})
+
+	It("keeps counters cumulative across exports", func() {
+		e := newExporter()
+		requests := metrics.Series{Name: "requests"}
+		e.AddCounter(requests, 2)
+
+		e.Start()
+		Eventually(receiver.received).ShouldNot(BeEmpty())
+
+		e.AddCounter(requests, 3)
+		e.Stop(context.Background())
+
+		received := receiver.received()
+		first, last := received[0].Metrics[0].Points[0], received[len(received)-1].Metrics[0].Points[0]
+		Expect(first.Value).To(Equal(2.0))
+		Expect(last.Value).To(Equal(5.0))
+		Expect(last.StartTime).To(Equal(first.StartTime))
+	})
+
+	It("retries failed exports with backoff", func() {
+		receiver.fail(2)
+
+		e := newExporter()
+		e.SetGauge(metrics.Series{Name: "memory"}, 1)
+
+		e.Start()
+		DeferCleanup(e.Stop)
+
+		Eventually(receiver.received).ShouldNot(BeEmpty())
+		Expect(receiver.exports()).To(BeNumerically(">=", 3))
+	})
+
+	It("reports every failed export to the error handler", func() {
+		receiver.fail(2)
+
+		var failures atomic.Int32
+		e := newExporter(otlp.WithErrorHandler(func(error) {
+			failures.Add(1)
+		}))
+		e.SetGauge(metrics.Series{Name: "memory"}, 1)
+
+		e.Start()
+		DeferCleanup(e.Stop)
+
+		Eventually(receiver.received).ShouldNot(BeEmpty())
+		Expect(failures.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("does not retry exports the receiver rejected", func() {
+		receiver.reject("", http.StatusBadRequest)
+
+		e := newExporter(
+			otlp.WithInterval(50*time.Millisecond),
+			otlp.WithBackoff(time.Millisecond, time.Millisecond),
+		)
+		e.SetGauge(metrics.Series{Name: "memory"}, 1)
+
+		e.Start()
+		Eventually(receiver.exports).Should(Equal(1))
+		Consistently(receiver.exports, 30*time.Millisecond).Should(Equal(1))
+
+		receiver.reject("", 0)
+		e.Stop(context.Background())
+
+		Expect(receiver.received()).NotTo(BeEmpty())
+	})
+
+	It("stops exporting deleted series", func() {
+		e := newExporter(otlp.WithInterval(time.Hour))
+		memory := metrics.Series{Name: "memory"}
+		e.SetGauge(memory, 1)
+		e.SetGauge(metrics.Series{Name: "disk"}, 2)
+		e.DeleteSeries(memory)
+
+		e.Start()
+		e.Stop(context.Background())
+
+		Expect(receiver.received()).To(HaveLen(1))
+		Expect(receiver.received()[0].Metrics).To(HaveLen(1))
+		Expect(receiver.received()[0].Metrics[0].Name).To(Equal("disk"))
+	})
+
+	It("abandons the last export once the context of Stop is done", func() {
+		// The receiver accepts connections but never responds.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(l.Close)
+
+		client, err = otlp.NewClient(otlp.ProtocolHTTP, "http://"+l.Addr().String(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		e := newExporter(otlp.WithInterval(time.Hour))
+		e.SetGauge(metrics.Series{Name: "size"}, 1)
+		e.Start()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		e.Stop(ctx)
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+})
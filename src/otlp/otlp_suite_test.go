@@ -0,0 +1,201 @@
+package otlp_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"code.cloudfoundry.org/service-metrics-release/otlp"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestOTLP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "OTLP Suite")
+}
+
+// fakeReceiver is an in-process OTLP receiver that records the requests
+// exported to it over gRPC or HTTP.
+type fakeReceiver struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests []*otlp.Request
+	// attempts is the number of exports, including the refused ones.
+	attempts int
+	// failures is the number of exports still to be refused as unavailable.
+	failures int
+	// rejection is the gRPC status and HTTP status code every export is
+	// refused with, if set.
+	rejection struct {
+		grpcStatus string
+		httpStatus int
+	}
+	// rejected is the number of data points reported as rejected.
+	rejected int64
+}
+
+// newFakeReceiver starts a receiver over cleartext HTTP/1.1 and HTTP/2, or
+// over TLS if secure is true.
+func newFakeReceiver(secure bool) *fakeReceiver {
+	f := &fakeReceiver{}
+	f.server = httptest.NewUnstartedServer(f)
+	if secure {
+		f.server.EnableHTTP2 = true
+		f.server.StartTLS()
+		return f
+	}
+
+	f.server.Config.Protocols = new(http.Protocols)
+	f.server.Config.Protocols.SetHTTP1(true)
+	f.server.Config.Protocols.SetUnencryptedHTTP2(true)
+	f.server.Start()
+
+	return f
+}
+
+func (f *fakeReceiver) url() string {
+	return f.server.URL
+}
+
+func (f *fakeReceiver) close() {
+	f.server.Close()
+}
+
+func (f *fakeReceiver) fail(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = n
+}
+
+func (f *fakeReceiver) reject(grpcStatus string, httpStatus int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rejection.grpcStatus = grpcStatus
+	f.rejection.httpStatus = httpStatus
+}
+
+func (f *fakeReceiver) rejectPoints(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rejected = n
+}
+
+func (f *fakeReceiver) received() []*otlp.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*otlp.Request(nil), f.requests...)
+}
+
+func (f *fakeReceiver) exports() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.attempts
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+
+	Expect(r.Method).To(Equal(http.MethodPost))
+
+	body, err := io.ReadAll(r.Body)
+	Expect(err).NotTo(HaveOccurred())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.attempts++
+	switch r.URL.Path {
+	case "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export":
+		f.serveGRPC(w, r, body)
+	case "/v1/metrics":
+		f.serveHTTP(w, r, body)
+	default:
+		Fail("unexpected path " + r.URL.Path)
+	}
+}
+
+func (f *fakeReceiver) serveGRPC(w http.ResponseWriter, r *http.Request, body []byte) {
+	Expect(r.ProtoMajor).To(Equal(2))
+	Expect(r.Header.Get("Content-Type")).To(Equal("application/grpc"))
+	Expect(len(body)).To(BeNumerically(">=", 5))
+	Expect(binary.BigEndian.Uint32(body[1:5])).To(BeEquivalentTo(len(body) - 5))
+
+	w.Header().Set("Content-Type", "application/grpc")
+
+	status := f.rejection.grpcStatus
+	if f.failures > 0 {
+		f.failures--
+		status = "14"
+	}
+	if status != "" {
+		w.Header().Set("Grpc-Status", status)
+		w.Header().Set("Grpc-Message", "refused")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f.record(body[5:])
+
+	resp := f.response()
+	msg := make([]byte, 5, 5+len(resp))
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(resp)))
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(append(msg, resp...))
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+func (f *fakeReceiver) serveHTTP(w http.ResponseWriter, r *http.Request, body []byte) {
+	Expect(r.Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+
+	status := f.rejection.httpStatus
+	if f.failures > 0 {
+		f.failures--
+		status = http.StatusServiceUnavailable
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	f.record(body)
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(f.response())
+}
+
+func (f *fakeReceiver) record(msg []byte) {
+	req, err := otlp.Unmarshal(msg)
+	Expect(err).NotTo(HaveOccurred())
+	f.requests = append(f.requests, req)
+}
+
+// response returns an ExportMetricsServiceResponse, with a partial success
+// if data points are to be rejected.
+func (f *fakeReceiver) response() []byte {
+	if f.rejected == 0 {
+		return nil
+	}
+
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(f.rejected))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, "points rejected")
+
+	var resp []byte
+	resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+	return protowire.AppendBytes(resp, partial)
+}
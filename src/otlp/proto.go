@@ -0,0 +1,428 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Request is an OTLP ExportMetricsServiceRequest with a single resource and
+// instrumentation scope. Only the fields service metrics exports are
+// supported.
+type Request struct {
+	Resource map[string]string
+	Scope    string
+	Metrics  []Metric
+}
+
+type MetricType int
+
+const (
+	TypeGauge MetricType = iota
+	// TypeSum is a monotonic sum with cumulative temporality.
+	TypeSum
+	// TypeHistogram is a histogram with cumulative temporality.
+	TypeHistogram
+)
+
+type Metric struct {
+	Name        string
+	Description string
+	Unit        string
+	Type        MetricType
+	Points      []Point
+}
+
+// Point is a data point of a metric. Gauges and sums have a Value,
+// histograms a Count, a Sum and a BucketCount for each of their Bounds plus
+// one for the values above the highest bound.
+type Point struct {
+	Attributes map[string]string
+	// StartTime and Time are Unix times in nanoseconds.
+	StartTime uint64
+	Time      uint64
+
+	Value float64
+
+	Count        uint64
+	Sum          float64
+	BucketCounts []uint64
+	Bounds       []float64
+}
+
+// Field numbers of the OTLP metrics messages, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto.
+const (
+	requestResourceMetrics protowire.Number = 1
+
+	resourceMetricsResource protowire.Number = 1
+	resourceMetricsScope    protowire.Number = 2
+
+	resourceAttributes protowire.Number = 1
+
+	scopeMetricsScope   protowire.Number = 1
+	scopeMetricsMetrics protowire.Number = 2
+
+	scopeName protowire.Number = 1
+
+	metricName        protowire.Number = 1
+	metricDescription protowire.Number = 2
+	metricUnit        protowire.Number = 3
+	metricGauge       protowire.Number = 5
+	metricSum         protowire.Number = 7
+	metricHistogram   protowire.Number = 9
+
+	dataPoints             protowire.Number = 1
+	aggregationTemporality protowire.Number = 2
+	sumIsMonotonic         protowire.Number = 3
+
+	pointStartTime    protowire.Number = 2
+	pointTime         protowire.Number = 3
+	numberAsDouble    protowire.Number = 4
+	numberAttributes  protowire.Number = 7
+	histogramCount    protowire.Number = 4
+	histogramSum      protowire.Number = 5
+	histogramBuckets  protowire.Number = 6
+	histogramBounds   protowire.Number = 7
+	histogramAttrs    protowire.Number = 9
+	keyValueKey       protowire.Number = 1
+	keyValueValue     protowire.Number = 2
+	anyValueString    protowire.Number = 1
+	partialSuccess    protowire.Number = 1
+	partialRejected   protowire.Number = 1
+	partialErrMessage protowire.Number = 2
+
+	temporalityCumulative = 2
+)
+
+// Marshal encodes r as an ExportMetricsServiceRequest.
+func (r *Request) Marshal() []byte {
+	var resource []byte
+	for _, k := range sortedKeys(r.Resource) {
+		resource = appendMessage(resource, resourceAttributes, marshalKeyValue(k, r.Resource[k]))
+	}
+
+	var scope []byte
+	scope = appendMessage(scope, scopeMetricsScope, appendString(nil, scopeName, r.Scope))
+	for _, m := range r.Metrics {
+		scope = appendMessage(scope, scopeMetricsMetrics, m.marshal())
+	}
+
+	var rm []byte
+	rm = appendMessage(rm, resourceMetricsResource, resource)
+	rm = appendMessage(rm, resourceMetricsScope, scope)
+
+	return appendMessage(nil, requestResourceMetrics, rm)
+}
+
+func (m *Metric) marshal() []byte {
+	var b []byte
+	b = appendString(b, metricName, m.Name)
+	b = appendString(b, metricDescription, m.Description)
+	b = appendString(b, metricUnit, m.Unit)
+
+	var data []byte
+	for _, p := range m.Points {
+		if m.Type == TypeHistogram {
+			data = appendMessage(data, dataPoints, p.marshalHistogram())
+		} else {
+			data = appendMessage(data, dataPoints, p.marshalNumber())
+		}
+	}
+
+	switch m.Type {
+	case TypeGauge:
+		return appendMessage(b, metricGauge, data)
+	case TypeSum:
+		data = appendVarint(data, aggregationTemporality, temporalityCumulative)
+		data = appendVarint(data, sumIsMonotonic, 1)
+		return appendMessage(b, metricSum, data)
+	default:
+		data = appendVarint(data, aggregationTemporality, temporalityCumulative)
+		return appendMessage(b, metricHistogram, data)
+	}
+}
+
+func (p *Point) marshalNumber() []byte {
+	var b []byte
+	b = appendFixed64(b, pointStartTime, p.StartTime)
+	b = appendFixed64(b, pointTime, p.Time)
+	b = appendFixed64(b, numberAsDouble, math.Float64bits(p.Value))
+	for _, k := range sortedKeys(p.Attributes) {
+		b = appendMessage(b, numberAttributes, marshalKeyValue(k, p.Attributes[k]))
+	}
+
+	return b
+}
+
+func (p *Point) marshalHistogram() []byte {
+	var b []byte
+	b = appendFixed64(b, pointStartTime, p.StartTime)
+	b = appendFixed64(b, pointTime, p.Time)
+	b = appendFixed64(b, histogramCount, p.Count)
+	b = appendFixed64(b, histogramSum, math.Float64bits(p.Sum))
+
+	var counts []byte
+	for _, c := range p.BucketCounts {
+		counts = protowire.AppendFixed64(counts, c)
+	}
+	b = appendMessage(b, histogramBuckets, counts)
+
+	var bounds []byte
+	for _, bound := range p.Bounds {
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(bound))
+	}
+	b = appendMessage(b, histogramBounds, bounds)
+
+	for _, k := range sortedKeys(p.Attributes) {
+		b = appendMessage(b, histogramAttrs, marshalKeyValue(k, p.Attributes[k]))
+	}
+
+	return b
+}
+
+func marshalKeyValue(k, v string) []byte {
+	b := appendString(nil, keyValueKey, k)
+	return appendMessage(b, keyValueValue, appendString(nil, anyValueString, v))
+}
+
+// Unmarshal decodes an ExportMetricsServiceRequest, merging the attributes
+// and metrics of all its resources and scopes. Attributes that are not
+// strings are skipped.
+func Unmarshal(b []byte) (*Request, error) {
+	r := &Request{}
+
+	err := consumeMessages(b, requestResourceMetrics, func(rm []byte) error {
+		return consumeFields(rm, func(num protowire.Number, v []byte) error {
+			switch num {
+			case resourceMetricsResource:
+				return consumeMessages(v, resourceAttributes, func(kv []byte) error {
+					return unmarshalKeyValue(kv, &r.Resource)
+				})
+			case resourceMetricsScope:
+				return consumeFields(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case scopeMetricsScope:
+						return consumeMessages(v, scopeName, func(name []byte) error {
+							r.Scope = string(name)
+							return nil
+						})
+					case scopeMetricsMetrics:
+						m, err := unmarshalMetric(v)
+						if err != nil {
+							return err
+						}
+						r.Metrics = append(r.Metrics, m)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+
+	return r, err
+}
+
+func unmarshalMetric(b []byte) (Metric, error) {
+	var m Metric
+	err := consumeFields(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case metricName:
+			m.Name = string(v)
+		case metricDescription:
+			m.Description = string(v)
+		case metricUnit:
+			m.Unit = string(v)
+		case metricGauge, metricSum, metricHistogram:
+			m.Type = map[protowire.Number]MetricType{
+				metricGauge:     TypeGauge,
+				metricSum:       TypeSum,
+				metricHistogram: TypeHistogram,
+			}[num]
+			return consumeMessages(v, dataPoints, func(dp []byte) error {
+				p, err := unmarshalPoint(dp, m.Type == TypeHistogram)
+				if err != nil {
+					return err
+				}
+				m.Points = append(m.Points, p)
+				return nil
+			})
+		}
+		return nil
+	})
+
+	return m, err
+}
+
+func unmarshalPoint(b []byte, histogram bool) (Point, error) {
+	var p Point
+	err := consumeFields(b, func(num protowire.Number, v []byte) error {
+		switch {
+		case num == pointStartTime:
+			p.StartTime = fixed64(v)
+		case num == pointTime:
+			p.Time = fixed64(v)
+		case !histogram && num == numberAsDouble:
+			p.Value = math.Float64frombits(fixed64(v))
+		case !histogram && num == numberAttributes, histogram && num == histogramAttrs:
+			return unmarshalKeyValue(v, &p.Attributes)
+		case histogram && num == histogramCount:
+			p.Count = fixed64(v)
+		case histogram && num == histogramSum:
+			p.Sum = math.Float64frombits(fixed64(v))
+		case histogram && num == histogramBuckets:
+			for ; len(v) >= 8; v = v[8:] {
+				p.BucketCounts = append(p.BucketCounts, fixed64(v))
+			}
+		case histogram && num == histogramBounds:
+			for ; len(v) >= 8; v = v[8:] {
+				p.Bounds = append(p.Bounds, math.Float64frombits(fixed64(v)))
+			}
+		}
+		return nil
+	})
+
+	return p, err
+}
+
+// unmarshalKeyValue adds a string attribute to into, which is allocated by
+// the first one.
+func unmarshalKeyValue(b []byte, into *map[string]string) error {
+	var (
+		key, value string
+		isString   bool
+	)
+	err := consumeFields(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case keyValueKey:
+			key = string(v)
+		case keyValueValue:
+			return consumeMessages(v, anyValueString, func(s []byte) error {
+				value, isString = string(s), true
+				return nil
+			})
+		}
+		return nil
+	})
+
+	if isString {
+		if *into == nil {
+			*into = make(map[string]string)
+		}
+		(*into)[key] = value
+	}
+
+	return err
+}
+
+// unmarshalPartialSuccess returns the data points an
+// ExportMetricsServiceResponse reports as rejected and why.
+func unmarshalPartialSuccess(b []byte) (int64, string, error) {
+	var (
+		rejected int64
+		message  string
+	)
+	err := consumeMessages(b, partialSuccess, func(ps []byte) error {
+		return consumeFields(ps, func(num protowire.Number, v []byte) error {
+			switch num {
+			case partialRejected:
+				n, _ := protowire.ConsumeVarint(v)
+				rejected = int64(n)
+			case partialErrMessage:
+				message = string(v)
+			}
+			return nil
+		})
+	})
+
+	return rejected, message, err
+}
+
+// consumeFields calls f with the number and value of each field in b. The
+// value of a length-delimited field is its contents, the value of any other
+// field is its encoding.
+func consumeFields(b []byte, f func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid field tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v []byte
+		if typ == protowire.BytesType {
+			v, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := f(num, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// consumeMessages calls f with the value of every field num in b.
+func consumeMessages(b []byte, num protowire.Number, f func([]byte) error) error {
+	return consumeFields(b, func(n protowire.Number, v []byte) error {
+		if n != num {
+			return nil
+		}
+		return f(v)
+	})
+}
+
+func fixed64(v []byte) uint64 {
+	if len(v) < 8 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint64(v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,60 @@
+package otlp_test
+
+import (
+	"code.cloudfoundry.org/service-metrics-release/otlp"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request", func() {
+	It("unmarshals the request it marshals", func() {
+		r := &otlp.Request{
+			Resource: map[string]string{"service.name": "my-origin", "bosh.index": "0"},
+			Scope:    "service-metrics",
+			Metrics: []otlp.Metric{
+				{
+					Name:        "memory",
+					Description: "Memory in use.",
+					Unit:        "bytes",
+					Type:        otlp.TypeGauge,
+					Points: []otlp.Point{
+						{Attributes: map[string]string{"pool": "heap"}, Time: 2000, Value: 1.5},
+						{Attributes: map[string]string{"pool": "stack"}, Time: 2000, Value: -3},
+					},
+				},
+				{
+					Name: "requests",
+					Type: otlp.TypeSum,
+					Points: []otlp.Point{
+						{StartTime: 1000, Time: 2000, Value: 42},
+					},
+				},
+				{
+					Name: "latency",
+					Type: otlp.TypeHistogram,
+					Points: []otlp.Point{
+						{
+							Attributes:   map[string]string{"route": "/"},
+							StartTime:    1000,
+							Time:         2000,
+							Count:        3,
+							Sum:          7.5,
+							Bounds:       []float64{1, 5},
+							BucketCounts: []uint64{1, 1, 1},
+						},
+					},
+				},
+			},
+		}
+
+		Expect(otlp.Unmarshal(r.Marshal())).To(Equal(r))
+	})
+
+	It("fails to unmarshal truncated requests", func() {
+		b := (&otlp.Request{Scope: "service-metrics"}).Marshal()
+
+		_, err := otlp.Unmarshal(b[:len(b)-1])
+		Expect(err).To(HaveOccurred())
+	})
+})
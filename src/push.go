@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+// pushCollector is the collector name the self-instrumentation of pushed
+// metrics is labelled with.
+const pushCollector = "push"
+
+// maxPushSize is the largest body that can be pushed.
+const maxPushSize = 4 * 1024 * 1024
+
+// pushServer records the metrics co-located services POST to /metrics as a
+// JSON array or as NDJSON, with the same validation and sanitization as the
+// output of the metrics commands.
+type pushServer struct {
+	servers []*http.Server
+
+	// processor is not safe for concurrent use, so pushes are recorded one
+	// at a time.
+	mu        sync.Mutex
+	processor metrics.Processor
+}
+
+// startPush starts accepting pushed metrics on the configured address and
+// unix domain socket, if any.
+func startPush(logger lager.Logger, m metrics.Sink, signatures *metrics.Signatures) (*pushServer, error) {
+	logger = logger.WithData(lager.Data{"collector": pushCollector})
+
+	s := &pushServer{
+		// The processor only records pushed batches and never runs a
+		// command, so it has no executor.
+		processor: metrics.NewProcessor(
+			logger,
+			m,
+			nil,
+			metrics.WithFormat(metrics.FormatAuto),
+			metrics.WithRelabelRules(cfg.relabelRules(collectorConfig{Name: pushCollector})),
+			metrics.WithSignatures(signatures),
+			metrics.WithInstrumentation(pushCollector),
+		),
+	}
+
+	var listeners []net.Listener
+	if cfg.PushAddress != "" {
+		l, err := net.Listen("tcp", cfg.PushAddress)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	if cfg.PushSocket != "" {
+		l, err := listenUnix(cfg.PushSocket)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s)
+
+	for _, l := range listeners {
+		server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		s.servers = append(s.servers, server)
+
+		logger.Info("accepting-pushed-metrics", lager.Data{
+			"address": l.Addr().String(),
+		})
+
+		go func() {
+			if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+				logger.Error("accepting-pushed-metrics", err)
+			}
+		}()
+	}
+
+	return s, nil
+}
+
+// pushSocketMode is the mode of the push socket, which only the user and
+// group of the process can connect to whatever its umask.
+const pushSocketMode = 0o660
+
+// listenUnix listens on a unix domain socket at path, replacing the socket
+// left behind by a previous process.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, pushSocketMode); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// stop stops accepting pushed metrics once the pushes in flight have been
+// recorded, or abandons them once ctx is done.
+func (s *pushServer) stop(ctx context.Context) {
+	for _, server := range s.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			_ = server.Close()
+		}
+	}
+}
+
+func (s *pushServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPushSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only JSON is accepted, the Prometheus text format reports cumulative
+	// totals that cannot be told apart between the services pushing them.
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("[")) && !bytes.HasPrefix(trimmed, []byte("{")) {
+		http.Error(w, "body must be a JSON array of metric entries or NDJSON", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s.mu.Lock()
+	err = s.processor.ProcessBatch(body)
+	s.mu.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	egress "code.cloudfoundry.org/go-metric-registry"
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pushServer", func() {
+	var (
+		reg    *metrics.PrometheusRegistry
+		socket string
+		push   *pushServer
+	)
+
+	BeforeEach(func() {
+		cfg = defaultConfig()
+		reg = metrics.NewPrometheusRegistry()
+		socket = filepath.Join(GinkgoT().TempDir(), "push.sock")
+	})
+
+	AfterEach(func() {
+		if push != nil {
+			push.stop(context.Background())
+			push = nil
+		}
+	})
+
+	start := func() error {
+		var err error
+		push, err = startPush(lager.NewLogger("test"), metrics.NewRegistrySink(reg), metrics.NewSignatures())
+
+		return err
+	}
+
+	gauge := func(name string) float64 {
+		families, err := reg.Gather()
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, f := range families {
+			if f.GetName() == name {
+				return f.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+
+		Fail("no metric named " + name)
+		return 0
+	}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		push.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", strings.NewReader(body)))
+
+		return rec
+	}
+
+	Describe("the unix domain socket", func() {
+		BeforeEach(func() {
+			cfg.PushSocket = socket
+		})
+
+		It("records the metrics POSTed to it", func() {
+			Expect(start()).To(Succeed())
+
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			}}
+			resp, err := client.Post("http://push/metrics", "application/json", strings.NewReader(`[{"key": "size", "value": 3, "unit": "bytes"}]`))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+			Expect(gauge("size")).To(Equal(3.0))
+		})
+
+		It("is only accessible to the user and group whatever the umask", func() {
+			umask := syscall.Umask(0)
+			defer syscall.Umask(umask)
+
+			Expect(start()).To(Succeed())
+
+			info, err := os.Stat(socket)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Type()).To(Equal(os.ModeSocket))
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0o660)))
+		})
+
+		It("replaces the socket left behind by a previous process", func() {
+			l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+			Expect(err).NotTo(HaveOccurred())
+			l.SetUnlinkOnClose(false)
+			Expect(l.Close()).To(Succeed())
+			Expect(socket).To(BeAnExistingFile())
+
+			Expect(start()).To(Succeed())
+		})
+
+		It("does not remove a file that is not a socket", func() {
+			Expect(os.WriteFile(socket, []byte("data"), 0o600)).To(Succeed())
+
+			Expect(start()).NotTo(Succeed())
+			Expect(os.ReadFile(socket)).To(Equal([]byte("data")))
+		})
+	})
+
+	Describe("a push", func() {
+		BeforeEach(func() {
+			Expect(start()).To(Succeed())
+		})
+
+		It("records a JSON array or NDJSON", func() {
+			Expect(post(`[{"key": "size", "value": 3, "unit": "bytes"}]`).Code).To(Equal(http.StatusNoContent))
+			Expect(gauge("size")).To(Equal(3.0))
+
+			Expect(post("{\"key\": \"size\", \"value\": 4, \"unit\": \"bytes\"}\n").Code).To(Equal(http.StatusNoContent))
+			Expect(gauge("size")).To(Equal(4.0))
+		})
+
+		It("only accepts POST", func() {
+			rec := httptest.NewRecorder()
+			push.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			Expect(rec.Code).To(Equal(http.StatusMethodNotAllowed))
+			Expect(rec.Header().Get("Allow")).To(Equal(http.MethodPost))
+		})
+
+		It("rejects a body larger than the max", func() {
+			body := `[{"key": "size", "value": 3, "unit": "bytes"}]` + strings.Repeat(" ", maxPushSize)
+
+			Expect(post(body).Code).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+
+		It("accepts a body of the max size", func() {
+			entry := `[{"key": "size", "value": 3, "unit": "bytes"}]`
+			body := entry + strings.Repeat(" ", maxPushSize-len(entry))
+
+			Expect(post(body).Code).To(Equal(http.StatusNoContent))
+		})
+
+		It("rejects the Prometheus text format", func() {
+			Expect(post("size 3\n").Code).To(Equal(http.StatusUnsupportedMediaType))
+		})
+
+		It("rejects JSON that cannot be parsed", func() {
+			Expect(post(`[{"key": "size", "value": "three"}`).Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("skips entries named after the metrics service metrics exports about itself", func() {
+			Expect(post(`[
+				{"key": "size", "value": "three", "unit": "bytes"},
+				{"name": "service_metrics_rejected_entries", "delta": 1, "labels": {"reason": "other"}},
+				{"key": "service_metrics_modified_metric_names", "value": 1, "unit": "count"}
+			]`).Code).To(Equal(http.StatusNoContent))
+
+			families, err := reg.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			for _, f := range families {
+				if f.GetName() == "service_metrics_rejected_entries" {
+					Expect(f.GetMetric()).To(HaveLen(1))
+					Expect(f.GetMetric()[0].GetCounter().GetValue()).To(Equal(1.0))
+				}
+			}
+		})
+
+		It("skips entries of a series that cannot be registered alongside the metrics served", func() {
+			reg.NewCounter("size", "", egress.WithMetricLabels(map[string]string{"db": "one"})).Add(1)
+
+			Expect(post(`[{"key": "size", "value": 3, "unit": "bytes"}]`).Code).To(Equal(http.StatusNoContent))
+
+			families, err := reg.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			for _, f := range families {
+				if f.GetName() == "size" {
+					Expect(f.GetMetric()).To(HaveLen(1))
+					Expect(f.GetMetric()[0].GetCounter().GetValue()).To(Equal(1.0))
+				}
+			}
+		})
+	})
+})
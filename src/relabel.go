@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+// relabelConfig configures a relabel rule like a Prometheus
+// metric_relabel_config.
+type relabelConfig struct {
+	Action       string   `json:"action" yaml:"action"`
+	SourceLabels []string `json:"source_labels" yaml:"source_labels"`
+	Separator    *string  `json:"separator" yaml:"separator"`
+	Regex        *string  `json:"regex" yaml:"regex"`
+	TargetLabel  string   `json:"target_label" yaml:"target_label"`
+	Replacement  *string  `json:"replacement" yaml:"replacement"`
+	Modulus      uint64   `json:"modulus" yaml:"modulus"`
+}
+
+// relabelList is configured as a list in the configuration file, as a JSON
+// array of rules in the RELABEL_RULES environment variable, or as one JSON
+// object per --relabel-rule flag.
+type relabelList []relabelConfig
+
+// relabelList implements flag.Value
+func (r *relabelList) String() string {
+	if r == nil {
+		return "[]"
+	}
+
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// relabelList implements flag.Value
+func (r *relabelList) Set(value string) error {
+	var rule relabelConfig
+	if err := json.Unmarshal([]byte(value), &rule); err != nil {
+		return err
+	}
+
+	*r = append(*r, rule)
+
+	return nil
+}
+
+// relabelList implements envstruct.Unmarshaller
+func (r *relabelList) UnmarshalEnv(v string) error {
+	return json.Unmarshal([]byte(v), r)
+}
+
+// compileRelabelRules compiles the rules with the defaults of Prometheus:
+// the replace action, the ";" separator, the regex "(.*)" and the
+// replacement "$1". Rules are named after their position in the
+// configuration, prefixed by prefix.
+func compileRelabelRules(prefix string, configs []relabelConfig) ([]metrics.RelabelRule, error) {
+	rules := make([]metrics.RelabelRule, 0, len(configs))
+	for i, c := range configs {
+		name := fmt.Sprintf("%s[%d]", prefix, i)
+
+		rule, err := c.compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %s: %w", name, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (c relabelConfig) compile(name string) (metrics.RelabelRule, error) {
+	rule := metrics.RelabelRule{
+		Name:         name,
+		Action:       metrics.RelabelReplace,
+		SourceLabels: c.SourceLabels,
+		Separator:    ";",
+		TargetLabel:  c.TargetLabel,
+		Replacement:  "$1",
+		Modulus:      c.Modulus,
+	}
+
+	if c.Action != "" {
+		action, err := metrics.ParseRelabelAction(c.Action)
+		if err != nil {
+			return metrics.RelabelRule{}, err
+		}
+		rule.Action = action
+	}
+
+	if c.Separator != nil {
+		rule.Separator = *c.Separator
+	}
+
+	if c.Replacement != nil {
+		rule.Replacement = *c.Replacement
+	}
+
+	regex := "(.*)"
+	if c.Regex != nil {
+		regex = *c.Regex
+	}
+
+	// Like a Keep or Drop expression, the regex is anchored at both ends.
+	var err error
+	rule.Regex, err = regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return metrics.RelabelRule{}, err
+	}
+
+	switch rule.Action {
+	case metrics.RelabelKeep, metrics.RelabelDrop:
+		if len(rule.SourceLabels) == 0 {
+			return metrics.RelabelRule{}, fmt.Errorf("%s requires source_labels", rule.Action)
+		}
+	case metrics.RelabelReplace:
+		if rule.TargetLabel == "" {
+			return metrics.RelabelRule{}, errors.New("replace requires a target_label")
+		}
+	case metrics.RelabelHashMod:
+		if rule.TargetLabel == "" || rule.Modulus == 0 {
+			return metrics.RelabelRule{}, errors.New("hashmod requires a target_label and a positive modulus")
+		}
+	}
+
+	return rule, nil
+}
+
+// relabelRules returns the rules of the collector followed by the global
+// rules, which have been validated.
+func (c config) relabelRules(collector collectorConfig) []metrics.RelabelRule {
+	own, _ := compileRelabelRules(fmt.Sprintf("collectors[%s].relabel_rules", collector.Name), collector.RelabelRules)
+	global, _ := compileRelabelRules("relabel_rules", c.RelabelRules)
+
+	return append(own, global...)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/go-envstruct"
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"code.cloudfoundry.org/service-metrics-release/scheduler"
+)
+
+// run is a set of collectors running on their intervals.
+type run struct {
+	stop   chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// startRun runs the collectors until stop is closed. Their metrics commands
+// are killed when ctx is canceled, or when the run is stopped with stopBy.
+func startRun(ctx context.Context, collectors []*collector) *run {
+	var jobs []scheduler.Job
+	for _, c := range collectors {
+		jobs = append(jobs, c.job())
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &run{
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(r.done)
+		scheduler.New(jobs...).Run(ctx, r.stop)
+	}()
+
+	return r
+}
+
+// stopBy stops the run, giving the runs in flight until ctx is done to
+// finish before their metrics commands are killed, and reports whether they
+// were.
+func (r *run) stopBy(ctx context.Context) (killed bool) {
+	defer r.cancel()
+
+	close(r.stop)
+
+	select {
+	case <-r.done:
+		return false
+	case <-ctx.Done():
+		r.cancel()
+		<-r.done
+		return true
+	}
+}
+
+// reload re-reads the configuration and replaces the running collectors with
+// the ones it configures, once the runs in flight have finished or have been
+// killed after the shutdown grace period. The registry, and therefore every
+// exported metric, is kept. An invalid configuration is logged and rejected,
+// leaving the current collectors running.
+func reload(
+	ctx context.Context,
+	logger lager.Logger,
+	m metrics.Sink,
+	signatures *metrics.Signatures,
+	collectors []*collector,
+	r *run,
+) ([]*collector, *run) {
+	action := "reloading-config"
+
+	next, err := reloadConfig()
+	if err != nil {
+		logger.Error(action, err, lager.Data{
+			"event": "rejected",
+		})
+		return collectors, r
+	}
+
+	if settings := cfg.restartRequired(next); len(settings) > 0 {
+		logger.Info(action, lager.Data{
+			"event":    "restart-required",
+			"settings": settings,
+		})
+		next = next.withRestartSettingsOf(cfg)
+	}
+
+	// A metrics command that hangs must not keep every collector stopped,
+	// so the runs in flight only get the shutdown grace period to finish.
+	graceCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	defer cancel()
+
+	if r.stopBy(graceCtx) {
+		logger.Info(action, lager.Data{
+			"event":        "canceled-metrics-cmd",
+			"grace_period": cfg.ShutdownGracePeriod.String(),
+		})
+	}
+
+	cfg = next
+	collectors = newCollectors(cfg.collectors(), collectors, logger, m, signatures)
+
+	var names []string
+	for _, c := range collectors {
+		names = append(names, c.config.Name)
+	}
+
+	logger.Info(action, lager.Data{
+		"event":      "done",
+		"collectors": names,
+	})
+
+	if err := envstruct.WriteReport(&cfg); err != nil {
+		logger.Error(action, err, lager.Data{
+			"event": "writing-report",
+		})
+	}
+
+	return collectors, startRun(ctx, collectors)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("run", func() {
+	var started string
+
+	BeforeEach(func() {
+		cfg = defaultConfig()
+		started = filepath.Join(GinkgoT().TempDir(), "started")
+	})
+
+	startCollector := func(script string) *run {
+		c := newCollector(collectorConfig{
+			Name:     "test",
+			Command:  "/bin/sh",
+			Args:     []string{"-c", "touch " + started + "; " + script},
+			Interval: duration(time.Hour),
+		}, nil, lager.NewLogger("test"), metrics.NewRegistrySink(metrics.NewPrometheusRegistry()), metrics.NewSignatures())
+
+		r := startRun(context.Background(), []*collector{c})
+		Eventually(started).Should(BeAnExistingFile())
+
+		return r
+	}
+
+	It("lets the runs in flight finish within the grace period", func() {
+		r := startCollector("sleep 0.2; echo '[]'")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		Expect(r.stopBy(ctx)).To(BeFalse())
+	})
+
+	It("kills a metrics command that hangs once the grace period has expired", func() {
+		r := startCollector("sleep 30")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		Expect(r.stopBy(ctx)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+})
+
+var _ = Describe("reload", func() {
+	var (
+		logger     lager.Logger
+		logs       *logSink
+		m          metrics.Sink
+		signatures *metrics.Signatures
+		path       string
+	)
+
+	BeforeEach(func() {
+		logger, logs = newTestLogger()
+		m = metrics.NewRegistrySink(metrics.NewPrometheusRegistry())
+		signatures = metrics.NewSignatures()
+		path = filepath.Join(GinkgoT().TempDir(), "config.yml")
+
+		DeferCleanup(func(args []string) { os.Args = args }, os.Args)
+		os.Args = []string{"service-metrics", "--config", path}
+	})
+
+	writeConfig := func(content string) {
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+	}
+
+	// start starts the collectors of the configuration file.
+	start := func() ([]*collector, *run) {
+		var err error
+		cfg, err = reloadConfig()
+		Expect(err).NotTo(HaveOccurred())
+
+		collectors := newCollectors(cfg.collectors(), nil, logger, m, signatures)
+		return collectors, startRun(context.Background(), collectors)
+	}
+
+	stop := func(r *run) {
+		close(r.stop)
+		Eventually(r.done).Should(BeClosed())
+	}
+
+	It("replaces the collectors and keeps the statistics of those that remain", func() {
+		writeConfig("max_consecutive_failures: 0\norigin: o\ncollectors:\n- {name: a, command: /bin/true, interval: 1h}\n")
+		collectors, r := start()
+		Eventually(func() int { return collectors[0].failures.runs }).Should(Equal(1))
+
+		writeConfig("max_consecutive_failures: 0\norigin: o\ncollectors:\n- {name: a, command: /bin/true, interval: 1h}\n- {name: b, command: /bin/true, interval: 1h}\n")
+		collectors, r = reload(context.Background(), logger, m, signatures, collectors, r)
+		defer stop(r)
+
+		Expect(collectors).To(HaveLen(2))
+		Expect(collectors[0].config.Name).To(Equal("a"))
+		Expect(collectors[1].config.Name).To(Equal("b"))
+		Eventually(func() int { return collectors[0].failures.runs }).Should(Equal(2))
+		Expect(logs.data("reloading-config")).To(ContainElement(HaveKeyWithValue("collectors", []string{"a", "b"})))
+	})
+
+	It("keeps the running collectors when the configuration is invalid", func() {
+		writeConfig("max_consecutive_failures: 0\norigin: o\ncollectors:\n- {name: a, command: /bin/true, interval: 1h}\n")
+		collectors, r := start()
+
+		writeConfig("max_consecutive_failures: 0\norigin: o\ncollectors:\n- {name: a, interval: 1h}\n")
+		next, nextRun := reload(context.Background(), logger, m, signatures, collectors, r)
+		defer stop(nextRun)
+
+		Expect(next).To(Equal(collectors))
+		Expect(nextRun).To(Equal(r))
+		Expect(logs.events("reloading-config")).To(Equal([]string{"rejected"}))
+	})
+
+	It("keeps the settings that require a restart", func() {
+		writeConfig("max_consecutive_failures: 0\norigin: o\nmetrics_cmd: /bin/true\n")
+		collectors, r := start()
+
+		writeConfig("max_consecutive_failures: 0\norigin: changed\nport: 9090\nmetrics_cmd: /bin/true\nmetrics_interval: 1s\n")
+		_, r = reload(context.Background(), logger, m, signatures, collectors, r)
+		defer stop(r)
+
+		Expect(cfg.Origin).To(Equal("o"))
+		Expect(cfg.Port).To(BeZero())
+		Expect(cfg.MetricsInterval).To(Equal(time.Second))
+		Expect(logs.data("reloading-config")).To(ContainElement(HaveKeyWithValue("settings", []string{"origin", "port"})))
+	})
+})
+
+var _ = Describe("config", func() {
+	// changed returns c with the field f set to a different value.
+	changed := func(c config, f reflect.StructField) config {
+		v := reflect.ValueOf(&c).Elem().FieldByIndex(f.Index)
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(v.String() + "changed")
+		case reflect.Int, reflect.Int64:
+			v.SetInt(v.Int() + 1)
+		case reflect.Bool:
+			v.SetBool(!v.Bool())
+		case reflect.Slice:
+			v.Set(reflect.Append(v, reflect.New(v.Type().Elem()).Elem()))
+		case reflect.Map:
+			m := reflect.MakeMap(v.Type())
+			m.SetMapIndex(reflect.ValueOf("changed"), reflect.ValueOf("changed"))
+			v.Set(m)
+		default:
+			Fail("unexpected kind of field " + f.Name)
+		}
+
+		return c
+	}
+
+	It("reports every setting that is not reloaded as requiring a restart", func() {
+		for _, f := range reflect.VisibleFields(reflect.TypeOf(config{})) {
+			next := changed(defaultConfig(), f)
+			settings := defaultConfig().restartRequired(next)
+
+			if f.Tag.Get("reload") == "true" {
+				Expect(settings).To(BeEmpty(), f.Name)
+				continue
+			}
+
+			Expect(settings).To(Equal([]string{strings.Split(f.Tag.Get("yaml"), ",")[0]}), f.Name)
+			Expect(defaultConfig().restartRequired(next.withRestartSettingsOf(defaultConfig()))).To(BeEmpty(), f.Name)
+		}
+	})
+
+	It("keeps the reloaded settings when restoring the others", func() {
+		next := defaultConfig()
+		next.Port = 9090
+		next.MetricsInterval = time.Second
+		next.OTLPResourceAttributes = stringMap{"a": "b"}
+
+		kept := next.withRestartSettingsOf(defaultConfig())
+		Expect(kept.Port).To(BeZero())
+		Expect(kept.OTLPResourceAttributes).To(BeEmpty())
+		Expect(kept.MetricsInterval).To(Equal(time.Second))
+	})
+})
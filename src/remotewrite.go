@@ -0,0 +1,48 @@
+package main
+
+import (
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/remotewrite"
+)
+
+// startRemoteWrite starts writing the metrics recorded in the returned writer
+// to the configured Prometheus remote write endpoint, calling onError with
+// every write that failed.
+func startRemoteWrite(logger lager.Logger, onError func(error)) (*remotewrite.Writer, error) {
+	tlsConfig, err := clientTLSConfig(cfg.RemoteWriteCAFile, cfg.RemoteWriteCertFile, cfg.RemoteWriteKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []remotewrite.ClientOption
+	switch {
+	case cfg.RemoteWriteBearerToken != "":
+		opts = append(opts, remotewrite.WithBearerToken(cfg.RemoteWriteBearerToken))
+	case cfg.RemoteWriteUsername != "":
+		opts = append(opts, remotewrite.WithBasicAuth(cfg.RemoteWriteUsername, cfg.RemoteWritePassword))
+	}
+
+	client, err := remotewrite.NewClient(cfg.RemoteWriteURL, tlsConfig, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := remotewrite.NewWriter(
+		client,
+		logger,
+		remotewrite.WithExternalLabels(cfg.RemoteWriteExternalLabels),
+		remotewrite.WithInterval(cfg.remoteWriteInterval()),
+		remotewrite.WithQueueSize(cfg.RemoteWriteQueueSize),
+		remotewrite.WithErrorHandler(onError),
+	)
+	writer.Start()
+
+	logger.Info("writing-remote-write-requests", lager.Data{
+		"url":             cfg.RemoteWriteURL,
+		"interval":        cfg.remoteWriteInterval().String(),
+		"queue_size":      cfg.RemoteWriteQueueSize,
+		"external_labels": cfg.RemoteWriteExternalLabels,
+	})
+
+	return writer, nil
+}
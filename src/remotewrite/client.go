@@ -0,0 +1,130 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// protocolVersion is the remote write protocol version sent in the
+	// X-Prometheus-Remote-Write-Version header.
+	protocolVersion = "0.1.0"
+
+	userAgent = "service-metrics"
+
+	// maxErrorBodySize is how much of the body of a failed response is
+	// included in its error.
+	maxErrorBodySize = 512
+)
+
+// ErrPermanent is wrapped by the errors of writes that must not be retried.
+var ErrPermanent = errors.New("write failed permanently")
+
+// Client writes series to a Prometheus remote write endpoint, such as
+// Prometheus with the remote write receiver enabled, Mimir or Thanos.
+type Client struct {
+	url    string
+	client *http.Client
+
+	username    string
+	password    string
+	bearerToken string
+}
+
+// ClientOption configures optional Client behaviour.
+type ClientOption func(*Client)
+
+// WithBasicAuth authenticates every write with username and password.
+func WithBasicAuth(username, password string) ClientOption {
+	return func(c *Client) {
+		c.username, c.password = username, password
+	}
+}
+
+// WithBearerToken authenticates every write with token.
+func WithBearerToken(token string) ClientOption {
+	return func(c *Client) {
+		c.bearerToken = token
+	}
+}
+
+// NewClient returns a client for the endpoint at rawURL. An https endpoint is
+// verified with tlsConfig, which may also set the identity of the client.
+func NewClient(rawURL string, tlsConfig *tls.Config, opts ...ClientOption) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url %q must be http or https", rawURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if u.Scheme == "https" {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	c := &Client{
+		url:    rawURL,
+		client: &http.Client{Transport: transport},
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c, nil
+}
+
+// Write sends r, snappy-compressed, to the endpoint. Errors that must not be
+// retried wrap ErrPermanent.
+func (c *Client) Write(ctx context.Context, r *WriteRequest) error {
+	body := snappy.Encode(nil, r.Marshal())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", protocolVersion)
+
+	switch {
+	case c.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+
+	// Like Prometheus, only server errors and rate limiting are retried.
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
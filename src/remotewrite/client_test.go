@@ -0,0 +1,79 @@
+package remotewrite_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"code.cloudfoundry.org/service-metrics-release/remotewrite"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var endpoint *fakeEndpoint
+
+	request := &remotewrite.WriteRequest{
+		Timeseries: []remotewrite.TimeSeries{{
+			Labels:  []remotewrite.Label{{Name: "__name__", Value: "memory"}},
+			Samples: []remotewrite.Sample{{Value: 10, Timestamp: 1000}},
+		}},
+	}
+
+	BeforeEach(func() {
+		endpoint = newFakeEndpoint()
+		DeferCleanup(endpoint.close)
+	})
+
+	It("requires an http or https url", func() {
+		_, err := remotewrite.NewClient("localhost:9090", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("writes the request", func() {
+		client, err := remotewrite.NewClient(endpoint.url(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(client.Write(context.Background(), request)).To(Succeed())
+		Expect(endpoint.received()).To(Equal([]*remotewrite.WriteRequest{request}))
+		Expect(endpoint.receivedHeaders()[0].Get("Authorization")).To(BeEmpty())
+	})
+
+	It("authenticates with basic auth", func() {
+		client, err := remotewrite.NewClient(endpoint.url(), nil, remotewrite.WithBasicAuth("user", "secret"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(client.Write(context.Background(), request)).To(Succeed())
+		Expect(endpoint.receivedHeaders()[0].Get("Authorization")).To(Equal("Basic dXNlcjpzZWNyZXQ="))
+	})
+
+	It("authenticates with a bearer token", func() {
+		client, err := remotewrite.NewClient(endpoint.url(), nil, remotewrite.WithBearerToken("token"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(client.Write(context.Background(), request)).To(Succeed())
+		Expect(endpoint.receivedHeaders()[0].Get("Authorization")).To(Equal("Bearer token"))
+	})
+
+	It("returns retryable errors when the endpoint is unavailable", func() {
+		endpoint.fail(1)
+
+		client, err := remotewrite.NewClient(endpoint.url(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = client.Write(context.Background(), request)
+		Expect(err).To(MatchError(ContainSubstring("503 Service Unavailable: refused")))
+		Expect(errors.Is(err, remotewrite.ErrPermanent)).To(BeFalse())
+	})
+
+	It("returns permanent errors when the endpoint rejects the request", func() {
+		endpoint.reject(http.StatusBadRequest)
+
+		client, err := remotewrite.NewClient(endpoint.url(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = client.Write(context.Background(), request)
+		Expect(err).To(MatchError(remotewrite.ErrPermanent))
+	})
+})
@@ -0,0 +1,182 @@
+package remotewrite
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// WriteRequest is a Prometheus remote write 1.0 WriteRequest. Only the
+// fields service metrics writes are supported.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is a series identified by its labels, including __name__,
+// which are sorted by name.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value at a Unix time in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// Field numbers of the remote write messages, see
+// https://github.com/prometheus/prometheus/blob/main/prompb/types.proto.
+const (
+	requestTimeseries protowire.Number = 1
+
+	seriesLabels  protowire.Number = 1
+	seriesSamples protowire.Number = 2
+
+	labelName  protowire.Number = 1
+	labelValue protowire.Number = 2
+
+	sampleValue     protowire.Number = 1
+	sampleTimestamp protowire.Number = 2
+)
+
+// Marshal returns the protobuf encoding of r.
+func (r *WriteRequest) Marshal() []byte {
+	var b []byte
+	for _, ts := range r.Timeseries {
+		var series []byte
+		for _, l := range ts.Labels {
+			var label []byte
+			label = appendString(label, labelName, l.Name)
+			label = appendString(label, labelValue, l.Value)
+			series = appendMessage(series, seriesLabels, label)
+		}
+		for _, s := range ts.Samples {
+			var sample []byte
+			sample = protowire.AppendTag(sample, sampleValue, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+			sample = protowire.AppendTag(sample, sampleTimestamp, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+			series = appendMessage(series, seriesSamples, sample)
+		}
+		b = appendMessage(b, requestTimeseries, series)
+	}
+
+	return b
+}
+
+// Unmarshal decodes a WriteRequest, ignoring the fields it does not support.
+func Unmarshal(b []byte) (*WriteRequest, error) {
+	r := &WriteRequest{}
+	err := consumeMessages(b, requestTimeseries, func(series []byte) error {
+		var ts TimeSeries
+		err := consumeFields(series, func(num protowire.Number, v []byte) error {
+			switch num {
+			case seriesLabels:
+				var l Label
+				err := consumeFields(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case labelName:
+						l.Name = string(v)
+					case labelValue:
+						l.Value = string(v)
+					}
+					return nil
+				})
+				ts.Labels = append(ts.Labels, l)
+				return err
+			case seriesSamples:
+				var s Sample
+				err := consumeFields(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case sampleValue:
+						s.Value = math.Float64frombits(fixed64(v))
+					case sampleTimestamp:
+						t, _ := protowire.ConsumeVarint(v)
+						s.Timestamp = int64(t)
+					}
+					return nil
+				})
+				ts.Samples = append(ts.Samples, s)
+				return err
+			}
+			return nil
+		})
+		r.Timeseries = append(r.Timeseries, ts)
+		return err
+	})
+
+	return r, err
+}
+
+// consumeFields calls f with the number and value of each field in b. The
+// value of a length-delimited field is its contents, the value of any other
+// field is its encoding.
+func consumeFields(b []byte, f func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid field tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v []byte
+		if typ == protowire.BytesType {
+			v, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := f(num, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// consumeMessages calls f with the value of every field num in b.
+func consumeMessages(b []byte, num protowire.Number, f func([]byte) error) error {
+	return consumeFields(b, func(n protowire.Number, v []byte) error {
+		if n != num {
+			return nil
+		}
+		return f(v)
+	})
+}
+
+func fixed64(v []byte) uint64 {
+	if len(v) < 8 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint64(v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
@@ -0,0 +1,39 @@
+package remotewrite_test
+
+import (
+	"code.cloudfoundry.org/service-metrics-release/remotewrite"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WriteRequest", func() {
+	It("unmarshals the request it marshals", func() {
+		r := &remotewrite.WriteRequest{
+			Timeseries: []remotewrite.TimeSeries{
+				{
+					Labels: []remotewrite.Label{
+						{Name: "__name__", Value: "memory"},
+						{Name: "pool", Value: "heap"},
+					},
+					Samples: []remotewrite.Sample{{Value: 1.5, Timestamp: 1700000000000}},
+				},
+				{
+					Labels:  []remotewrite.Label{{Name: "__name__", Value: "requests_total"}},
+					Samples: []remotewrite.Sample{{Value: -3, Timestamp: 1}},
+				},
+			},
+		}
+
+		Expect(remotewrite.Unmarshal(r.Marshal())).To(Equal(r))
+	})
+
+	It("fails to unmarshal truncated requests", func() {
+		b := (&remotewrite.WriteRequest{Timeseries: []remotewrite.TimeSeries{{
+			Labels: []remotewrite.Label{{Name: "__name__", Value: "memory"}},
+		}}}).Marshal()
+
+		_, err := remotewrite.Unmarshal(b[:len(b)-1])
+		Expect(err).To(HaveOccurred())
+	})
+})
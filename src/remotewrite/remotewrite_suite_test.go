@@ -0,0 +1,135 @@
+package remotewrite_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"code.cloudfoundry.org/service-metrics-release/remotewrite"
+	"github.com/golang/snappy"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Remote Write Suite")
+}
+
+// fakeEndpoint is an in-process remote write endpoint that records the
+// requests written to it.
+type fakeEndpoint struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests []*remotewrite.WriteRequest
+	headers  []http.Header
+	// attempts is the number of writes, including the refused ones.
+	attempts int
+	// failures is the number of writes still to be refused as unavailable.
+	failures int
+	// status is the status every write is refused with, if set.
+	status int
+}
+
+func newFakeEndpoint() *fakeEndpoint {
+	f := &fakeEndpoint{}
+	f.server = httptest.NewServer(f)
+
+	return f
+}
+
+func (f *fakeEndpoint) url() string {
+	return f.server.URL + "/api/v1/write"
+}
+
+func (f *fakeEndpoint) close() {
+	f.server.Close()
+}
+
+func (f *fakeEndpoint) fail(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = n
+}
+
+func (f *fakeEndpoint) reject(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.status = status
+}
+
+func (f *fakeEndpoint) writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.attempts
+}
+
+func (f *fakeEndpoint) received() []*remotewrite.WriteRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*remotewrite.WriteRequest(nil), f.requests...)
+}
+
+func (f *fakeEndpoint) receivedHeaders() []http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]http.Header(nil), f.headers...)
+}
+
+// series returns the series of every request received, in order.
+func (f *fakeEndpoint) series() []remotewrite.TimeSeries {
+	var series []remotewrite.TimeSeries
+	for _, r := range f.received() {
+		series = append(series, r.Timeseries...)
+	}
+
+	return series
+}
+
+func (f *fakeEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+
+	Expect(r.Method).To(Equal(http.MethodPost))
+	Expect(r.URL.Path).To(Equal("/api/v1/write"))
+	Expect(r.Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+	Expect(r.Header.Get("Content-Encoding")).To(Equal("snappy"))
+	Expect(r.Header.Get("X-Prometheus-Remote-Write-Version")).To(Equal("0.1.0"))
+
+	body, err := io.ReadAll(r.Body)
+	Expect(err).NotTo(HaveOccurred())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.attempts++
+
+	status := f.status
+	if f.failures > 0 {
+		f.failures--
+		status = http.StatusServiceUnavailable
+	}
+	if status != 0 {
+		http.Error(w, "refused", status)
+		return
+	}
+
+	msg, err := snappy.Decode(nil, body)
+	Expect(err).NotTo(HaveOccurred())
+
+	req, err := remotewrite.Unmarshal(msg)
+	Expect(err).NotTo(HaveOccurred())
+
+	f.requests = append(f.requests, req)
+	f.headers = append(f.headers, r.Header.Clone())
+
+	w.WriteHeader(http.StatusNoContent)
+}
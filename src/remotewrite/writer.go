@@ -0,0 +1,367 @@
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+const (
+	// writeTimeout bounds every write, so that an unresponsive endpoint is
+	// retried like one that is unavailable.
+	writeTimeout = 30 * time.Second
+
+	// maxSeriesPerRequest is the largest number of series written in one
+	// request.
+	maxSeriesPerRequest = 2000
+)
+
+// staleNaN is the value Prometheus marks a series that is gone with.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// Writer is a metrics.Sink that keeps the latest value of every series it
+// records and writes a sample of each of them to a remote write endpoint on
+// every interval. Counters are written with their total and histograms as
+// their _bucket, _sum and _count series, like they are served for
+// Prometheus. Deleted gauges are written once more as stale.
+//
+// The requests of every interval are queued until they are written, so that
+// the samples of an endpoint that is unavailable are written once it is back.
+// Failed writes are retried with exponential backoff. When the queue is full
+// the oldest request is dropped. It is safe for concurrent use.
+type Writer struct {
+	client *Client
+	logger lager.Logger
+
+	externalLabels map[string]string
+
+	interval   time.Duration
+	queueSize  int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	onError func(error)
+
+	mu     sync.Mutex
+	series *metrics.CumulativeStore
+	stale  [][]Label
+
+	queue []*WriteRequest
+
+	stop chan struct{}
+	done chan struct{}
+	// stopCtx bounds the last write, it is set before stop is closed.
+	stopCtx context.Context
+}
+
+// WriterOption configures optional Writer behaviour.
+type WriterOption func(*Writer)
+
+// WithExternalLabels adds labels to every series that does not have a label
+// with the same name, like the external labels of Prometheus.
+func WithExternalLabels(labels map[string]string) WriterOption {
+	return func(w *Writer) {
+		w.externalLabels = labels
+	}
+}
+
+// WithInterval sets how often the series are written, 1 minute by default.
+func WithInterval(d time.Duration) WriterOption {
+	return func(w *Writer) {
+		w.interval = d
+	}
+}
+
+// WithQueueSize sets the largest number of requests queued while the
+// endpoint cannot be written to, 100 by default.
+func WithQueueSize(n int) WriterOption {
+	return func(w *Writer) {
+		w.queueSize = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry of a failed write,
+// which doubles with every retry up to max. It is 1 second up to 1 minute by
+// default.
+func WithBackoff(min, max time.Duration) WriterOption {
+	return func(w *Writer) {
+		w.minBackoff, w.maxBackoff = min, max
+	}
+}
+
+// WithErrorHandler sets a function that is called with the error of every
+// write that failed.
+func WithErrorHandler(f func(error)) WriterOption {
+	return func(w *Writer) {
+		w.onError = f
+	}
+}
+
+func NewWriter(c *Client, logger lager.Logger, opts ...WriterOption) *Writer {
+	w := &Writer{
+		client:     c,
+		logger:     logger,
+		interval:   time.Minute,
+		queueSize:  100,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		onError:    func(error) {},
+		series:     metrics.NewCumulativeStore(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(w)
+	}
+
+	return w
+}
+
+func (w *Writer) SetGauge(s metrics.Series, value float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.series.SetGauge(s, value)
+}
+
+func (w *Writer) AddCounter(s metrics.Series, delta float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.series.AddCounter(s, delta)
+}
+
+func (w *Writer) ObserveHistogram(s metrics.Series, buckets []float64, value float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.series.ObserveHistogram(s, buckets, value)
+}
+
+func (w *Writer) AddHistogramCounts(s metrics.Series, buckets []float64, counts []uint64, sum float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.series.AddHistogramCounts(s, buckets, counts, sum)
+}
+
+func (w *Writer) DeleteSeries(s metrics.Series) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.series.Delete(s) {
+		w.stale = append(w.stale, w.labels(s.Name, s.Labels))
+	}
+}
+
+// labels returns the sorted labels of the series name, including its
+// external labels.
+func (w *Writer) labels(name string, labels map[string]string) []Label {
+	all := make(map[string]string, len(labels)+len(w.externalLabels)+1)
+	for k, v := range w.externalLabels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	all["__name__"] = name
+
+	sorted := make([]Label, 0, len(all))
+	for k, v := range all {
+		sorted = append(sorted, Label{Name: k, Value: v})
+	}
+	sortLabels(sorted)
+
+	return sorted
+}
+
+func sortLabels(labels []Label) {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+}
+
+// Start starts writing the series on every interval.
+func (w *Writer) Start() {
+	go w.run()
+}
+
+// Stop stops writing and makes a last attempt to write the queued requests
+// and the latest samples, which is abandoned once ctx is done.
+func (w *Writer) Stop(ctx context.Context) {
+	w.stopCtx = ctx
+	close(w.stop)
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+	}
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	retry := time.NewTimer(0)
+	<-retry.C
+	defer retry.Stop()
+
+	var backoff time.Duration
+	for {
+		select {
+		case <-ticker.C:
+			w.enqueue(w.snapshot())
+			if backoff > 0 {
+				continue
+			}
+		case <-retry.C:
+		case <-w.stop:
+			w.enqueue(w.snapshot())
+			w.write(w.stopCtx)
+			return
+		}
+
+		if w.write(context.Background()) {
+			backoff = 0
+			continue
+		}
+
+		backoff = min(max(2*backoff, w.minBackoff), w.maxBackoff)
+		w.logger.Info("writing-remote-write-requests", lager.Data{
+			"event":    "retrying",
+			"pending":  len(w.queue),
+			"retry_in": backoff.String(),
+		})
+		retry.Reset(backoff)
+	}
+}
+
+// enqueue queues the requests for series, dropping the oldest requests when
+// the queue is full.
+func (w *Writer) enqueue(series []TimeSeries) {
+	for len(series) > 0 {
+		n := min(len(series), maxSeriesPerRequest)
+		w.queue = append(w.queue, &WriteRequest{Timeseries: series[:n]})
+		series = series[n:]
+	}
+
+	if dropped := len(w.queue) - w.queueSize; dropped > 0 {
+		w.queue = w.queue[dropped:]
+		w.logger.Error("writing-remote-write-requests", errors.New("queue full"), lager.Data{
+			"event":   "dropped",
+			"dropped": dropped,
+		})
+	}
+}
+
+// write writes the queued requests in order and reports whether the queue
+// is empty. Requests that must not be retried are dropped.
+func (w *Writer) write(ctx context.Context) bool {
+	for len(w.queue) > 0 {
+		r := w.queue[0]
+
+		writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+		err := w.client.Write(writeCtx, r)
+		cancel()
+
+		if err != nil {
+			w.onError(err)
+		}
+
+		switch {
+		case err == nil:
+			w.logger.Debug("writing-remote-write-requests", lager.Data{
+				"series": len(r.Timeseries),
+			})
+		case errors.Is(err, ErrPermanent):
+			w.logger.Error("writing-remote-write-requests", err, lager.Data{
+				"event":  "dropped",
+				"series": len(r.Timeseries),
+			})
+		default:
+			w.logger.Error("writing-remote-write-requests", err, lager.Data{
+				"series": len(r.Timeseries),
+			})
+			return false
+		}
+
+		w.queue = w.queue[1:]
+	}
+
+	return true
+}
+
+// snapshot returns a series with a sample of the current value of every
+// series, and a stale marker for every series deleted since the last one.
+func (w *Writer) snapshot() []TimeSeries {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	sample := func(labels []Label, value float64) TimeSeries {
+		return TimeSeries{
+			Labels:  labels,
+			Samples: []Sample{{Value: value, Timestamp: now}},
+		}
+	}
+
+	var timeseries []TimeSeries
+	for _, s := range w.series.Series() {
+		labels := w.labels(s.Series.Name, s.Series.Labels)
+		if s.Kind != metrics.CumulativeHistogram {
+			timeseries = append(timeseries, sample(labels, s.Value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, count := range s.BucketCounts {
+			cumulative += count
+
+			le := "+Inf"
+			if i < len(s.Bounds) {
+				le = strconv.FormatFloat(s.Bounds[i], 'g', -1, 64)
+			}
+			timeseries = append(timeseries, sample(withSuffix(labels, "_bucket", "le", le), float64(cumulative)))
+		}
+		timeseries = append(timeseries, sample(withSuffix(labels, "_sum", "", ""), s.Sum))
+		timeseries = append(timeseries, sample(withSuffix(labels, "_count", "", ""), float64(s.Count)))
+	}
+
+	for _, labels := range w.stale {
+		timeseries = append(timeseries, sample(labels, staleNaN))
+	}
+	w.stale = nil
+
+	return timeseries
+}
+
+// withSuffix returns a copy of labels with the suffix added to __name__ and,
+// unless name is empty, the label name set to value.
+func withSuffix(labels []Label, suffix, name, value string) []Label {
+	suffixed := make([]Label, 0, len(labels)+1)
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			l.Value += suffix
+		}
+		if l.Name != name {
+			suffixed = append(suffixed, l)
+		}
+	}
+
+	if name != "" {
+		suffixed = append(suffixed, Label{Name: name, Value: value})
+		sortLabels(suffixed)
+	}
+
+	return suffixed
+}
@@ -0,0 +1,237 @@
+package remotewrite_test
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"code.cloudfoundry.org/service-metrics-release/remotewrite"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Writer", func() {
+	var (
+		endpoint *fakeEndpoint
+		client   *remotewrite.Client
+	)
+
+	BeforeEach(func() {
+		endpoint = newFakeEndpoint()
+		DeferCleanup(endpoint.close)
+
+		var err error
+		client, err = remotewrite.NewClient(endpoint.url(), nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	newWriter := func(opts ...remotewrite.WriterOption) *remotewrite.Writer {
+		opts = append([]remotewrite.WriterOption{
+			remotewrite.WithInterval(10 * time.Millisecond),
+			remotewrite.WithBackoff(10*time.Millisecond, 20*time.Millisecond),
+		}, opts...)
+
+		return remotewrite.NewWriter(client, lager.NewLogger("test"), opts...)
+	}
+
+	labels := func(ts remotewrite.TimeSeries) map[string]string {
+		m := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			m[l.Name] = l.Value
+		}
+		return m
+	}
+
+	It("writes gauges, counters and histograms with external labels", func() {
+		w := newWriter(remotewrite.WithExternalLabels(map[string]string{
+			"origin": "my-origin",
+			"pool":   "overridden",
+		}))
+
+		w.SetGauge(metrics.Series{Name: "memory", Labels: map[string]string{"pool": "heap"}}, 15)
+		w.AddCounter(metrics.Series{Name: "requests_total"}, 2.5)
+		w.AddCounter(metrics.Series{Name: "requests_total"}, 1)
+		w.ObserveHistogram(metrics.Series{Name: "latency"}, []float64{1, 5}, 0.5)
+		w.ObserveHistogram(metrics.Series{Name: "latency"}, []float64{1, 5}, 10)
+
+		w.Start()
+		Eventually(endpoint.received).ShouldNot(BeEmpty())
+		w.Stop(context.Background())
+
+		series := endpoint.received()[0].Timeseries
+		Expect(series).To(HaveLen(7))
+
+		for _, ts := range series {
+			Expect(ts.Samples).To(HaveLen(1))
+			Expect(ts.Samples[0].Timestamp).To(BeNumerically("~", time.Now().UnixMilli(), 5000))
+			Expect(ts.Labels[0].Name).To(Equal("__name__"))
+			Expect(labels(ts)).To(HaveKeyWithValue("origin", "my-origin"))
+		}
+
+		Expect(labels(series[0])).To(Equal(map[string]string{"__name__": "latency_bucket", "le": "1", "origin": "my-origin", "pool": "overridden"}))
+		Expect(series[0].Samples[0].Value).To(Equal(1.0))
+		Expect(labels(series[1])).To(HaveKeyWithValue("le", "5"))
+		Expect(series[1].Samples[0].Value).To(Equal(1.0))
+		Expect(labels(series[2])).To(HaveKeyWithValue("le", "+Inf"))
+		Expect(series[2].Samples[0].Value).To(Equal(2.0))
+		Expect(labels(series[3])).To(HaveKeyWithValue("__name__", "latency_sum"))
+		Expect(series[3].Samples[0].Value).To(Equal(10.5))
+		Expect(labels(series[4])).To(HaveKeyWithValue("__name__", "latency_count"))
+		Expect(series[4].Samples[0].Value).To(Equal(2.0))
+
+		Expect(labels(series[5])).To(Equal(map[string]string{"__name__": "memory", "origin": "my-origin", "pool": "heap"}))
+		Expect(series[5].Samples[0].Value).To(Equal(15.0))
+
+		Expect(labels(series[6])).To(HaveKeyWithValue("__name__", "requests_total"))
+		Expect(series[6].Samples[0].Value).To(Equal(3.5))
+	})
+
+	It("adds pre-aggregated bucket counts to histograms", func() {
+		w := newWriter()
+		w.AddHistogramCounts(metrics.Series{Name: "latency"}, []float64{1, 5}, []uint64{2000000, 3, 1}, 1000007)
+
+		w.Start()
+		Eventually(endpoint.received).ShouldNot(BeEmpty())
+		w.Stop(context.Background())
+
+		series := endpoint.received()[0].Timeseries
+		Expect(series).To(HaveLen(5))
+		Expect(series[0].Samples[0].Value).To(Equal(2000000.0))
+		Expect(series[1].Samples[0].Value).To(Equal(2000003.0))
+		Expect(series[2].Samples[0].Value).To(Equal(2000004.0))
+		Expect(labels(series[3])).To(HaveKeyWithValue("__name__", "latency_sum"))
+		Expect(series[3].Samples[0].Value).To(Equal(1000007.0))
+		Expect(series[4].Samples[0].Value).To(Equal(2000004.0))
+	})
+
+	It("sorts the labels of every series by name", func() {
+		w := newWriter()
+		w.SetGauge(metrics.Series{Name: "memory", Labels: map[string]string{"b": "2", "a": "1", "z": "3"}}, 1)
+
+		w.Start()
+		Eventually(endpoint.received).ShouldNot(BeEmpty())
+		w.Stop(context.Background())
+
+		Expect(endpoint.received()[0].Timeseries[0].Labels).To(Equal([]remotewrite.Label{
+			{Name: "__name__", Value: "memory"},
+			{Name: "a", Value: "1"},
+			{Name: "b", Value: "2"},
+			{Name: "z", Value: "3"},
+		}))
+	})
+
+	It("marks deleted gauges as stale once", func() {
+		w := newWriter(remotewrite.WithInterval(time.Hour))
+		memory := metrics.Series{Name: "memory"}
+		w.SetGauge(memory, 1)
+		w.DeleteSeries(memory)
+
+		w.Start()
+		w.Stop(context.Background())
+
+		series := endpoint.series()
+		Expect(series).To(HaveLen(1))
+		Expect(math.Float64bits(series[0].Samples[0].Value)).To(BeEquivalentTo(0x7ff0000000000002))
+	})
+
+	It("writes the queued requests once the endpoint is available", func() {
+		endpoint.fail(3)
+
+		w := newWriter(remotewrite.WithBackoff(50*time.Millisecond, 50*time.Millisecond))
+		w.SetGauge(metrics.Series{Name: "memory"}, 1)
+
+		w.Start()
+		DeferCleanup(w.Stop)
+
+		Eventually(func() int {
+			return len(endpoint.received())
+		}).Should(BeNumerically(">=", 2))
+
+		timestamps := map[int64]bool{}
+		for _, ts := range endpoint.series() {
+			timestamps[ts.Samples[0].Timestamp] = true
+		}
+		Expect(len(timestamps)).To(BeNumerically(">=", 2))
+	})
+
+	It("reports every failed write to the error handler", func() {
+		endpoint.fail(2)
+
+		var failures atomic.Int32
+		w := newWriter(remotewrite.WithErrorHandler(func(error) {
+			failures.Add(1)
+		}))
+		w.SetGauge(metrics.Series{Name: "memory"}, 1)
+
+		w.Start()
+		DeferCleanup(w.Stop)
+
+		Eventually(endpoint.received).ShouldNot(BeEmpty())
+		Expect(failures.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("drops the oldest requests when the queue is full", func() {
+		endpoint.fail(1000)
+
+		w := newWriter(
+			remotewrite.WithQueueSize(2),
+			remotewrite.WithBackoff(time.Hour, time.Hour),
+		)
+		w.SetGauge(metrics.Series{Name: "memory"}, 1)
+
+		w.Start()
+		Eventually(endpoint.writes).Should(Equal(1))
+		time.Sleep(50 * time.Millisecond)
+
+		endpoint.fail(0)
+		w.Stop(context.Background())
+
+		Expect(endpoint.received()).To(HaveLen(2))
+	})
+
+	It("does not retry requests the endpoint rejected", func() {
+		endpoint.reject(http.StatusBadRequest)
+
+		w := newWriter(
+			remotewrite.WithInterval(50*time.Millisecond),
+			remotewrite.WithBackoff(time.Millisecond, time.Millisecond),
+		)
+		w.SetGauge(metrics.Series{Name: "memory"}, 1)
+
+		w.Start()
+		Eventually(endpoint.writes).Should(Equal(1))
+		Consistently(endpoint.writes, 30*time.Millisecond).Should(Equal(1))
+
+		endpoint.reject(0)
+		w.Stop(context.Background())
+
+		Expect(endpoint.received()).To(HaveLen(1))
+	})
+
+	It("abandons the last write once the context of Stop is done", func() {
+		// The endpoint accepts connections but never responds.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(l.Close)
+
+		client, err = remotewrite.NewClient("http://"+l.Addr().String()+"/api/v1/write", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		w := newWriter(remotewrite.WithInterval(time.Hour))
+		w.SetGauge(metrics.Series{Name: "size"}, 1)
+		w.Start()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		w.Stop(ctx)
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+})
@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Job is run by the Scheduler once immediately and then every Interval.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context)
+
+	// CancelOnStop cancels the context of a run in flight once the Scheduler
+	// is stopped, for jobs that keep running until they are told to stop.
+	CancelOnStop bool
+}
+
+// Scheduler runs every job in its own goroutine, so that a slow or failing
+// job does not delay any of the others.
+type Scheduler struct {
+	jobs []Job
+}
+
+func New(jobs ...Job) *Scheduler {
+	return &Scheduler{
+		jobs: jobs,
+	}
+}
+
+// Run runs the jobs until stop is closed and returns once every job has
+// stopped. A run in flight when stop is closed is allowed to finish, unless
+// ctx is canceled.
+func (s *Scheduler) Run(ctx context.Context, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+
+	for _, j := range s.jobs {
+		wg.Add(1)
+		go func(j Job) {
+			defer wg.Done()
+			run(ctx, stop, j)
+		}(j)
+	}
+
+	wg.Wait()
+}
+
+func run(ctx context.Context, stop <-chan struct{}, j Job) {
+	if j.CancelOnStop {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		j.Run(ctx)
+
+		timer := time.NewTimer(j.Interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
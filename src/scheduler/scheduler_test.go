@@ -0,0 +1,142 @@
+package scheduler_test
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/service-metrics-release/scheduler"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scheduler", func() {
+	var (
+		stop chan struct{}
+		done chan struct{}
+	)
+
+	BeforeEach(func() {
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	})
+
+	start := func(s *scheduler.Scheduler, ctx context.Context) {
+		go func() {
+			defer close(done)
+			s.Run(ctx, stop)
+		}()
+	}
+
+	It("runs every job immediately and then on its own interval", func() {
+		var fast, slow int64
+		s := scheduler.New(
+			scheduler.Job{
+				Name:     "fast",
+				Interval: 10 * time.Millisecond,
+				Run:      func(context.Context) { atomic.AddInt64(&fast, 1) },
+			},
+			scheduler.Job{
+				Name:     "slow",
+				Interval: time.Hour,
+				Run:      func(context.Context) { atomic.AddInt64(&slow, 1) },
+			},
+		)
+
+		start(s, context.Background())
+
+		Eventually(func() int64 { return atomic.LoadInt64(&fast) }).Should(BeNumerically(">=", 3))
+		Consistently(func() int64 { return atomic.LoadInt64(&slow) }, 50*time.Millisecond).Should(Equal(int64(1)))
+
+		close(stop)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("does not let a blocked job delay the others", func() {
+		var runs int64
+		blocked := make(chan struct{})
+		s := scheduler.New(
+			scheduler.Job{
+				Name:     "blocked",
+				Interval: time.Millisecond,
+				Run:      func(context.Context) { <-blocked },
+			},
+			scheduler.Job{
+				Name:     "healthy",
+				Interval: time.Millisecond,
+				Run:      func(context.Context) { atomic.AddInt64(&runs, 1) },
+			},
+		)
+
+		start(s, context.Background())
+
+		Eventually(func() int64 { return atomic.LoadInt64(&runs) }).Should(BeNumerically(">=", 3))
+
+		close(blocked)
+		close(stop)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("waits for runs in flight when stopped", func() {
+		started := make(chan struct{})
+		finish := make(chan struct{})
+		s := scheduler.New(scheduler.Job{
+			Name:     "job",
+			Interval: time.Hour,
+			Run: func(context.Context) {
+				close(started)
+				<-finish
+			},
+		})
+
+		start(s, context.Background())
+		Eventually(started).Should(BeClosed())
+
+		close(stop)
+		Consistently(done, 50*time.Millisecond).ShouldNot(BeClosed())
+
+		close(finish)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("passes the context on to the jobs", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		started := make(chan struct{})
+		s := scheduler.New(scheduler.Job{
+			Name:     "job",
+			Interval: time.Hour,
+			Run: func(ctx context.Context) {
+				close(started)
+				<-ctx.Done()
+			},
+		})
+
+		start(s, ctx)
+		Eventually(started).Should(BeClosed())
+		close(stop)
+		Consistently(done, 50*time.Millisecond).ShouldNot(BeClosed())
+
+		cancel()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("cancels runs in flight of jobs that are canceled on stop", func() {
+		started := make(chan struct{})
+		s := scheduler.New(scheduler.Job{
+			Name:         "job",
+			Interval:     time.Hour,
+			CancelOnStop: true,
+			Run: func(ctx context.Context) {
+				close(started)
+				<-ctx.Done()
+			},
+		})
+
+		start(s, context.Background())
+		Eventually(started).Should(BeClosed())
+
+		close(stop)
+		Eventually(done).Should(BeClosed())
+	})
+})
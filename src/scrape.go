@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	egress "code.cloudfoundry.org/go-metric-registry"
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+// maxScrapeSize is the largest response a URL collector records.
+const maxScrapeSize = 64 * 1024 * 1024
+
+// scrapeAccept asks for the Prometheus text format, which is what the
+// prometheus format of URL collectors parses.
+const scrapeAccept = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+// scraper fetches the metrics of a URL collector. A scrape that takes longer
+// than timeout is abandoned and counted like a metrics command that timed
+// out.
+type scraper struct {
+	url      string
+	client   *http.Client
+	timeout  time.Duration
+	logger   lager.Logger
+	timeouts egress.Counter
+
+	// err is returned by every scrape if the client could not be created.
+	err error
+}
+
+func validateURL(c collectorConfig) error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url %q must be http or https", c.URL)
+	}
+
+	if c.CAFile != "" {
+		if _, err := loadCAPool(c.CAFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadCAPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// clientTLSConfig returns the TLS configuration of connections to an https
+// endpoint, which trust the system roots unless a CA file is given and
+// authenticate with the optional certificate.
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := loadCAPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func newScraper(c collectorConfig, logger lager.Logger, timeouts egress.Counter) *scraper {
+	s := &scraper{
+		url:      c.URL,
+		timeout:  time.Duration(c.Timeout),
+		logger:   logger,
+		timeouts: timeouts,
+	}
+
+	tlsConfig, err := clientTLSConfig(c.CAFile, "", "")
+	if err != nil {
+		s.err = err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	s.client = &http.Client{Transport: transport}
+
+	return s
+}
+
+// scrape returns the body of a successful response. A 503 Service
+// Unavailable response is treated like a metrics command that is not ready
+// yet.
+func (s *scraper) scrape(ctx context.Context) ([]byte, error) {
+	action := "scraping-metrics-url"
+
+	if s.err != nil {
+		s.logger.Error(action, s.err, lager.Data{
+			"event": "failed",
+			"url":   s.url,
+		})
+		return nil, fmt.Errorf("%w: %w", metrics.ErrCommandFailed, s.err)
+	}
+
+	s.logger.Info(action, lager.Data{
+		"event": "starting",
+		"url":   s.url,
+	})
+
+	scrapeCtx := ctx
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		scrapeCtx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	body, err := s.get(scrapeCtx)
+
+	if ctx.Err() != nil {
+		s.logger.Info(action, lager.Data{
+			"event": "canceled",
+			"url":   s.url,
+		})
+		return nil, ctx.Err()
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.logger.Error(action, metrics.ErrTimedOut, lager.Data{
+			"event":   "timed-out",
+			"url":     s.url,
+			"timeout": s.timeout.String(),
+		})
+		s.timeouts.Add(1)
+		return nil, metrics.ErrTimedOut
+	}
+
+	if errors.Is(err, metrics.ErrNotReady) {
+		s.logger.Info(action, lager.Data{
+			"event": "not yet ready to emit metrics",
+			"url":   s.url,
+		})
+		return nil, err
+	}
+
+	if err != nil {
+		s.logger.Error(action, err, lager.Data{
+			"event": "failed",
+			"url":   s.url,
+		})
+		return nil, fmt.Errorf("%w: %w", metrics.ErrCommandFailed, err)
+	}
+
+	s.logger.Info(action, lager.Data{
+		"event": "done",
+		"url":   s.url,
+	})
+
+	return body, nil
+}
+
+func (s *scraper) get(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", scrapeAccept)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("%w: unexpected status %s", metrics.ErrNotReady, resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxScrapeSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxScrapeSize {
+		return nil, fmt.Errorf("response larger than %d bytes", maxScrapeSize)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("scraper", func() {
+	var (
+		timeouts *spyCounter
+		dir      string
+	)
+
+	BeforeEach(func() {
+		timeouts = &spyCounter{}
+		dir = GinkgoT().TempDir()
+	})
+
+	newTestScraper := func(c collectorConfig) *scraper {
+		return newScraper(c, lager.NewLogger("test"), timeouts)
+	}
+
+	// writeCA writes the certificate of a new CA to a file and returns its
+	// path along with the CA and its key.
+	writeCA := func() (string, *x509.Certificate, *ecdsa.PrivateKey) {
+		ca, key := newCertificate(nil, nil, x509.ExtKeyUsageAny)
+		path := filepath.Join(dir, "ca-"+ca.SerialNumber.String()+".pem")
+		Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600)).To(Succeed())
+
+		return path, ca, key
+	}
+
+	// newTLSServer starts a server with a certificate signed by the CA.
+	newTLSServer := func(ca *x509.Certificate, caKey *ecdsa.PrivateKey, h http.Handler) *httptest.Server {
+		cert, key := newCertificate(ca, caKey, x509.ExtKeyUsageServerAuth)
+
+		server := httptest.NewUnstartedServer(h)
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		}
+		server.StartTLS()
+		DeferCleanup(server.Close)
+
+		return server
+	}
+
+	exposition := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("size 3\n"))
+	})
+
+	Describe("over HTTPS", func() {
+		var (
+			caFile string
+			server *httptest.Server
+		)
+
+		BeforeEach(func() {
+			var ca *x509.Certificate
+			var caKey *ecdsa.PrivateKey
+			caFile, ca, caKey = writeCA()
+			server = newTLSServer(ca, caKey, exposition)
+		})
+
+		It("scrapes a server whose certificate is signed by the CA", func() {
+			body, err := newTestScraper(collectorConfig{URL: server.URL, CAFile: caFile}).scrape(context.Background())
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("size 3\n"))
+		})
+
+		It("does not trust a server whose certificate is not signed by the CA", func() {
+			otherCA, _, _ := writeCA()
+
+			_, err := newTestScraper(collectorConfig{URL: server.URL, CAFile: otherCA}).scrape(context.Background())
+			Expect(err).To(MatchError(metrics.ErrCommandFailed))
+			Expect(err).To(MatchError(ContainSubstring("certificate")))
+		})
+
+		It("does not trust a server whose certificate is not signed by a system root without a CA", func() {
+			_, err := newTestScraper(collectorConfig{URL: server.URL}).scrape(context.Background())
+			Expect(err).To(MatchError(metrics.ErrCommandFailed))
+			Expect(err).To(MatchError(ContainSubstring("certificate")))
+		})
+
+		It("verifies that the certificate is for the host of the URL", func() {
+			url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+			_, err := newTestScraper(collectorConfig{URL: url, CAFile: caFile}).scrape(context.Background())
+			Expect(err).To(MatchError(metrics.ErrCommandFailed))
+			Expect(err).To(MatchError(ContainSubstring("certificate")))
+		})
+
+		It("fails every scrape when the CA cannot be loaded", func() {
+			Expect(os.WriteFile(caFile, []byte("not a certificate"), 0o600)).To(Succeed())
+
+			_, err := newTestScraper(collectorConfig{URL: server.URL, CAFile: caFile}).scrape(context.Background())
+			Expect(err).To(MatchError(metrics.ErrCommandFailed))
+			Expect(err).To(MatchError(ContainSubstring("no certificates found")))
+		})
+	})
+
+	DescribeTable("requires TLS 1.2 or later",
+		func(withCA bool) {
+			c := collectorConfig{URL: "https://127.0.0.1/metrics"}
+			if withCA {
+				c.CAFile, _, _ = writeCA()
+			}
+
+			s := newTestScraper(c)
+			Expect(s.err).NotTo(HaveOccurred())
+
+			tlsConfig := s.client.Transport.(*http.Transport).TLSClientConfig
+			Expect(tlsConfig.MinVersion).To(BeEquivalentTo(tls.VersionTLS12))
+			Expect(tlsConfig.RootCAs != nil).To(Equal(withCA))
+		},
+		Entry("with the system roots", false),
+		Entry("with a CA file", true),
+	)
+
+	It("asks for the Prometheus text format", func() {
+		accept := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accept <- r.Header.Get("Accept")
+		}))
+		defer server.Close()
+
+		_, err := newTestScraper(collectorConfig{URL: server.URL}).scrape(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(accept).To(Receive(Equal(scrapeAccept)))
+	})
+
+	DescribeTable("classifies the response status",
+		func(status int, expected error) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			_, err := newTestScraper(collectorConfig{URL: server.URL}).scrape(context.Background())
+			Expect(err).To(MatchError(expected))
+		},
+		Entry("unavailable as not ready", http.StatusServiceUnavailable, metrics.ErrNotReady),
+		Entry("unauthorized as failed", http.StatusUnauthorized, metrics.ErrCommandFailed),
+		Entry("server error as failed", http.StatusInternalServerError, metrics.ErrCommandFailed),
+	)
+
+	It("abandons a scrape that takes longer than the timeout", func() {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+		defer server.Close()
+		defer close(release)
+
+		_, err := newTestScraper(collectorConfig{URL: server.URL, Timeout: duration(100 * time.Millisecond)}).scrape(context.Background())
+		Expect(err).To(MatchError(metrics.ErrTimedOut))
+		Expect(timeouts.value()).To(Equal(1.0))
+	})
+})
+
+// newCertificate returns a certificate for 127.0.0.1 signed by parent, or a
+// self-signed CA if parent is nil.
+func newCertificate(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "service-metrics"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return cert, key
+}
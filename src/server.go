@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"code.cloudfoundry.org/tlsconfig"
+)
+
+// serveMetrics serves the metrics of reg for prom_scraper on
+// https://127.0.0.1:<port>/metrics, to clients with a certificate signed by
+// the configured CA.
+func serveMetrics(logger lager.Logger, reg *metrics.PrometheusRegistry) error {
+	tlsConfig, err := tlsconfig.Build(
+		tlsconfig.WithInternalServiceDefaults(),
+		tlsconfig.WithIdentityFromFile(cfg.CertFile, cfg.KeyFile),
+	).Server(
+		tlsconfig.WithClientAuthenticationFromFile(cfg.CAFile),
+	)
+	if err != nil {
+		return err
+	}
+
+	lis, err := tls.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", cfg.Port), tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg.Handler())
+
+	s := &http.Server{
+		Handler:           mux,
+		ReadTimeout:       5 * time.Minute,
+		ReadHeaderTimeout: 5 * time.Minute,
+		WriteTimeout:      5 * time.Minute,
+	}
+	go func() {
+		if err := s.Serve(lis); err != nil && err != http.ErrServerClosed {
+			logger.Error("serving-metrics", err)
+		}
+	}()
+
+	logger.Info("serving-metrics", lager.Data{"address": lis.Addr().String()})
+
+	return nil
+}
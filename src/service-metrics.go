@@ -1,34 +1,29 @@
 package main
 
 import (
-	"flag"
-	"fmt"
-	"log"
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	egress "code.cloudfoundry.org/go-metric-registry"
 	"code.cloudfoundry.org/service-metrics-release/metrics"
+	"code.cloudfoundry.org/service-metrics-release/otlp"
+	"code.cloudfoundry.org/service-metrics-release/remotewrite"
 
-	"code.cloudfoundry.org/go-envstruct"
 	"code.cloudfoundry.org/lager/v3"
 )
 
-type config struct {
-	Origin          string        `env:"ORIGIN, report"`
-	MetricsInterval time.Duration `env:"METRICS_INTERVAL, report"`
-	MetricsCmd      string        `env:"METRICS_CMD, report"`
-	MetricsCmdArgs  multiFlag     `env:"METRICS_CMD_ARG"`
-	Debug           bool          `env:"DEBUG, report"`
-	Port            int           `env:"PORT, report"`
-	CAFile          string        `env:"CA_FILE_PATH, report"`
-	CertFile        string        `env:"CERT_FILE_PATH, report"`
-	KeyFile         string        `env:"KEY_FILE_PATH, report"`
-}
-
-var cfg config
-
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "once":
+			os.Exit(runOnce(os.Args[2:]))
+		}
+	}
+
 	parseConfig()
 
 	stdoutLogLevel := lager.INFO
@@ -40,86 +35,171 @@ func main() {
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, stdoutLogLevel))
 	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
 
-	m := egress.NewRegistry(log.New(os.Stdout, "", 0),
-		egress.WithTLSServer(
-			cfg.Port,
-			cfg.CertFile,
-			cfg.KeyFile,
-			cfg.CAFile,
-		),
-	)
-
-	processor := metrics.NewProcessor(
-		logger,
-		m,
-		NewCommandLineExecutor(logger),
-	)
-
-	processor.Process(cfg.MetricsCmd, cfg.MetricsCmdArgs...)
-	for {
-		<-time.After(cfg.MetricsInterval)
-		processor.Process(cfg.MetricsCmd, cfg.MetricsCmdArgs...)
-	}
-}
+	reg := metrics.NewPrometheusRegistry()
 
-func parseConfig() {
-	cfg = config{
-		MetricsInterval: time.Minute,
+	// Without a port, metrics sent to the Loggregator agent, an OTLP
+	// receiver or a remote write endpoint are not served for prom_scraper as
+	// well.
+	if cfg.Port != 0 || !cfg.loggregatorEnabled() && !cfg.otlpEnabled() && !cfg.remoteWriteEnabled() {
+		if err := serveMetrics(logger, reg); err != nil {
+			logger.Error("serving-metrics", err)
+			os.Exit(1)
+		}
 	}
-	err := envstruct.Load(&cfg)
-	if err != nil {
-		log.Panicf("error loading envstruct: %s", err)
+
+	// Samples are recorded in the registry as they are collected, so that
+	// none are lost. Every other output receives them from its own goroutine,
+	// so that an output that falls behind does not hold up the others.
+	m := metrics.NewFanOut(logger, metrics.NewRegistrySink(reg))
+
+	var ls *loggregatorSink
+	if cfg.loggregatorEnabled() {
+		var err error
+		ls, err = startLoggregator(logger, m.FailureHandler("loggregator"))
+		if err != nil {
+			logger.Error("sending-loggregator-envelopes", err)
+			os.Exit(1)
+		}
+		m.AddOutput("loggregator", ls)
 	}
 
-	cmdArgsFromEnv := cfg.MetricsCmdArgs
-	flag.StringVar(&cfg.Origin, "origin", cfg.Origin, "Required. Source name for metrics emitted by this process, e.g. service-name")
-	flag.StringVar(&cfg.MetricsCmd, "metrics-cmd", cfg.MetricsCmd, "Required. Path to metrics command")
-	flag.Var(&cfg.MetricsCmdArgs, "metrics-cmd-arg", "Argument to pass on to metrics-cmd (multi-valued)")
-	flag.DurationVar(&cfg.MetricsInterval, "metrics-interval", cfg.MetricsInterval, "Interval to run metrics-cmd")
-	flag.BoolVar(&cfg.Debug, "debug", cfg.Debug, "Output debug logging")
-	flag.Parse()
+	var exporter *otlp.Exporter
+	if cfg.otlpEnabled() {
+		var err error
+		exporter, err = startOTLP(logger, m.FailureHandler("otlp"))
+		if err != nil {
+			logger.Error("exporting-otlp-metrics", err)
+			os.Exit(1)
+		}
+		m.AddOutput("otlp", exporter)
+	}
 
-	if len(cfg.MetricsCmdArgs) == 0 {
-		cfg.MetricsCmdArgs = cmdArgsFromEnv
+	var writer *remotewrite.Writer
+	if cfg.remoteWriteEnabled() {
+		var err error
+		writer, err = startRemoteWrite(logger, m.FailureHandler("remote_write"))
+		if err != nil {
+			logger.Error("writing-remote-write-requests", err)
+			os.Exit(1)
+		}
+		m.AddOutput("remote_write", writer)
 	}
 
-	assertFlag("origin", cfg.Origin)
-	assertFlag("metrics-cmd", cfg.MetricsCmd)
+	signatures := metrics.NewSignatures()
 
-	err = envstruct.WriteReport(&cfg)
-	if err != nil {
-		log.Panicf("error writing report: %s", err)
+	collectors := newCollectors(cfg.collectors(), nil, logger, m, signatures)
+
+	var push *pushServer
+	if cfg.pushEnabled() {
+		var err error
+		push, err = startPush(logger, m, signatures)
+		if err != nil {
+			logger.Error("accepting-pushed-metrics", err)
+			os.Exit(1)
+		}
 	}
-}
 
-type multiFlag []string
+	var statsd *statsdListener
+	if cfg.statsdEnabled() {
+		var err error
+		statsd, err = startStatsD(logger, m, signatures)
+		if err != nil {
+			logger.Error("receiving-statsd-metrics", err)
+			os.Exit(1)
+		}
+	}
 
-// multiFlag implements flag.Value
-func (m *multiFlag) String() string {
-	return fmt.Sprint(cfg.MetricsCmdArgs)
-}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	start := time.Now()
 
-// multiFlag implements flag.Value
-func (m *multiFlag) Set(value string) error {
-	if cfg.MetricsCmdArgs == nil {
-		cfg.MetricsCmdArgs = multiFlag{}
+	r := startRun(context.Background(), collectors)
+
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		collectors, r = reload(context.Background(), logger, m, signatures, collectors, r)
+		sig = <-signals
 	}
 
-	cfg.MetricsCmdArgs = append(cfg.MetricsCmdArgs, value)
+	logger.Info("shutting-down", lager.Data{
+		"signal":            sig.String(),
+		"grace_period":      cfg.ShutdownGracePeriod.String(),
+		"final_scrape_wait": cfg.FinalScrapeWait.String(),
+	})
+
+	// Stop accepting pushed and StatsD metrics, then deliver the last samples
+	// before the outputs send them for the last time.
+	var steps []func(context.Context)
+	if push != nil {
+		steps = append(steps, push.stop)
+	}
+	if statsd != nil {
+		steps = append(steps, func(context.Context) { statsd.stop() })
+	}
+	steps = append(steps, func(context.Context) { m.Close() })
+	if ls != nil {
+		steps = append(steps, ls.stop)
+	}
+	if exporter != nil {
+		steps = append(steps, exporter.Stop)
+	}
+	if writer != nil {
+		steps = append(steps, writer.Stop)
+	}
 
-	return nil
-}
+	shutdown(logger, r, steps...)
 
-// multiFlag implements envstruct.Unmarshaller
-func (m *multiFlag) UnmarshalEnv(v string) error {
-	cfg.MetricsCmdArgs = multiFlag{v}
-	return nil
+	summary := lager.Data{}
+	for _, c := range collectors {
+		summary[c.config.Name] = lager.Data{
+			"runs":     c.failures.runs,
+			"failures": c.failures.failures,
+		}
+	}
+
+	logger.Info("shutting-down", lager.Data{
+		"event":      "done",
+		"uptime":     time.Since(start).Round(time.Second).String(),
+		"collectors": summary,
+	})
 }
 
-func assertFlag(name, value string) {
-	if value == "" {
-		flag.Usage()
-		fmt.Fprintf(os.Stderr, "\nMust provide --%s", name)
-		os.Exit(1)
+// shutdown stops the run and then takes the steps in order, before waiting
+// for prom_scraper to scrape the last recorded metrics once more. Every step
+// shares one deadline, so that together they take no longer than the grace
+// period and the final scrape wait, which the drain script allows for. The
+// runs in flight only get the grace period to finish.
+func shutdown(logger lager.Logger, r *run, steps ...func(context.Context)) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod+cfg.FinalScrapeWait)
+	defer cancel()
+
+	graceCtx, cancelGrace := context.WithTimeout(ctx, cfg.ShutdownGracePeriod)
+	defer cancelGrace()
+
+	if r.stopBy(graceCtx) {
+		logger.Info("shutting-down", lager.Data{
+			"event": "canceled-metrics-cmd",
+		})
+	}
+
+	for _, step := range steps {
+		step(ctx)
+	}
+
+	// Keep serving the last recorded metrics long enough for prom_scraper to
+	// scrape them once more, unless the deadline is reached first.
+	if cfg.FinalScrapeWait > 0 {
+		logger.Info("shutting-down", lager.Data{
+			"event": "waiting-for-final-scrape",
+			"wait":  cfg.FinalScrapeWait.String(),
+		})
+
+		timer := time.NewTimer(cfg.FinalScrapeWait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
 	}
 }
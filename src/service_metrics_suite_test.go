@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"code.cloudfoundry.org/lager/v3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestServiceMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Service Metrics Suite")
+}
+
+// logSink records the logs of a lager.Logger.
+type logSink struct {
+	mu   sync.Mutex
+	logs []lager.LogFormat
+}
+
+// newTestLogger returns a logger that logs every level to the returned sink.
+func newTestLogger() (lager.Logger, *logSink) {
+	logger := lager.NewLogger("test")
+	sink := &logSink{}
+	logger.RegisterSink(sink)
+
+	return logger, sink
+}
+
+func (s *logSink) Log(l lager.LogFormat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logs = append(s.logs, l)
+}
+
+// data returns the data of every log of action, in order.
+func (s *logSink) data(action string) []lager.Data {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []lager.Data
+	for _, l := range s.logs {
+		if strings.HasSuffix(l.Message, "."+action) {
+			data = append(data, l.Data)
+		}
+	}
+
+	return data
+}
+
+// events returns the "event" of every log of action, in order.
+func (s *logSink) events(action string) []string {
+	var events []string
+	for _, d := range s.data(action) {
+		if e, ok := d["event"].(string); ok {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+// processExited reports whether the process has exited, including when it
+// is a zombie that was not reaped yet.
+func processExited(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+
+	// The state follows the command name, which is in parentheses.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+
+	return len(fields) == 0 || fields[0] == "Z" || fields[0] == "X"
+}
+
+// readPid returns the pid written to the file, once it has been written.
+func readPid(path string) int {
+	var pid int
+	Eventually(func() error {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		pid, err = strconv.Atoi(strings.TrimSpace(string(b)))
+		return err
+	}).Should(Succeed())
+
+	return pid
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("shutdown", func() {
+	var (
+		logger lager.Logger
+		logs   *logSink
+	)
+
+	BeforeEach(func() {
+		cfg = defaultConfig()
+		cfg.ShutdownGracePeriod = 200 * time.Millisecond
+		cfg.FinalScrapeWait = 300 * time.Millisecond
+		logger, logs = newTestLogger()
+	})
+
+	It("gives every step the deadline of the grace period and the final scrape wait", func() {
+		var deadlines []time.Time
+		step := func(ctx context.Context) {
+			deadline, ok := ctx.Deadline()
+			Expect(ok).To(BeTrue())
+			deadlines = append(deadlines, deadline)
+		}
+
+		start := time.Now()
+		shutdown(logger, startRun(context.Background(), nil), step, step)
+
+		Expect(deadlines).To(HaveLen(2))
+		Expect(deadlines[1]).To(Equal(deadlines[0]))
+		Expect(deadlines[0]).To(BeTemporally("~", start.Add(500*time.Millisecond), 100*time.Millisecond))
+		Expect(time.Since(start)).To(BeNumerically(">=", cfg.FinalScrapeWait))
+		Expect(logs.events("shutting-down")).To(Equal([]string{"waiting-for-final-scrape"}))
+	})
+
+	It("takes no longer than the grace period and the final scrape wait together", func() {
+		started := filepath.Join(GinkgoT().TempDir(), "started")
+		c := newCollector(collectorConfig{
+			Name:     "test",
+			Command:  "/bin/sh",
+			Args:     []string{"-c", "touch " + started + "; trap '' TERM; sleep 30"},
+			Interval: duration(time.Hour),
+		}, nil, logger, metrics.NewRegistrySink(metrics.NewPrometheusRegistry()), metrics.NewSignatures())
+		r := startRun(context.Background(), []*collector{c})
+		Eventually(started).Should(BeAnExistingFile())
+
+		// The first step hangs like an output whose endpoint never
+		// responds, so the steps after it are already past the deadline.
+		var late error
+		start := time.Now()
+		shutdown(logger, r,
+			func(ctx context.Context) { <-ctx.Done() },
+			func(ctx context.Context) { late = ctx.Err() },
+		)
+
+		Expect(time.Since(start)).To(BeNumerically("~", 500*time.Millisecond, 250*time.Millisecond))
+		Expect(late).To(MatchError(context.DeadlineExceeded))
+		Expect(logs.events("shutting-down")).To(Equal([]string{"canceled-metrics-cmd", "waiting-for-final-scrape"}))
+	})
+})
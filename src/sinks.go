@@ -0,0 +1,28 @@
+package main
+
+import (
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+// sinkCounter is a counter about service metrics itself, such as the number
+// of metrics command timeouts, recorded in a sink.
+type sinkCounter struct {
+	sink   metrics.Sink
+	series metrics.Series
+}
+
+// newSinkCounter returns a counter for the series, which is exported as 0
+// until it is first incremented.
+func newSinkCounter(sink metrics.Sink, name, help string, labels map[string]string) *sinkCounter {
+	c := &sinkCounter{
+		sink:   sink,
+		series: metrics.Series{Name: name, Help: help, Labels: labels},
+	}
+	sink.AddCounter(c.series, 0)
+
+	return c
+}
+
+func (c *sinkCounter) Add(delta float64) {
+	c.sink.AddCounter(c.series, delta)
+}
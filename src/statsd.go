@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+// statsdCollector is the collector name the self-instrumentation of StatsD
+// metrics is labelled with.
+const statsdCollector = "statsd"
+
+// maxStatsDPacket is the largest UDP packet that can be received.
+const maxStatsDPacket = 64 * 1024
+
+// statsdListener receives StatsD metrics over UDP and records what it has
+// aggregated on every flush interval.
+type statsdListener struct {
+	conn      net.PacketConn
+	statsd    *metrics.StatsD
+	processor metrics.Processor
+	stopped   chan struct{}
+	done      chan struct{}
+}
+
+// startStatsD starts receiving StatsD metrics on the configured address.
+func startStatsD(logger lager.Logger, m metrics.Sink, signatures *metrics.Signatures) (*statsdListener, error) {
+	logger = logger.WithData(lager.Data{"collector": statsdCollector})
+
+	conn, err := net.ListenPacket("udp", cfg.StatsDAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &statsdListener{
+		conn:   conn,
+		statsd: metrics.NewStatsD(),
+		// The processor only records aggregated StatsD metrics and never
+		// runs a command, so it has no executor.
+		processor: metrics.NewProcessor(
+			logger,
+			m,
+			nil,
+			metrics.WithRelabelRules(cfg.relabelRules(collectorConfig{Name: statsdCollector})),
+			metrics.WithSignatures(signatures),
+			metrics.WithInstrumentation(statsdCollector),
+		),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	logger.Info("receiving-statsd-metrics", lager.Data{
+		"address":        conn.LocalAddr().String(),
+		"flush_interval": cfg.StatsDFlushInterval.String(),
+	})
+
+	go l.receive(logger)
+	go l.flush(cfg.StatsDFlushInterval)
+
+	return l, nil
+}
+
+func (l *statsdListener) receive(logger lager.Logger) {
+	buf := make([]byte, maxStatsDPacket)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Error("receiving-statsd-metrics", err)
+			continue
+		}
+
+		l.statsd.Add(buf[:n])
+	}
+}
+
+func (l *statsdListener) flush(interval time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.processor.ProcessStatsD(l.statsd)
+		case <-l.stopped:
+			l.processor.ProcessStatsD(l.statsd)
+			return
+		}
+	}
+}
+
+// stop stops receiving StatsD metrics and records what was received since
+// the last flush.
+func (l *statsdListener) stop() {
+	_ = l.conn.Close()
+	close(l.stopped)
+	<-l.done
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+// errStderr is logged with the stderr lines of the metrics command when they
+// are logged at error level.
+var errStderr = errors.New("metrics command wrote to stderr")
+
+// stderrLog configures how the stderr of the metrics command is logged.
+type stderrLog struct {
+	level lager.LogLevel
+	// maxBytes is how much of the stderr of one run is logged, the rest is
+	// dropped. Zero logs all of it.
+	maxBytes int
+}
+
+// stderrWriter logs every line written to it at the configured level.
+type stderrWriter struct {
+	logger metrics.Logger
+	stderrLog
+
+	mu      sync.Mutex
+	line    []byte
+	written int
+	dropped int
+}
+
+func (l stderrLog) writer(logger metrics.Logger) *stderrWriter {
+	return &stderrWriter{logger: logger, stderrLog: l}
+}
+
+func (w *stderrWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := len(b)
+
+	if w.maxBytes > 0 {
+		keep := max(w.maxBytes-w.written, 0)
+		if len(b) > keep {
+			w.dropped += len(b) - keep
+			b = b[:keep]
+		}
+	}
+	w.written += len(b)
+
+	w.line = append(w.line, b...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.log(string(bytes.TrimSuffix(w.line[:i], []byte("\r"))))
+		w.line = w.line[i+1:]
+	}
+
+	return n, nil
+}
+
+// flush logs the last line if it did not end with a newline, and how much
+// was dropped. It is called once the command has exited.
+func (w *stderrWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.line) > 0 {
+		w.log(string(w.line))
+		w.line = nil
+	}
+
+	w.truncated()
+}
+
+// reset logs how much was dropped so far and allows another maxBytes to be
+// logged, for commands that keep running.
+func (w *stderrWriter) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.truncated()
+	w.written, w.dropped = len(w.line), 0
+}
+
+func (w *stderrWriter) truncated() {
+	if w.dropped > 0 {
+		w.logger.Info("executing-metrics-cmd", lager.Data{
+			"event":         "stderr truncated",
+			"max_bytes":     w.maxBytes,
+			"dropped_bytes": w.dropped,
+		})
+	}
+}
+
+func (w *stderrWriter) log(line string) {
+	data := lager.Data{
+		"event": "stderr",
+		"line":  line,
+	}
+
+	switch w.level {
+	case lager.DEBUG:
+		w.logger.Debug("executing-metrics-cmd", data)
+	case lager.ERROR:
+		w.logger.Error("executing-metrics-cmd", errStderr, data)
+	default:
+		w.logger.Info("executing-metrics-cmd", data)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("stderrWriter", func() {
+	var (
+		logger lager.Logger
+		logs   *logSink
+	)
+
+	BeforeEach(func() {
+		logger, logs = newTestLogger()
+	})
+
+	lines := func() []string {
+		var lines []string
+		for _, d := range logs.data("executing-metrics-cmd") {
+			if line, ok := d["line"].(string); ok {
+				lines = append(lines, line)
+			}
+		}
+
+		return lines
+	}
+
+	write := func(w *stderrWriter, chunks ...string) {
+		for _, c := range chunks {
+			n, err := w.Write([]byte(c))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(c)))
+		}
+	}
+
+	It("logs every line once it is complete, whatever the writes", func() {
+		w := stderrLog{level: lager.INFO}.writer(logger)
+
+		write(w, "fir", "st\nsecond\r\nthi", "rd")
+		Expect(lines()).To(Equal([]string{"first", "second"}))
+
+		w.flush()
+		Expect(lines()).To(Equal([]string{"first", "second", "third"}))
+	})
+
+	It("logs empty lines", func() {
+		w := stderrLog{level: lager.INFO}.writer(logger)
+
+		write(w, "one\n\ntwo\n")
+		w.flush()
+
+		Expect(lines()).To(Equal([]string{"one", "", "two"}))
+	})
+
+	It("drops what is written after max bytes and logs how much", func() {
+		w := stderrLog{level: lager.INFO, maxBytes: 6}.writer(logger)
+
+		write(w, "one\n", "two\nthree\n")
+		w.flush()
+
+		Expect(lines()).To(Equal([]string{"one", "tw"}))
+		Expect(logs.data("executing-metrics-cmd")).To(ContainElement(And(
+			HaveKeyWithValue("event", "stderr truncated"),
+			HaveKeyWithValue("max_bytes", 6),
+			HaveKeyWithValue("dropped_bytes", 8),
+		)))
+	})
+
+	It("logs another max bytes after a reset", func() {
+		w := stderrLog{level: lager.INFO, maxBytes: 4}.writer(logger)
+
+		write(w, "one\ntwo\n")
+		w.reset()
+		write(w, "three\n")
+		w.flush()
+
+		Expect(lines()).To(Equal([]string{"one", "thre"}))
+		Expect(logs.events("executing-metrics-cmd")).To(Equal([]string{
+			"stderr", "stderr truncated", "stderr", "stderr truncated",
+		}))
+	})
+
+	It("logs everything without max bytes", func() {
+		w := stderrLog{level: lager.INFO}.writer(logger)
+		long := strings.Repeat("x", 1024*1024)
+
+		write(w, long+"\n")
+		w.flush()
+
+		Expect(lines()).To(Equal([]string{long}))
+		Expect(logs.events("executing-metrics-cmd")).NotTo(ContainElement("stderr truncated"))
+	})
+
+	DescribeTable("logs at the configured level",
+		func(level, expected lager.LogLevel) {
+			w := stderrLog{level: level}.writer(logger)
+
+			write(w, "line\n")
+
+			logs.mu.Lock()
+			defer logs.mu.Unlock()
+			Expect(logs.logs).To(HaveLen(1))
+			Expect(logs.logs[0].LogLevel).To(Equal(expected))
+		},
+		Entry("debug", lager.DEBUG, lager.DEBUG),
+		Entry("info", lager.INFO, lager.INFO),
+		Entry("error", lager.ERROR, lager.ERROR),
+		Entry("any other level as info", lager.FATAL, lager.INFO),
+	)
+})
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+)
+
+// validation is the report of validating the output of one collector.
+type validation struct {
+	Collector string                   `json:"collector"`
+	Command   string                   `json:"command,omitempty"`
+	Args      []string                 `json:"args,omitempty"`
+	URL       string                   `json:"url,omitempty"`
+	Accepted  []metrics.AcceptedSeries `json:"accepted"`
+	Renamed   []metrics.Rename         `json:"renamed"`
+	Rejected  []metrics.RejectedEntry  `json:"rejected"`
+	Error     string                   `json:"error,omitempty"`
+}
+
+func (v validation) valid() bool {
+	return v.Error == "" && len(v.Rejected) == 0
+}
+
+// outputExecutor returns the given output instead of running the command.
+type outputExecutor []byte
+
+func (o outputExecutor) Run(*exec.Cmd) ([]byte, error) {
+	return o, nil
+}
+
+// runValidate implements the validate subcommand. It runs every configured
+// metrics command once, or reads a single output from --input, records the
+// output exactly like the metrics commands run by service metrics, but into
+// a registry that is not served, and prints what was recorded, renamed and
+// rejected. It returns 1 if a command failed, its output could not be parsed
+// or any entry was rejected.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	input := fs.String("input", "", "Validate the metrics command output in this file, or - for stdin, instead of running the configured metrics commands")
+	reportFormat := fs.String("report", "text", "Format of the report: text or json")
+
+	c, err := loadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		return 1
+	}
+
+	if *reportFormat != "text" && *reportFormat != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid --report: unknown report format %q, must be one of text or json\n", *reportFormat)
+		return 1
+	}
+
+	collectors := c.collectors()
+	var output []byte
+	if *input != "" {
+		output, err = readInput(*input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --input: %s\n", err)
+			return 1
+		}
+
+		collectors = []collectorConfig{{
+			Name:     "input",
+			Command:  *input,
+			Interval: duration(c.MetricsInterval),
+			Format:   c.MetricsFormat,
+		}}
+	}
+
+	if err := validateStderrLogLevel(c.StderrLogLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		return 1
+	}
+
+	if _, err := compileRelabelRules("relabel_rules", c.RelabelRules); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --relabel-rule: %s\n", err)
+		return 1
+	}
+
+	if err := validateCollectors(collectors); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid collectors: %s\n", err)
+		return 1
+	}
+
+	logLevel := lager.ERROR
+	if c.Debug {
+		logLevel = lager.DEBUG
+	}
+
+	logger := lager.NewLogger("service-metrics")
+	logger.RegisterSink(lager.NewWriterSink(os.Stderr, logLevel))
+
+	m := metrics.NewRegistrySink(metrics.NewPrometheusRegistry())
+	signatures := metrics.NewSignatures()
+	cfg = c
+
+	var validations []validation
+	valid := true
+	for _, col := range collectors {
+		var opts []collectorOption
+		if *input != "" {
+			opts = append(opts, withExecutor(outputExecutor(output)))
+		}
+
+		v := validateCollector(col, logger, m, signatures, opts...)
+		valid = valid && v.valid()
+		validations = append(validations, v)
+	}
+
+	if *reportFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(struct {
+			Valid      bool         `json:"valid"`
+			Collectors []validation `json:"collectors"`
+		}{valid, validations})
+	} else {
+		for _, v := range validations {
+			printValidation(os.Stdout, v)
+		}
+	}
+
+	if !valid {
+		return 1
+	}
+
+	return 0
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	return os.ReadFile(path)
+}
+
+// validateCollector builds the collector exactly like service metrics does,
+// runs it one time like the once subcommand and reports what the run
+// recorded, renamed and rejected.
+func validateCollector(
+	c collectorConfig,
+	logger lager.Logger,
+	m metrics.Sink,
+	signatures *metrics.Signatures,
+	opts ...collectorOption,
+) validation {
+	report := &metrics.Report{}
+	col := newCollector(c, nil, logger, m, signatures, append(opts, withReport(report))...)
+
+	v := validation{
+		Collector: c.Name,
+		Command:   c.Command,
+		Args:      c.Args,
+		URL:       c.URL,
+		Accepted:  []metrics.AcceptedSeries{},
+		Renamed:   []metrics.Rename{},
+		Rejected:  []metrics.RejectedEntry{},
+	}
+
+	if err := col.collect(context.Background()); err != nil {
+		v.Error = err.Error()
+	}
+
+	v.Accepted = append(v.Accepted, report.Accepted()...)
+	v.Renamed = append(v.Renamed, report.Renamed()...)
+	v.Rejected = append(v.Rejected, report.Rejected()...)
+
+	return v
+}
+
+func printValidation(w io.Writer, v validation) {
+	status := "valid"
+	if !v.valid() {
+		status = "invalid"
+	}
+
+	source := v.URL
+	if source == "" {
+		source = strings.Join(append([]string{v.Command}, v.Args...), " ")
+	}
+
+	fmt.Fprintf(w, "%s (%s): %s\n", v.Collector, source, status)
+
+	for _, a := range v.Accepted {
+		fmt.Fprintf(w, "  accepted  %-9s  %s\n", a.Type, formatSeries(a.Name, a.Labels))
+	}
+
+	for _, r := range v.Renamed {
+		fmt.Fprintf(w, "  renamed   %-9s  %s -> %s\n", r.Kind, r.From, r.To)
+	}
+
+	for _, r := range v.Rejected {
+		detail := r.Reason
+		if r.Key != "" {
+			detail += " (" + r.Key + ")"
+		}
+
+		entry := ""
+		if r.Entry != nil {
+			b, _ := json.Marshal(r.Entry)
+			entry = " " + string(b)
+		}
+
+		fmt.Fprintf(w, "  rejected  %s: %s%s\n", r.Name, detail, entry)
+	}
+
+	if v.Error != "" {
+		fmt.Fprintf(w, "  error     %s\n", v.Error)
+	}
+
+	fmt.Fprintf(w, "  %d accepted, %d renamed, %d rejected\n", len(v.Accepted), len(v.Renamed), len(v.Rejected))
+}
+
+// formatSeries formats a series like the Prometheus text format does.
+func formatSeries(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, k := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
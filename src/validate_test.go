@@ -0,0 +1,69 @@
+package main
+
+import (
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/service-metrics-release/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("validateCollector", func() {
+	BeforeEach(func() {
+		cfg = defaultConfig()
+	})
+
+	validate := func(c collectorConfig, opts ...collectorOption) validation {
+		return validateCollector(c, lager.NewLogger("test"), metrics.NewRegistrySink(metrics.NewPrometheusRegistry()), metrics.NewSignatures(), opts...)
+	}
+
+	It("reports what a run of the metrics command recorded, renamed and rejected", func() {
+		v := validate(collectorConfig{
+			Name:    "echo",
+			Command: "/bin/echo",
+			Args: []string{`[
+				{"key": "my-key", "value": 3, "unit": "bytes"},
+				{"key": "size", "value": "three", "unit": "bytes"}
+			]`},
+			Format: "json",
+			Labels: map[string]string{"db": "one"},
+		})
+
+		Expect(v.Error).To(BeEmpty())
+		Expect(v.Accepted).To(ConsistOf(metrics.AcceptedSeries{
+			Type:   "gauge",
+			Name:   "my_key",
+			Labels: map[string]string{"unit": "bytes", "db": "one"},
+		}))
+		Expect(v.Renamed).To(ConsistOf(metrics.Rename{Kind: "metric", From: "my-key", To: "my_key"}))
+		Expect(v.Rejected).To(HaveLen(1))
+		Expect(v.valid()).To(BeFalse())
+	})
+
+	It("records an output it is given instead of running the metrics command", func() {
+		v := validate(collectorConfig{
+			Name:    "input",
+			Command: "-",
+			Format:  "json",
+		}, withExecutor(outputExecutor(`[{"name": "requests", "delta": 1}]`)))
+
+		Expect(v.Error).To(BeEmpty())
+		Expect(v.Accepted).To(ConsistOf(metrics.AcceptedSeries{Type: "counter", Name: "requests", Labels: map[string]string{}}))
+		Expect(v.valid()).To(BeTrue())
+	})
+
+	It("applies the relabel rules service metrics applies", func() {
+		regex := "size"
+		cfg.RelabelRules = relabelList{{Action: "drop", SourceLabels: []string{"__name__"}, Regex: &regex}}
+
+		v := validate(collectorConfig{
+			Name:    "echo",
+			Command: "/bin/echo",
+			Args:    []string{`[{"key": "size", "value": 3, "unit": "bytes"}]`},
+			Format:  "json",
+		})
+
+		Expect(v.Error).To(BeEmpty())
+		Expect(v.Accepted).To(BeEmpty())
+	})
+})